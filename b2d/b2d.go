@@ -7,14 +7,18 @@
 package b2d
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
 
 	"github.com/docker/machine/libmachine/log"
 )
@@ -27,7 +31,17 @@ const (
 )
 
 var (
+	// GithubAPIToken authenticates the release lookups to avoid the rate
+	// limit of anonymous GitHub API requests.
 	GithubAPIToken string
+	// ReleaseAPIURL is the GitHub (Enterprise) API URL of the latest
+	// Boot2Docker release. Defaults to the boot2docker/boot2docker repository.
+	ReleaseAPIURL string
+	// MirrorURL replaces the GitHub release download URL: the ISO of a
+	// release is downloaded from MirrorURL/<tag>/boot2docker.iso.
+	MirrorURL string
+	// Quiet disables the download progress.
+	Quiet bool
 )
 
 var (
@@ -70,6 +84,13 @@ func getRequest(apiURL string) (*http.Request, error) {
 	return req, nil
 }
 
+func releaseAPIURL() string {
+	if ReleaseAPIURL != "" {
+		return ReleaseAPIURL
+	}
+	return defaultURL
+}
+
 // releaseGetter is a client that gets release information of a product and downloads it.
 type releaseGetter interface {
 	// Filename returns filename of the product.
@@ -95,7 +116,7 @@ func (b *b2dReleaseGetter) Filename() string {
 // getReleaseTag gets the release tag of Boot2Docker from apiURL.
 func (*b2dReleaseGetter) getReleaseTag(apiURL string) (string, error) {
 	if apiURL == "" {
-		apiURL = defaultURL
+		apiURL = releaseAPIURL()
 	}
 
 	client := getClient()
@@ -125,7 +146,7 @@ func (*b2dReleaseGetter) getReleaseTag(apiURL string) (string, error) {
 // FIXME: find or create some other way to get the "latest release" of boot2docker since the GitHub API has a pretty low rate limit on API requests
 func (b *b2dReleaseGetter) GetReleaseURL(apiURL string) (string, error) {
 	if apiURL == "" {
-		apiURL = defaultURL
+		apiURL = releaseAPIURL()
 	}
 
 	// match github (enterprise) release urls:
@@ -145,6 +166,11 @@ func (b *b2dReleaseGetter) GetReleaseURL(apiURL string) (string, error) {
 
 	tag, err := b.getReleaseTag(apiURL)
 	if err != nil {
+		if MirrorURL == "" && apiURL == defaultURL {
+			// GitHub redirects to the latest release asset without any API request
+			log.Warnf("Could not get the latest Boot2Docker release: %s", err)
+			return fmt.Sprintf("https://github.com/%s/%s/releases/latest/download/%s", org, repo, b.isoFilename), nil
+		}
 		return "", err
 	}
 
@@ -157,6 +183,9 @@ See here for more details: %s
 Consider specifying another storage driver (e.g. 'overlay') using '--engine-storage-driver' instead.
 `, tag, bugURL)
 	}
+	if MirrorURL != "" {
+		return fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(MirrorURL, "/"), tag, b.isoFilename), nil
+	}
 	url := fmt.Sprintf("%s://%s/%s/%s/releases/download/%s/%s", scheme, host, org, repo, tag, b.isoFilename)
 	return url, nil
 }
@@ -244,6 +273,28 @@ func NewB2dUtils(storePath string) *B2dUtils {
 	}
 }
 
+// VersionURL returns the download URL of the Boot2Docker release tag.
+func (b *B2dUtils) VersionURL(tag string) string {
+	if MirrorURL != "" {
+		return fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(MirrorURL, "/"), tag, b.Filename())
+	}
+	return fmt.Sprintf("https://github.com/boot2docker/boot2docker/releases/download/%s/%s", tag, b.Filename())
+}
+
+// VersionFilename returns the name of the cached ISO of the release tag.
+func (b *B2dUtils) VersionFilename(tag string) string {
+	return fmt.Sprintf("boot2docker-%s.iso", tag)
+}
+
+// DownloadLatest downloads the latest Boot2Docker release into the cache.
+func (b *B2dUtils) DownloadLatest() error {
+	releaseURL, err := b.GetReleaseURL("")
+	if err != nil {
+		return err
+	}
+	return Download(b.ImgCachePath, b.Filename(), releaseURL)
+}
+
 func (b *B2dUtils) IsLatest() bool {
 	localVer, err := b.version()
 	if err != nil {
@@ -259,3 +310,36 @@ func (b *B2dUtils) IsLatest() bool {
 
 	return localVer == latestVer
 }
+
+// VerifyChecksum checks the SHA256 checksum of the file at path against
+// checksum, a hex string optionally prefixed with "sha256:".
+func VerifyChecksum(path, checksum string) error {
+	expected := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(checksum), "sha256:"))
+	if _, err := hex.DecodeString(expected); err != nil || len(expected) != sha256.Size*2 {
+		return fmt.Errorf("invalid SHA256 checksum %q", checksum)
+	}
+
+	actual, err := Checksum(path)
+	if err != nil {
+		return err
+	}
+	if actual != expected {
+		return fmt.Errorf("SHA256 checksum mismatch for %s: expected %s, got %s", path, expected, actual)
+	}
+	return nil
+}
+
+// Checksum returns the hex SHA256 checksum of the file at path.
+func Checksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,236 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package b2d
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+const (
+	downloadAttempts   = 5
+	downloadBackoff    = time.Second
+	downloadMaxBackoff = 30 * time.Second
+)
+
+// Download fetches srcURL into dir/file. Local paths and file:// URLs are
+// copied. HTTP downloads are kept in a ".part" file and resumed with range
+// requests when the connection drops, retrying with an exponential backoff.
+// A ".part" file is only resumed for the file it was started with, see
+// downloadPart.
+// dir/file is replaced by a rename once complete, so the readers of a shared
+// cache never see a partial file.
+func Download(dir, file, srcURL string) error {
+	u, err := url.Parse(srcURL)
+	if err != nil {
+		return err
+	}
+	dest := filepath.Join(dir, file)
+
+	if u.Scheme == "file" || u.Scheme == "" {
+		log.Infof("Copying %s to %s...", u.Path, dest)
+		return copyFile(u.Path, dest)
+	}
+
+	log.Infof("Downloading %s from %s...", dest, srcURL)
+	part := dest + ".part"
+	backoff := downloadBackoff
+	for attempt := 1; ; attempt++ {
+		err = downloadPart(part, srcURL)
+		if err == nil {
+			break
+		}
+		if attempt == downloadAttempts {
+			return fmt.Errorf("Could not download %s after %d attempts: %s", srcURL, attempt, err)
+		}
+		log.Warnf("Download of %s interrupted: %s. Resuming in %s...", srcURL, err, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > downloadMaxBackoff {
+			backoff = downloadMaxBackoff
+		}
+	}
+
+	os.Remove(part + partSourceSuffix)
+	return os.Rename(part, dest)
+}
+
+// partSourceSuffix names the file next to a ".part" file recording what it
+// is a part of.
+const partSourceSuffix = ".source"
+
+// partSource is the download a ".part" file is a part of: the URL, and the
+// ETag or else the Last-Modified date and the length of the response it was
+// started with.
+type partSource struct {
+	URL       string `json:"url"`
+	Validator string `json:"validator,omitempty"`
+	Length    int64  `json:"length"`
+}
+
+func readPartSource(part string) partSource {
+	var source partSource
+	if data, err := ioutil.ReadFile(part + partSourceSuffix); err == nil {
+		json.Unmarshal(data, &source)
+	}
+	return source
+}
+
+func writePartSource(part string, source partSource) error {
+	data, err := json.Marshal(source)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(part+partSourceSuffix, data, 0644)
+}
+
+// responseValidator returns the validator of rsp If-Range takes back, a
+// strong ETag or else the Last-Modified date.
+func responseValidator(rsp *http.Response) string {
+	if etag := rsp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return rsp.Header.Get("Last-Modified")
+}
+
+// contentRangeLength returns the complete length of a partial response, -1
+// when it is unknown.
+func contentRangeLength(rsp *http.Response) int64 {
+	cr := rsp.Header.Get("Content-Range")
+	i := strings.LastIndex(cr, "/")
+	if i < 0 {
+		return -1
+	}
+	length, err := strconv.ParseInt(cr[i+1:], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return length
+}
+
+// downloadPart appends the missing bytes of srcURL to the partial download
+// part. A part left by another URL is started over, and so is a part of a
+// file which changed since, told by its validator or else its length.
+func downloadPart(part, srcURL string) error {
+	f, err := os.OpenFile(part, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	source := readPartSource(part)
+	if offset > 0 && (source.URL != srcURL || (source.Validator == "" && source.Length < 0)) {
+		log.Debugf("Discarding the partial download of %q", source.URL)
+		if offset, err = restartPart(f); err != nil {
+			return err
+		}
+	}
+
+	// not getRequest, the GitHub token must not leak to mirrors
+	req, err := http.NewRequest("GET", srcURL, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if source.Validator != "" {
+			// the server sends the whole file instead when it changed
+			req.Header.Set("If-Range", source.Validator)
+		}
+	}
+
+	rsp, err := getClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	switch rsp.StatusCode {
+	case http.StatusPartialContent:
+		if source.Validator == "" && contentRangeLength(rsp) != source.Length {
+			restartPart(f)
+			return fmt.Errorf("%s changed since the partial download", srcURL)
+		}
+		log.Debugf("Resuming download at %d bytes", offset)
+	case http.StatusOK:
+		// the server ignored the range, or the file changed: start over
+		if offset, err = restartPart(f); err != nil {
+			return err
+		}
+		source = partSource{URL: srcURL, Validator: responseValidator(rsp), Length: rsp.ContentLength}
+		if err := writePartSource(part, source); err != nil {
+			return err
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the previous attempt already got everything
+		if offset == source.Length {
+			return nil
+		}
+		restartPart(f)
+		return fmt.Errorf("%s changed since the partial download", srcURL)
+	default:
+		return fmt.Errorf("unexpected HTTP status %s", rsp.Status)
+	}
+
+	var body io.Reader = rsp.Body
+	if !Quiet {
+		total := int64(-1)
+		if rsp.ContentLength >= 0 {
+			total = offset + rsp.ContentLength
+		}
+		body = newProgressReader(rsp.Body, "Downloading "+filepath.Base(strings.TrimSuffix(part, ".part")), offset, total)
+	}
+	if _, err = io.Copy(f, body); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// restartPart empties the partial download f.
+func restartPart(f *os.File) (int64, error) {
+	if err := f.Truncate(0); err != nil {
+		return 0, err
+	}
+	return f.Seek(0, io.SeekStart)
+}
+
+// copyFile copies src to a temporary file renamed to dest.
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := fmt.Sprintf("%s.%d.tmp", dest, os.Getpid())
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
@@ -0,0 +1,97 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package b2d
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// Progress logs the progress of a long transfer of Total bytes, with the
+// bytes done and the estimated time left.
+type Progress struct {
+	// What names the transfer in the log, like "Downloading boot2docker.iso".
+	What  string
+	Total int64
+
+	began     time.Time
+	startDone int64
+}
+
+// NewProgress starts the progress of a transfer of total bytes, done of
+// which are already there, like the part of a resumed download.
+func NewProgress(what string, done, total int64) *Progress {
+	return &Progress{What: what, Total: total, began: time.Now(), startDone: done}
+}
+
+// Log logs that done bytes were transferred.
+func (p *Progress) Log(done int64) {
+	if p.Total <= 0 {
+		log.Infof("%s: %s", p.What, formatBytes(done))
+		return
+	}
+	msg := fmt.Sprintf("%s: %d%% (%s of %s", p.What, done*100/p.Total, formatBytes(done), formatBytes(p.Total))
+	if left := p.left(done); left > 0 {
+		msg += fmt.Sprintf(", %s left", left)
+	}
+	log.Infof("%s)", msg)
+}
+
+// left estimates the time left from the rate since the start.
+func (p *Progress) left(done int64) time.Duration {
+	elapsed := time.Since(p.began)
+	if done <= p.startDone || done >= p.Total || elapsed < time.Second {
+		return 0
+	}
+	rate := float64(done-p.startDone) / elapsed.Seconds()
+	return (time.Duration(float64(p.Total-done)/rate) * time.Second).Round(time.Second)
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+// progressInterval is the least time between two progress lines of a reader
+const progressInterval = 2 * time.Second
+
+// progressReader logs the progress of the bytes read from r every 10%, or
+// every progressInterval when the size is unknown.
+type progressReader struct {
+	r        io.Reader
+	progress *Progress
+	done     int64
+	next     int64
+	logged   time.Time
+}
+
+func newProgressReader(r io.Reader, what string, done, total int64) *progressReader {
+	return &progressReader{r: r, progress: NewProgress(what, done, total), done: done, next: done}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.done += int64(n)
+	total := p.progress.Total
+	switch {
+	case total > 0 && p.done >= p.next:
+		p.progress.Log(p.done)
+		p.next = (p.done*10/total + 1) * total / 10
+	case total <= 0 && time.Since(p.logged) >= progressInterval:
+		p.progress.Log(p.done)
+		p.logged = time.Now()
+	}
+	return n, err
+}
@@ -0,0 +1,58 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package b2d
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// logProgress reads data through a progressReader, one byte per read, and
+// returns the progress lines it logged.
+func logProgress(data []byte, done, total int64) []string {
+	var out bytes.Buffer
+	log.SetOutWriter(&out)
+	defer log.SetOutWriter(os.Stdout)
+
+	r := newProgressReader(iotest.OneByteReader(bytes.NewReader(data)), "Downloading boot2docker.iso", done, total)
+	io.Copy(ioutil.Discard, r)
+	return strings.Split(strings.TrimSpace(out.String()), "\n")
+}
+
+func TestProgressReader(t *testing.T) {
+	// a line at the start and at every 10%
+	lines := logProgress(make([]byte, 100), 0, 100)
+	assert.Len(t, lines, 11)
+	assert.Equal(t, "Downloading boot2docker.iso: 1% (1 B of 100 B)", lines[0])
+	assert.Equal(t, "Downloading boot2docker.iso: 10% (10 B of 100 B)", lines[1])
+	assert.Equal(t, "Downloading boot2docker.iso: 50% (50 B of 100 B)", lines[5])
+	assert.Equal(t, "Downloading boot2docker.iso: 100% (100 B of 100 B)", lines[10])
+
+	// a resumed download counts the bytes already there
+	lines = logProgress(make([]byte, 40), 60, 100)
+	assert.Len(t, lines, 5)
+	assert.Equal(t, "Downloading boot2docker.iso: 61% (61 B of 100 B)", lines[0])
+	assert.Equal(t, "Downloading boot2docker.iso: 70% (70 B of 100 B)", lines[1])
+	assert.Equal(t, "Downloading boot2docker.iso: 100% (100 B of 100 B)", lines[4])
+
+	// an unknown size is logged every progressInterval, the first read at once
+	lines = logProgress(make([]byte, 2048), 0, -1)
+	assert.Equal(t, []string{"Downloading boot2docker.iso: 1 B"}, lines)
+}
+
+func TestFormatBytes(t *testing.T) {
+	assert.Equal(t, "512 B", formatBytes(512))
+	assert.Equal(t, "1.5 KB", formatBytes(1536))
+	assert.Equal(t, "20.0 MB", formatBytes(20<<20))
+	assert.Equal(t, "1.2 GB", formatBytes(1288490189))
+}
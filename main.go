@@ -5,18 +5,79 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
 
+	"github.com/docker/machine/commands/mcndirs"
 	"github.com/docker/machine/libmachine/drivers/plugin"
 	"github.com/docker/machine/libmachine/ssh"
 	"github.com/zchee/docker-machine-driver-xhyve/xhyve"
 	hyperkit "github.com/zchee/libhyperkit"
 )
 
+// usage documents the machine commands of the driver binary.
+const usage = `Usage:
+  %[1]s export <machine> <file.tar.gz>
+  %[1]s import <file.tar.gz> <machine>
+  %[1]s migrate-virtualbox <machine> [<new machine>]
+  %[1]s snapshot create|restore|delete <machine> <snapshot>
+  %[1]s snapshot list <machine>
+  %[1]s pause|resume <machine>
+  %[1]s dry-run <machine>
+  %[1]s diagnose <machine>
+  %[1]s stats <machine>
+  %[1]s create-nodes <prefix> <count> [<create flags>...]
+  %[1]s cleanup
+  %[1]s repair-vmnet
+  %[1]s capabilities
+`
+
+// machineCommands are the first arguments of the machine commands.
+var machineCommands = map[string]bool{
+	"export":             true,
+	"import":             true,
+	"migrate-virtualbox": true,
+	"snapshot":           true,
+	"pause":              true,
+	"resume":             true,
+	"dry-run":            true,
+	"diagnose":           true,
+	"stats":              true,
+	"create-nodes":       true,
+	"cleanup":            true,
+	"repair-vmnet":       true,
+	"capabilities":       true,
+}
+
 func main() {
-	if len(os.Args) >= 2 && os.Args[1] == "xhyve" {
-		runXhyve()
+	if isHelper() {
+		runHelper(os.Args[1:])
+	} else if len(os.Args) >= 2 && os.Args[1] == "xhyve" {
+		runXhyve(os.Args[1:], func(pty string) error {
+			return xhyve.LogConsole(pty, os.Getenv(xhyve.ConsoleLogEnv))
+		})
+	} else if len(os.Args) == 2 && os.Args[1] == "supervise" {
+		ssh.SetDefaultClient(ssh.Native)
+		if err := xhyve.Supervise(os.Stdin); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	} else if len(os.Args) == 2 && xhyve.IsBackgroundTask(os.Args[1]) {
+		ssh.SetDefaultClient(ssh.Native)
+		if err := xhyve.RunBackgroundTask(os.Args[1], os.Stdin); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	} else if len(os.Args) == 2 && os.Args[1] == "fake-vm" {
+		if err := xhyve.FakeVM(os.Stdin); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	} else if len(os.Args) >= 2 && machineCommands[os.Args[1]] {
+		runMachineCommand(os.Args[1:])
 	} else {
 		// Using the native driver gives much better performance.
 		ssh.SetDefaultClient(ssh.Native)
@@ -24,11 +85,115 @@ func main() {
 	}
 }
 
-func runXhyve() {
+// runMachineCommand runs the machine commands working directly on the
+// docker-machine store, like "export <machine> <file>".
+func runMachineCommand(args []string) {
+	storePath := mcndirs.GetBaseDir()
+
+	var err error
+	switch {
+	case args[0] == "export" && len(args) == 3:
+		err = xhyve.ExportMachine(storePath, args[1], args[2])
+	case args[0] == "import" && len(args) == 3:
+		err = xhyve.ImportMachine(storePath, args[1], args[2])
+	case args[0] == "migrate-virtualbox" && (len(args) == 2 || len(args) == 3):
+		ssh.SetDefaultClient(ssh.Native)
+		err = xhyve.MigrateVirtualBox(storePath, args[1], args[len(args)-1])
+	case args[0] == "snapshot" && len(args) == 3 && args[1] == "list":
+		var names []string
+		if names, err = xhyve.ListSnapshots(storePath, args[2]); err == nil {
+			for _, name := range names {
+				fmt.Println(name)
+			}
+		}
+	case args[0] == "snapshot" && len(args) == 4 && args[1] == "create":
+		err = xhyve.CreateSnapshot(storePath, args[2], args[3])
+	case args[0] == "snapshot" && len(args) == 4 && args[1] == "restore":
+		err = xhyve.RestoreSnapshot(storePath, args[2], args[3])
+	case args[0] == "snapshot" && len(args) == 4 && args[1] == "delete":
+		err = xhyve.DeleteSnapshot(storePath, args[2], args[3])
+	case args[0] == "pause" && len(args) == 2:
+		err = xhyve.PauseMachine(storePath, args[1])
+	case args[0] == "resume" && len(args) == 2:
+		ssh.SetDefaultClient(ssh.Native)
+		err = xhyve.ResumeMachine(storePath, args[1])
+	case args[0] == "dry-run" && len(args) == 2:
+		err = xhyve.DryRun(storePath, args[1], os.Stdout)
+	case args[0] == "diagnose" && len(args) == 2:
+		err = xhyve.Diagnose(storePath, args[1], os.Stdout)
+	case args[0] == "stats" && len(args) == 2:
+		ssh.SetDefaultClient(ssh.Native)
+		err = xhyve.PrintStats(storePath, args[1], os.Stdout)
+	case args[0] == "create-nodes" && len(args) >= 3:
+		var count int
+		if count, err = strconv.Atoi(args[2]); err == nil {
+			err = xhyve.CreateNodes(storePath, args[1], count, args[3:], os.Stdout)
+		}
+	case args[0] == "cleanup" && len(args) == 1:
+		err = xhyve.Cleanup(storePath, os.Stdout)
+	case args[0] == "repair-vmnet" && len(args) == 1:
+		err = xhyve.RepairVmnet(os.Stdout)
+	case args[0] == "capabilities" && len(args) == 1:
+		var out []byte
+		if out, err = json.MarshalIndent(xhyve.GetCapabilities(), "", "  "); err == nil {
+			fmt.Println(string(out))
+		}
+	default:
+		fmt.Fprintf(os.Stderr, usage, os.Args[0])
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// isHelper reports whether the binary runs as the helper, under the name it
+// was run with or the name of its file.
+func isHelper() bool {
+	if filepath.Base(os.Args[0]) == xhyve.HelperName {
+		return true
+	}
+	exe, err := os.Executable()
+	return err == nil && filepath.Base(exe) == xhyve.HelperName
+}
+
+// runHelper runs the commands of the setuid root helper, which does nothing
+// else than running the hypervisor and removing the DHCP leases of removed
+// machines. It builds the hypervisor arguments itself, it never runs those it
+// is given.
+func runHelper(args []string) {
+	var err error
+	switch {
+	case len(args) == 1 && args[0] == "run":
+		var vm *xhyve.HelperVM
+		if vm, err = xhyve.OpenHelperVM(os.Stdin); err == nil {
+			runXhyve(vm.Args, vm.LogConsole)
+			vm.Close()
+		}
+	case len(args) == 2 && args[0] == "mac-address":
+		var xhyveArgs []string
+		if xhyveArgs, err = xhyve.HelperMACArgs(args[1]); err == nil {
+			runXhyve(xhyveArgs, nil)
+		}
+	case len(args) == 1 && args[0] == "remove-lease":
+		err = xhyve.RemoveHelperLease(os.Stdin)
+	default:
+		fmt.Fprintf(os.Stderr, "%s only runs the hypervisor for docker-machine-driver-xhyve\n", xhyve.HelperName)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// runXhyve runs the embedded hypervisor with args, whose first argument is
+// ignored, and copies the kernel log of com2 with logConsole.
+func runXhyve(args []string, logConsole func(pty string) error) {
 	done := make(chan bool)
 	ptyCh := make(chan string)
 
-	args := os.Args[1:] // Technically we only need 2:, but a bug in hooklift/xhyve requires one arg in the beginning
 	go func() {
 		if err := hyperkit.Run(args, ptyCh); err != nil {
 			fmt.Println(err)
@@ -36,11 +201,18 @@ func runXhyve() {
 		done <- true
 	}()
 
-	if os.Args[len(os.Args)-1] != "-M" {
+	if args[len(args)-1] != "-M" {
 		fmt.Printf("Waiting on a pseudo-terminal to be ready... ")
 		pty := <-ptyCh
 		fmt.Printf("done\n")
 		fmt.Printf("Hook up your terminal emulator to %s in order to connect to your VM\n", pty)
+
+		// com2 carries the kernel log, keep a copy of it in the machine directory
+		go func() {
+			if err := logConsole(<-ptyCh); err != nil {
+				fmt.Println(err)
+			}
+		}()
 	}
 
 	<-done
@@ -0,0 +1,135 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vmnet
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+)
+
+const (
+	// BOOTPTAB_FILE holds the static IP bindings of the vmnet DHCP server
+	BOOTPTAB_FILE = "/etc/bootptab"
+
+	// bootptabHeader ends the unused bootp part of the bootptab, the DHCP
+	// bindings follow it
+	bootptabHeader = "%%"
+)
+
+// StaticBinding is a static IP binding of the bootptab.
+type StaticBinding struct {
+	Name      string
+	HWAddress string
+	IPAddress string
+}
+
+// GetStaticBindings returns the static IP bindings of the bootptab, none
+// when there is no bootptab.
+func GetStaticBindings() ([]StaticBinding, error) {
+	data, err := ioutil.ReadFile(BOOTPTAB_FILE)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseBootptab(data), nil
+}
+
+// parseBootptab returns the bindings of the bootptab data, lines of a name,
+// the hardware type 1 of ethernet, a MAC address and an IP address.
+func parseBootptab(data []byte) []StaticBinding {
+	var bindings []StaticBinding
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || strings.HasPrefix(fields[0], "#") || fields[1] != "1" {
+			continue
+		}
+		bindings = append(bindings, StaticBinding{fields[0], fields[2], fields[3]})
+	}
+	return bindings
+}
+
+// AddStaticBinding binds the IP address of b to its MAC address in the
+// bootptab, which only root can write, replacing the previous bindings of
+// the MAC address.
+func AddStaticBinding(b StaticBinding) error {
+	return editBootptab(os.O_CREATE, func(data []byte) []byte {
+		kept, _ := removeBindings(data, b.HWAddress)
+		if len(kept) > 0 && kept[len(kept)-1] != '\n' {
+			kept = append(kept, '\n')
+		}
+		if !bytes.Contains(kept, []byte(bootptabHeader+"\n")) {
+			kept = append([]byte(bootptabHeader+"\n"), kept...)
+		}
+		return append(kept, fmt.Sprintf("%s 1 %s %s\n", b.Name, b.HWAddress, b.IPAddress)...)
+	})
+}
+
+// RemoveStaticBindingsByMACAddress removes the static IP bindings of the MAC
+// address mac from the bootptab. It returns the number of bindings removed.
+func RemoveStaticBindingsByMACAddress(mac string) (int, error) {
+	var removed int
+	err := editBootptab(0, func(data []byte) []byte {
+		var kept []byte
+		kept, removed = removeBindings(data, mac)
+		return kept
+	})
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	return removed, err
+}
+
+// editBootptab replaces the bootptab data with edit(data), holding its lock.
+// flag is os.O_CREATE to create a missing bootptab.
+func editBootptab(flag int, edit func(data []byte) []byte) error {
+	file, err := os.OpenFile(BOOTPTAB_FILE, os.O_RDWR|flag, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	edited := edit(data)
+	if bytes.Equal(edited, data) {
+		return nil
+	}
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	_, err = file.WriteAt(edited, 0)
+	return err
+}
+
+// removeBindings returns the bootptab data without the bindings of the MAC
+// address mac, and the number of bindings removed.
+func removeBindings(data []byte, mac string) ([]byte, int) {
+	var (
+		kept    bytes.Buffer
+		removed int
+	)
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 4 && fields[1] == "1" && fields[2] == mac && !strings.HasPrefix(fields[0], "#") {
+			removed++
+			continue
+		}
+		kept.WriteString(line)
+	}
+	return kept.Bytes(), removed
+}
@@ -0,0 +1,56 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vmnet
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testBootptab = `# bootptab
+%%
+# machine entries
+dev 1 aa:bb:cc:dd:ee:1 192.168.64.128
+#old 1 aa:bb:cc:dd:ee:2 192.168.64.129
+printer 6 aa:bb:cc:dd:ee:3 192.168.64.130
+node-1 1 aa:bb:cc:dd:ee:4 192.168.64.131
+dev-again 1 aa:bb:cc:dd:ee:1 192.168.64.132
+`
+
+func TestParseBootptab(t *testing.T) {
+	assert.Equal(t, []StaticBinding{
+		{"dev", "aa:bb:cc:dd:ee:1", "192.168.64.128"},
+		{"node-1", "aa:bb:cc:dd:ee:4", "192.168.64.131"},
+		{"dev-again", "aa:bb:cc:dd:ee:1", "192.168.64.132"},
+	}, parseBootptab([]byte(testBootptab)))
+
+	assert.Empty(t, parseBootptab(nil))
+	assert.Empty(t, parseBootptab([]byte("%%\ndev 1 aa:bb:cc:dd:ee:1\n")))
+}
+
+func TestRemoveBindings(t *testing.T) {
+	kept, removed := removeBindings([]byte(testBootptab), "aa:bb:cc:dd:ee:1")
+	assert.Equal(t, 2, removed)
+	assert.Equal(t, `# bootptab
+%%
+# machine entries
+#old 1 aa:bb:cc:dd:ee:2 192.168.64.129
+printer 6 aa:bb:cc:dd:ee:3 192.168.64.130
+node-1 1 aa:bb:cc:dd:ee:4 192.168.64.131
+`, string(kept))
+
+	// commented out and non ethernet entries are kept
+	kept, removed = removeBindings([]byte(testBootptab), "aa:bb:cc:dd:ee:2")
+	assert.Equal(t, 0, removed)
+	assert.Equal(t, testBootptab, string(kept))
+	_, removed = removeBindings([]byte(testBootptab), "aa:bb:cc:dd:ee:3")
+	assert.Equal(t, 0, removed)
+
+	// the last line may have no newline
+	kept, removed = removeBindings([]byte("%%\nnode-1 1 aa:bb:cc:dd:ee:4 192.168.64.131"), "aa:bb:cc:dd:ee:4")
+	assert.Equal(t, 1, removed)
+	assert.Equal(t, "%%\n", string(kept))
+}
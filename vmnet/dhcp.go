@@ -9,9 +9,13 @@ package vmnet
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
 	"strings"
+	"syscall"
 )
 
 const (
@@ -27,12 +31,24 @@ type DHCPEntry struct {
 }
 
 func parseDHCPdLeasesFile() ([]DHCPEntry, error) {
-	file, err := os.Open(DHCPD_LEASES_FILE)
+	return ParseLeasesFile(DHCPD_LEASES_FILE)
+}
+
+// ParseLeasesFile returns the DHCP leases of the file path, in the format of
+// the leases file of the vmnet DHCP server.
+func ParseLeasesFile(path string) ([]DHCPEntry, error) {
+	file, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
 
+	// bootpd does not lock the file, this only serializes the drivers
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_SH); err != nil {
+		return nil, err
+	}
+	defer syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+
 	var (
 		dhcpEntry   *DHCPEntry
 		dhcpEntries []DHCPEntry
@@ -44,11 +60,15 @@ func parseDHCPdLeasesFile() ([]DHCPEntry, error) {
 		if line == "{" {
 			dhcpEntry = new(DHCPEntry)
 		}
+		if dhcpEntry == nil {
+			// the file is being rewritten
+			continue
+		}
 		if strings.HasPrefix(line, "name=") {
 			dhcpEntry.Name = line[5:]
 		}
 		if strings.HasPrefix(line, "ip_address=") {
-			dhcpEntry.IPAddress = line[11:]
+			dhcpEntry.IPAddress = normalizeIP(line[11:])
 		}
 		if strings.HasPrefix(line, "hw_address=") {
 			dhcpEntry.HWAddress = line[13:]
@@ -61,24 +81,67 @@ func parseDHCPdLeasesFile() ([]DHCPEntry, error) {
 		}
 		if line == "}" {
 			dhcpEntries = append(dhcpEntries, *dhcpEntry)
+			dhcpEntry = nil
 		}
 	}
 	return dhcpEntries, scanner.Err()
 }
 
+// normalizeIP returns the canonical form of the IPv4 or IPv6 address ip, so
+// that the addresses of the leases compare equal to the addresses of net.
+func normalizeIP(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		return parsed.String()
+	}
+	return ip
+}
+
+// GetIPAddressByMACAddress returns the IP address leased to the MAC address
+// mac. Its IPv4 address is preferred over its IPv6 address on dual-stack
+// networks.
 func GetIPAddressByMACAddress(mac string) (string, error) {
 	dhcpEntries, err := parseDHCPdLeasesFile()
 	if err != nil {
 		return "", err
 	}
+	var ipv6 string
 	for _, dhcpEntry := range dhcpEntries {
-		if dhcpEntry.HWAddress == mac {
+		if dhcpEntry.HWAddress != mac {
+			continue
+		}
+		if !strings.Contains(dhcpEntry.IPAddress, ":") {
 			return dhcpEntry.IPAddress, nil
 		}
+		if ipv6 == "" {
+			ipv6 = dhcpEntry.IPAddress
+		}
+	}
+	if ipv6 != "" {
+		return ipv6, nil
 	}
 	return "", fmt.Errorf("Could not find an IP address for %s", mac)
 }
 
+// GetLeases returns the DHCP leases of the leases file.
+func GetLeases() ([]DHCPEntry, error) {
+	return parseDHCPdLeasesFile()
+}
+
+// GetLeasesByMACAddress returns the DHCP leases of the MAC address mac.
+func GetLeasesByMACAddress(mac string) ([]DHCPEntry, error) {
+	dhcpEntries, err := parseDHCPdLeasesFile()
+	if err != nil {
+		return nil, err
+	}
+	var leases []DHCPEntry
+	for _, dhcpEntry := range dhcpEntries {
+		if dhcpEntry.HWAddress == mac {
+			leases = append(leases, dhcpEntry)
+		}
+	}
+	return leases, nil
+}
+
 func GetIPAddressByName(name string) (string, error) {
 	dhcpEntries, err := parseDHCPdLeasesFile()
 	if err != nil {
@@ -91,3 +154,69 @@ func GetIPAddressByName(name string) (string, error) {
 	}
 	return "", fmt.Errorf("Could not find an IP address for %s", name)
 }
+
+// RemoveLeasesByMACAddress removes the DHCP leases of the MAC address mac
+// from the leases file, which only root can write. It returns the number of
+// leases removed.
+func RemoveLeasesByMACAddress(mac string) (int, error) {
+	file, err := os.OpenFile(DHCPD_LEASES_FILE, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		return 0, err
+	}
+	defer syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return 0, err
+	}
+	kept, removed := removeLeases(data, mac)
+	if removed == 0 {
+		return 0, nil
+	}
+	if err := file.Truncate(0); err != nil {
+		return 0, err
+	}
+	_, err = file.WriteAt(kept, 0)
+	return removed, err
+}
+
+// removeLeases returns the leases file data without the entries of the MAC
+// address mac, and the number of entries removed.
+func removeLeases(data []byte, mac string) ([]byte, int) {
+	var (
+		kept    bytes.Buffer
+		entry   []string
+		drop    bool
+		removed int
+	)
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "{" {
+			entry, drop = nil, false
+		}
+		if entry == nil && trimmed != "{" {
+			kept.WriteString(line)
+			continue
+		}
+		entry = append(entry, line)
+		if strings.HasPrefix(trimmed, "hw_address=") && len(trimmed) > 13 && trimmed[13:] == mac {
+			drop = true
+		}
+		if trimmed == "}" {
+			if drop {
+				removed++
+			} else {
+				kept.WriteString(strings.Join(entry, ""))
+			}
+			entry = nil
+		}
+	}
+	// an unterminated entry is kept as is
+	kept.WriteString(strings.Join(entry, ""))
+	return kept.Bytes(), removed
+}
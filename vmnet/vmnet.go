@@ -21,16 +21,32 @@ const (
 	NET_MASK_KEY = "Shared_Net_Mask"
 )
 
+// Output runs the defaults commands reading the vmnet configuration and
+// returns their standard output, like exec.Cmd.Output. The driver replaces it
+// to run them like its other commands.
+var Output = func(cmd *exec.Cmd) ([]byte, error) {
+	return cmd.Output()
+}
+
+// readConfig returns the value of key in the vmnet configuration.
+func readConfig(key string) (string, error) {
+	out, err := Output(exec.Command("defaults", "read", CONFIG_PLIST, key))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
 func GetNetAddr() (net.IP, error) {
 	if !IsExist(CONFIG_PLIST + ".plist") {
 		return nil, fmt.Errorf("Does not exist %s", CONFIG_PLIST+".plist")
 	}
 
-	out, err := exec.Command("defaults", "read", CONFIG_PLIST, NET_ADDR_KEY).Output()
+	out, err := readConfig(NET_ADDR_KEY)
 	if err != nil {
 		return nil, err
 	}
-	ip := net.ParseIP(strings.TrimSpace(string(out)))
+	ip := net.ParseIP(out)
 	if ip == nil {
 		return nil, fmt.Errorf("Could not get the network address for vmnet")
 	}
@@ -42,11 +58,11 @@ func getNetMask() (net.IPMask, error) {
 		return nil, fmt.Errorf("Does not exist %s", CONFIG_PLIST+".plist")
 	}
 
-	out, err := exec.Command("defaults", "read", CONFIG_PLIST, NET_MASK_KEY).Output()
+	out, err := readConfig(NET_MASK_KEY)
 	if err != nil {
 		return nil, err
 	}
-	mask := net.ParseIP(strings.TrimSpace(string(out)))
+	mask := net.ParseIP(out)
 	if mask == nil {
 		return nil, fmt.Errorf("Could not get the network mask for vmnet")
 	}
@@ -70,6 +86,68 @@ func GetIPNet() (*net.IPNet, error) {
 	}, nil
 }
 
+// CheckConfig checks the vmnet configuration plist, which vmnet writes with
+// its defaults when it does not exist. A truncated plist, or an invalid
+// shared network makes vmnet give the guests no IP address.
+func CheckConfig() error {
+	fi, err := os.Stat(CONFIG_PLIST + ".plist")
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Size() == 0 {
+		return fmt.Errorf("%s.plist is empty", CONFIG_PLIST)
+	}
+
+	ip, err := GetNetAddr()
+	if err != nil {
+		return fmt.Errorf("%s has no valid %s: %s", CONFIG_PLIST, NET_ADDR_KEY, err)
+	}
+	mask, err := getNetMask()
+	if err != nil {
+		return fmt.Errorf("%s has no valid %s: %s", CONFIG_PLIST, NET_MASK_KEY, err)
+	}
+	return checkSharedNet(ip, mask)
+}
+
+// checkSharedNet checks the host address ip of the shared network and its
+// mask make a private IPv4 network with room for guests.
+func checkSharedNet(ip net.IP, mask net.IPMask) error {
+	ip4 := ip.To4()
+	if ip4 == nil || len(mask) != net.IPv4len {
+		return fmt.Errorf("%s %s/%s is not an IPv4 network", NET_ADDR_KEY, ip, net.IP(mask))
+	}
+	ones, bits := mask.Size()
+	if bits == 0 || ones < 8 || ones > 30 {
+		return fmt.Errorf("%s %s is not a valid network mask", NET_MASK_KEY, net.IP(mask))
+	}
+	if !isPrivate(ip4) {
+		return fmt.Errorf("%s %s is not a private address", NET_ADDR_KEY, ip)
+	}
+	network := ip4.Mask(mask)
+	broadcast := make(net.IP, net.IPv4len)
+	for i := range network {
+		broadcast[i] = network[i] | ^mask[i]
+	}
+	if ip4.Equal(network) || ip4.Equal(broadcast) {
+		return fmt.Errorf("%s %s is the network or broadcast address of %s/%d", NET_ADDR_KEY, ip, network, ones)
+	}
+	return nil
+}
+
+// isPrivate reports whether the IPv4 address ip is in a private range.
+func isPrivate(ip net.IP) bool {
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"} {
+		_, n, _ := net.ParseCIDR(cidr)
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 // IsExist returns whether the filename is exists.
 func IsExist(filename string) bool {
 	_, err := os.Stat(filename)
@@ -0,0 +1,139 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/mcnflag"
+)
+
+// auditLogFilename is the audit log of the machine operations, in the store
+const auditLogFilename = "xhyve-audit.log"
+
+// auditRedactedFlags are the flags whose values are not written to the
+// audit log.
+var auditRedactedFlags = map[string]bool{
+	"xhyve-github-api-token": true,
+}
+
+// auditEntry is a JSON line of the audit log.
+type auditEntry struct {
+	Time    time.Time `json:"time"`
+	User    string    `json:"user"`
+	Op      string    `json:"op"`
+	Machine string    `json:"machine"`
+	Flags   []string  `json:"flags,omitempty"`
+	Outcome string    `json:"outcome"`
+	Error   string    `json:"error,omitempty"`
+}
+
+func (d *Driver) auditLogPath() string {
+	return filepath.Join(d.StorePath, auditLogFilename)
+}
+
+// auditUser returns the user running the driver, the one behind sudo when
+// run with it.
+func auditUser() string {
+	if name := os.Getenv("SUDO_USER"); name != "" {
+		return name
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// auditFlags returns the create flags of flags which differ from their
+// defaults, as --name=value arguments. The secrets and the passwords of the
+// URLs are redacted.
+func auditFlags(flags drivers.DriverOptions, createFlags []mcnflag.Flag) []string {
+	var args []string
+	for _, f := range createFlags {
+		var value string
+		switch flag := f.(type) {
+		case mcnflag.StringFlag:
+			if value = flags.String(flag.Name); value == flag.Value {
+				continue
+			}
+		case mcnflag.IntFlag:
+			n := flags.Int(flag.Name)
+			if n == flag.Value {
+				continue
+			}
+			value = fmt.Sprint(n)
+		case mcnflag.BoolFlag:
+			if !flags.Bool(flag.Name) {
+				continue
+			}
+			args = append(args, "--"+flag.Name)
+			continue
+		case mcnflag.StringSliceFlag:
+			values := flags.StringSlice(flag.Name)
+			if value = strings.Join(values, ","); value == strings.Join(flag.Value, ",") {
+				continue
+			}
+		default:
+			continue
+		}
+		if auditRedactedFlags[f.String()] {
+			value = "REDACTED"
+		} else if u, err := url.Parse(value); err == nil && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				u.User = url.UserPassword(u.User.Username(), "REDACTED")
+				value = u.String()
+			}
+		}
+		args = append(args, "--"+f.String()+"="+value)
+	}
+	return args
+}
+
+// audit appends the outcome of op, failed with *err, to the audit log of the
+// store, for the shared hosts where the users want to know who removed their
+// machine. The log is only opened for appending, an entry which can not be
+// written only warns. A driver without store has no audit log.
+func (d *Driver) audit(op string, err *error) {
+	if d.StorePath == "" {
+		return
+	}
+	e := auditEntry{
+		Time:    time.Now().UTC(),
+		User:    auditUser(),
+		Op:      op,
+		Machine: d.MachineName,
+		Outcome: eventDone,
+	}
+	if op == "create" {
+		e.Flags = d.auditFlags
+	}
+	if *err != nil {
+		e.Outcome = eventFailed
+		e.Error = (*err).Error()
+	}
+	data, jsonErr := json.Marshal(e)
+	if jsonErr != nil {
+		return
+	}
+
+	f, openErr := os.OpenFile(d.auditLogPath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if openErr != nil {
+		log.Warnf("Could not write the audit log: %s", openErr)
+		return
+	}
+	defer f.Close()
+	if _, writeErr := f.Write(append(data, '\n')); writeErr != nil {
+		log.Warnf("Could not write the audit log: %s", writeErr)
+	}
+}
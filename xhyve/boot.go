@@ -0,0 +1,106 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"net"
+	"regexp"
+	"sync"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// bootStage is a milestone of the guest boot observed on the console.
+type bootStage int
+
+const (
+	stageNone bootStage = iota
+	stageKernel
+	stageInit
+	stageNetwork
+	stageDocker
+)
+
+func (s bootStage) String() string {
+	switch s {
+	case stageKernel:
+		return "kernel started"
+	case stageInit:
+		return "init started"
+	case stageNetwork:
+		return "network configured"
+	case stageDocker:
+		return "docker daemon started"
+	}
+	return "no console output"
+}
+
+var (
+	bootStageRegexps = []struct {
+		stage bootStage
+		re    *regexp.Regexp
+	}{
+		{stageKernel, regexp.MustCompile(`Linux version \d+\.\d+`)},
+		{stageInit, regexp.MustCompile(`(?i)(boot2docker|rancheros|init) .*(version|started)`)},
+		// the DHCP client only runs on the guest NIC, the "ip addr" lines
+		// are the ones of an ethernet interface, not of lo or docker0
+		{stageNetwork, regexp.MustCompile(`(?:[Ll]ease of|bound to) (\d+\.\d+\.\d+\.\d+)|\binet (\d+\.\d+\.\d+\.\d+)/\d+ .*\b(?:eth|en)\w*$`)},
+		{stageDocker, regexp.MustCompile(`(?i)(starting|started) docker|API listen on`)},
+	}
+	kernelPanicRegexp = regexp.MustCompile(`Kernel panic.*`)
+)
+
+// bootProgress tracks the boot milestones seen on the console of a machine.
+type bootProgress struct {
+	mu    sync.Mutex
+	stage bootStage
+	ip    string
+	panic string
+}
+
+// observe updates the progress from a single console line.
+func (b *bootProgress) observe(line string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if m := kernelPanicRegexp.FindString(line); m != "" {
+		b.panic = m
+		return
+	}
+
+	for _, s := range bootStageRegexps {
+		m := s.re.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		if s.stage == stageNetwork {
+			ip := m[1] + m[2]
+			if !isGuestIP(ip) {
+				continue
+			}
+			b.ip = ip
+		}
+		if s.stage > b.stage {
+			log.Debugf("Boot progress: %s", s.stage)
+			b.stage = s.stage
+		}
+	}
+}
+
+// isGuestIP reports whether ip can be the address of the guest on the vmnet
+// network: loopback and link-local addresses are not.
+func isGuestIP(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed != nil && !parsed.IsLoopback() && !parsed.IsLinkLocalUnicast()
+}
+
+// status returns the last milestone, the IP announced on the console and the
+// kernel panic message, if any.
+func (b *bootProgress) status() (bootStage, string, string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.stage, b.ip, b.panic
+}
@@ -0,0 +1,60 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import "sort"
+
+// Capabilities describe what the driver supports, so that tools can adapt to
+// the installed version.
+type Capabilities struct {
+	Version           string
+	GitCommit         string
+	HypervisorVersion string
+	// ConfigVersion is the version of the machine configurations it saves.
+	ConfigVersion int
+	// Hypervisors are the values of --xhyve-hypervisor.
+	Hypervisors []string
+	// ImagePresets are the values of --xhyve-image-preset.
+	ImagePresets []string
+	DiskFormats  []string
+	Networking   []string
+	// SharedFolders are the ways to share host folders with the guest.
+	SharedFolders []string
+}
+
+// GetCapabilities returns the capabilities of the driver.
+func GetCapabilities() Capabilities {
+	return Capabilities{
+		Version:           Version,
+		GitCommit:         GitCommit,
+		HypervisorVersion: HypervisorVersion,
+		ConfigVersion:     configVersion,
+		Hypervisors:       hypervisorNames(),
+		ImagePresets:      imagePresetNames(),
+		DiskFormats:       []string{"sparsebundle", "raw", "qcow2"},
+		// vmnet shared networking for xhyve and hyperkit, the NAT of
+		// Virtualization.framework, the loopback of the fake hypervisor
+		Networking:    []string{"vmnet-shared", "vz-nat", "loopback"},
+		SharedFolders: []string{"virtio-9p", "virtio-fs", "nfs"},
+	}
+}
+
+func hypervisorNames() []string {
+	var names []string
+	for n := range backends {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func imagePresetNames() []string {
+	var names []string
+	for n := range imagePresets {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
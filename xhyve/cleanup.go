@@ -0,0 +1,98 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zchee/docker-machine-driver-xhyve/vmnet"
+)
+
+// leaseExpiry returns the expiry time of the DHCP lease l, whose lease field
+// is a hexadecimal Unix time.
+func leaseExpiry(l vmnet.DHCPEntry) (time.Time, error) {
+	t, err := strconv.ParseInt(strings.TrimPrefix(l.Lease, "0x"), 16, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid lease time %q", l.Lease)
+	}
+	return time.Unix(t, 0), nil
+}
+
+// staleLeases returns the expired leases of leases which belong to none of
+// machines. The leases within their lease time are kept, they may belong to
+// a running guest of another tool using vmnet.
+func staleLeases(leases []vmnet.DHCPEntry, machines map[string]*Driver, now time.Time) []vmnet.DHCPEntry {
+	known := make(map[string]bool)
+	for _, m := range machines {
+		if m.MacAddr != "" {
+			known[m.MacAddr] = true
+		}
+	}
+	var stale []vmnet.DHCPEntry
+	for _, l := range leases {
+		if known[l.HWAddress] {
+			continue
+		}
+		if expiry, err := leaseExpiry(l); err == nil && expiry.Before(now) {
+			stale = append(stale, l)
+		}
+	}
+	return stale
+}
+
+// removedMachineProcesses returns the running hypervisors of the machines of
+// the docker-machine store storePath which were removed from it, by machine
+// name.
+func removedMachineProcesses(storePath string, procs []process, machines map[string]*Driver) map[string]process {
+	dirRegexp := regexp.MustCompile(regexp.QuoteMeta(filepath.Join(storePath, "machines")+"/") + `([^/\s]+)/`)
+	removed := make(map[string]process)
+	for _, p := range procs {
+		m := dirRegexp.FindStringSubmatch(p.command)
+		if m == nil {
+			continue
+		}
+		if _, ok := machines[m[1]]; !ok {
+			removed[m[1]] = p
+		}
+	}
+	return removed
+}
+
+// Cleanup removes the expired DHCP leases left by the removed machines of
+// the docker-machine store storePath, and reports the hypervisors of removed
+// machines still running. It writes what it does to w.
+func Cleanup(storePath string, w io.Writer) error {
+	machines := storeMachines(storePath)
+
+	procs, err := listProcesses(execRunner{})
+	if err != nil {
+		return err
+	}
+	for name, p := range removedMachineProcesses(storePath, procs, machines) {
+		fmt.Fprintf(w, "The hypervisor of the removed machine %s is still running, stop it with \"kill %d\"\n", name, p.pid)
+	}
+
+	leases, err := vmnet.GetLeases()
+	if err != nil {
+		return fmt.Errorf("Could not read the DHCP leases: %s", err)
+	}
+	stale := staleLeases(leases, machines, time.Now())
+	if len(stale) == 0 {
+		fmt.Fprintf(w, "No stale DHCP lease\n")
+		return nil
+	}
+	var macs []string
+	for _, l := range stale {
+		fmt.Fprintf(w, "Removing the expired DHCP lease of %s (%s, %s)\n", l.HWAddress, l.Name, l.IPAddress)
+		macs = append(macs, l.HWAddress)
+	}
+	return removeLeases(macs)
+}
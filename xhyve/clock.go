@@ -0,0 +1,106 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/state"
+)
+
+const (
+	clockSyncPidFilename = "clock-sync.pid"
+	clockSyncLogFilename = "clock-sync.log"
+
+	defaultClockSyncInterval = 300
+
+	// clockCheckInterval is the period the host clock is checked for a sleep
+	clockCheckInterval = 10 * time.Second
+	// clockJumpThreshold is how much the wall clock has to move ahead of the
+	// monotonic clock, which stops while the Mac sleeps, to be a sleep
+	clockJumpThreshold = 5 * time.Second
+)
+
+// syncClock sets the clock of the guest to the clock of the host.
+func (d *Driver) syncClock() error {
+	cmd := fmt.Sprintf("sudo date -u -s @%d", time.Now().Unix())
+	_, err := d.runSSHCommand(cmd)
+	return err
+}
+
+// clockJumped reports whether the host slept while wall elapsed on the wall
+// clock and mono on the monotonic clock.
+func clockJumped(wall, mono time.Duration) bool {
+	return wall-mono > clockJumpThreshold
+}
+
+// keepClockSynced syncs the clock of the guest every ClockSyncInterval
+// seconds and as soon as the host wakes up from sleep. The first sync is done
+// once the guest answers over SSH. It returns when the machine stops, or
+// when stop is closed.
+func (d *Driver) keepClockSynced(stop <-chan struct{}) {
+	ticker := time.NewTicker(clockCheckInterval)
+	defer ticker.Stop()
+
+	interval := time.Duration(d.ClockSyncInterval) * time.Second
+	started := time.Now()
+	last := started
+	var lastSync time.Time
+	running := false
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		slept := clockJumped(now.Round(0).Sub(last.Round(0)), now.Sub(last))
+		last = now
+
+		s, err := d.processState()
+		if err != nil || (s != state.Running && s != state.Paused) {
+			// the hypervisor may not have written its pidfile yet
+			if running || now.Sub(started) > time.Duration(d.BootTimeout)*time.Second {
+				return
+			}
+			continue
+		}
+		running = true
+		// Resume syncs the clock of the paused machine
+		if s == state.Paused {
+			continue
+		}
+
+		if slept {
+			log.Infof("The host woke up from sleep, syncing the clock of %s", d.MachineName)
+		} else if !lastSync.IsZero() && now.Sub(lastSync) < interval {
+			continue
+		}
+		if err := d.syncClock(); err != nil {
+			log.Debugf("Could not sync the clock of %s: %s", d.MachineName, err)
+			continue
+		}
+		log.Debugf("Synced the clock of %s", d.MachineName)
+		lastSync = now
+	}
+}
+
+// clockSyncTask keeps the clock of the machine synced, unless it runs
+// already.
+var clockSyncTask = &backgroundTask{
+	command:     "clock-sync",
+	name:        "clock sync",
+	pidFilename: clockSyncPidFilename,
+	logFilename: clockSyncLogFilename,
+	enabled:     func(d *Driver) bool { return d.ClockSyncInterval != 0 },
+	supervised:  true,
+	run: func(d *Driver) error {
+		d.keepClockSynced(nil)
+		return nil
+	},
+}
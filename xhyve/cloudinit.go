@@ -0,0 +1,120 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/zchee/docker-machine-driver-xhyve/b2d"
+)
+
+const (
+	cloudImageFilename  = "cloud.img"
+	cloudKernelFilename = "vmlinuz"
+	cloudInitrdFilename = "initrd"
+
+	// dockerInstallScript installs the docker engine on the distributions
+	// supported by the docker convenience script.
+	dockerInstallScript = "curl -fsSL https://get.docker.com | sh"
+)
+
+// validateCloudImage makes sure the machine boots from a cloud image.
+func (d *Driver) validateCloudImage() error {
+	if d.CloudImageURL == "" || d.CloudKernelURL == "" || d.CloudInitrdURL == "" {
+		return fmt.Errorf("the %s image preset needs --xhyve-cloud-image-url, --xhyve-cloud-kernel-url and --xhyve-cloud-initrd-url", d.ImagePreset)
+	}
+	if d.Qcow2 {
+		return fmt.Errorf("--xhyve-qcow2 can not be used with the %s image preset", d.ImagePreset)
+	}
+	// the cloud image is used as is, only raw images can be attached
+	d.RawDisk = true
+	return nil
+}
+
+// fetchCloudImage downloads or copies the cloud image, its kernel and its
+// initrd to the machine directory.
+func (d *Driver) fetchCloudImage() error {
+	dir := d.ResolveStorePath(".")
+
+	for _, f := range []struct{ name, url string }{
+		{cloudKernelFilename, d.CloudKernelURL},
+		{cloudInitrdFilename, d.CloudInitrdURL},
+		{cloudImageFilename, d.CloudImageURL},
+	} {
+		if _, local := localISOPath(f.url); d.Offline && !local {
+			return fmt.Errorf("Can not download %s, --xhyve-offline is set", f.url)
+		}
+		if err := b2d.Download(dir, f.name, f.url); err != nil {
+			return fmt.Errorf("Could not fetch %s: %s", f.url, err)
+		}
+	}
+
+	d.Vmlinuz = cloudKernelFilename
+	d.Initrd = cloudInitrdFilename
+	return nil
+}
+
+// generateCloudDiskImage turns the cloud image into the disk of the machine,
+// grown to the requested size. cloud-init grows the root partition on boot.
+func (d *Driver) generateCloudDiskImage(size int64) error {
+	diskPath := d.rawDiskPath()
+	if err := os.Rename(d.ResolveStorePath(cloudImageFilename), diskPath); err != nil {
+		// the --xhyve-disk-dir is on another volume
+		if err := d.cloneFile(d.ResolveStorePath(cloudImageFilename), diskPath); err != nil {
+			return err
+		}
+		os.Remove(d.ResolveStorePath(cloudImageFilename))
+	}
+
+	fi, err := os.Stat(diskPath)
+	if err != nil {
+		return err
+	}
+	if fi.Size() > size*1048576 {
+		log.Warnf("The cloud image is larger than --xhyve-disk-size, keeping its %dMB", fi.Size()/1048576)
+		return nil
+	}
+	return os.Truncate(diskPath, size*1048576)
+}
+
+// cloudInitUserData returns the #cloud-config creating the SSH user of the
+// machine and installing docker.
+func (d *Driver) cloudInitUserData() ([]byte, error) {
+	keys, err := d.authorizedKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	config := fmt.Sprintf(`#cloud-config
+hostname: %s
+users:
+  - name: %s
+    sudo: ALL=(ALL) NOPASSWD:ALL
+    shell: /bin/bash
+    ssh_authorized_keys:
+      - %s
+runcmd:
+  - %s
+  - usermod -aG docker %s
+`, d.hostname(), d.GetSSHUsername(), strings.Join(keys, "\n      - "), dockerInstallScript, d.GetSSHUsername())
+	return []byte(config), nil
+}
+
+// generateNoCloudSeed writes a cloud-init NoCloud seed ISO.
+func (d *Driver) generateNoCloudSeed() error {
+	userData, err := d.cloudInitUserData()
+	if err != nil {
+		return err
+	}
+	metaData := fmt.Sprintf("instance-id: %s\nlocal-hostname: %s\n", d.MachineName, d.hostname())
+
+	return d.makeISO(d.seedISOPath(), "cidata", map[string][]byte{
+		"meta-data": []byte(metaData),
+		"user-data": userData,
+	})
+}
@@ -0,0 +1,185 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// commandOutputLimit is how much of the output of a command is logged
+const commandOutputLimit = 256
+
+// traceCommand logs the run of the external command cmd in debug mode, as a
+// single line of key=value pairs.
+func traceCommand(cmd *exec.Cmd, start time.Time, out []byte, err error) {
+	msg := fmt.Sprintf("exec: command=%q args=%q exit=%d duration=%s", cmd.Path, cmd.Args[1:], exitStatus(err), time.Since(start).Round(time.Millisecond))
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			msg += fmt.Sprintf(" error=%q", err.Error())
+		}
+	}
+	if len(out) > commandOutputLimit {
+		msg += fmt.Sprintf(" output=%q...", out[:commandOutputLimit])
+	} else if len(out) > 0 {
+		msg += fmt.Sprintf(" output=%q", out)
+	}
+	log.Debug(msg)
+}
+
+// traceStart logs the start of the long running command cmd in debug mode.
+func traceStart(cmd *exec.Cmd, err error) {
+	if err != nil {
+		log.Debugf("exec: command=%q args=%q error=%q", cmd.Path, cmd.Args[1:], err.Error())
+		return
+	}
+	log.Debugf("exec: command=%q args=%q pid=%d", cmd.Path, cmd.Args[1:], cmd.Process.Pid)
+}
+
+// CommandRunner runs the external commands of the driver: hdiutil, the
+// hypervisor, ps, cp and the others. A tool embedding the driver can replace
+// it with SetCommandRunner, the tests replace it with a fake.
+type CommandRunner interface {
+	// Output runs cmd and returns its standard output, like cmd.Output.
+	Output(cmd *exec.Cmd) ([]byte, error)
+	// CombinedOutput runs cmd and returns its standard output and error,
+	// like cmd.CombinedOutput.
+	CombinedOutput(cmd *exec.Cmd) ([]byte, error)
+	// Start starts the long running command cmd, like cmd.Start, and
+	// returns its process.
+	Start(cmd *exec.Cmd) (Process, error)
+}
+
+// Process is a long running command started by a CommandRunner.
+type Process interface {
+	// Pid returns the process id of the command.
+	Pid() int
+	// Wait waits for the command to exit, like cmd.Wait.
+	Wait() error
+	// Signal sends sig to the command, like cmd.Process.Signal.
+	Signal(sig os.Signal) error
+}
+
+// execRunner runs the commands on the host, and traces them.
+type execRunner struct{}
+
+func (execRunner) Output(cmd *exec.Cmd) ([]byte, error) {
+	start := time.Now()
+	out, err := cmd.Output()
+	traced := out
+	if exitErr, ok := err.(*exec.ExitError); ok && len(out) == 0 {
+		traced = exitErr.Stderr
+	}
+	traceCommand(cmd, start, traced, err)
+	return out, err
+}
+
+func (execRunner) CombinedOutput(cmd *exec.Cmd) ([]byte, error) {
+	start := time.Now()
+	out, err := cmd.CombinedOutput()
+	traceCommand(cmd, start, out, err)
+	return out, err
+}
+
+func (execRunner) Start(cmd *exec.Cmd) (Process, error) {
+	err := cmd.Start()
+	traceStart(cmd, err)
+	if err != nil {
+		return nil, err
+	}
+	return execProcess{cmd}, nil
+}
+
+// execProcess is a command started on the host.
+type execProcess struct {
+	cmd *exec.Cmd
+}
+
+func (p execProcess) Pid() int {
+	return p.cmd.Process.Pid
+}
+
+func (p execProcess) Wait() error {
+	return p.cmd.Wait()
+}
+
+func (p execProcess) Signal(sig os.Signal) error {
+	return p.cmd.Process.Signal(sig)
+}
+
+// quietRunner runs the commands on the host like execRunner, without tracing
+// them: their output is a secret.
+type quietRunner struct {
+	execRunner
+}
+
+func (quietRunner) Output(cmd *exec.Cmd) ([]byte, error) {
+	return cmd.Output()
+}
+
+// untraced returns r, or the quietRunner when r traces the commands on the
+// host.
+func untraced(r CommandRunner) CommandRunner {
+	if _, ok := r.(execRunner); ok {
+		return quietRunner{}
+	}
+	return r
+}
+
+// SetCommandRunner makes the driver run its external commands with r, which
+// is not saved with the machine.
+func (d *Driver) SetCommandRunner(r CommandRunner) {
+	d.runner = r
+}
+
+func (d *Driver) commands() CommandRunner {
+	if d.runner == nil {
+		return execRunner{}
+	}
+	return d.runner
+}
+
+// runCommand runs cmd with r, like cmd.Run. Its error has the output of the
+// command.
+func runCommand(r CommandRunner, cmd *exec.Cmd) error {
+	out, err := r.CombinedOutput(cmd)
+	if err != nil {
+		return commandError(cmd, out, err)
+	}
+	return nil
+}
+
+// commandOutput runs cmd with r, like cmd.Output. Its error has the standard
+// error of the command.
+func commandOutput(r CommandRunner, cmd *exec.Cmd) ([]byte, error) {
+	out, err := r.Output(cmd)
+	if err != nil {
+		var stderr []byte
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			stderr = exitErr.Stderr
+		}
+		return out, commandError(cmd, stderr, err)
+	}
+	return out, nil
+}
+
+// commandError returns the error err of the run of cmd with the trimmed
+// output out of the command, when it has some.
+func commandError(cmd *exec.Cmd, out []byte, err error) error {
+	name := filepath.Base(cmd.Args[0])
+	if len(cmd.Args) > 1 {
+		name += " " + cmd.Args[1]
+	}
+	if msg := strings.TrimSpace(string(out)); msg != "" {
+		return fmt.Errorf("%s failed: %s: %s", name, err, msg)
+	}
+	return fmt.Errorf("%s failed: %s", name, err)
+}
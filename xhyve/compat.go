@@ -0,0 +1,113 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// Hypervisor.framework is available since OS X 10.10, but only works
+// reliably with xhyve since 10.10.3.
+var minHypervisorMacOSVersion = []int{10, 10, 3}
+
+// hypervisorEntitlement must be granted to the driver binary to use
+// Hypervisor.framework since macOS 11.
+const hypervisorEntitlement = "com.apple.security.hypervisor"
+
+// macOSQuirks lists the macOS releases on which the embedded xhyve is known
+// to misbehave, from the oldest to the newest. A release matches when its
+// version is in [min, max), a nil max is open-ended.
+var macOSQuirks = []struct {
+	min, max []int
+	fatal    bool
+	message  string
+}{
+	{
+		min:     []int{10, 11},
+		max:     []int{10, 11, 4},
+		message: "vmnet on OS X 10.11 before 10.11.4 may not hand out DHCP leases after a host sleep. Upgrade macOS if the machine never gets an IP",
+	},
+}
+
+// checkMacOSCompatibility fails on macOS releases or hardware the hypervisor
+// can not run on, and emits specific guidance for the known quirks.
+func checkMacOSCompatibility(r CommandRunner, hypervisor, binary string) error {
+	if hypervisor == hypervisorFake {
+		return nil
+	}
+	osVersion, err := macOSVersion(r)
+	if err != nil {
+		return err
+	}
+	log.Debugf("Host macOS version: %s", osVersion)
+
+	ver, err := parseVersion(osVersion)
+	if err != nil {
+		return err
+	}
+	if hypervisor == hypervisorVZ {
+		if versionLess(ver, minVZMacOSVersion) {
+			return fmt.Errorf("The %s hypervisor requires macOS 11 or later for Virtualization.framework, you are running %s", hypervisorVZ, osVersion)
+		}
+		return nil
+	}
+
+	if versionLess(ver, minHypervisorMacOSVersion) {
+		return fmt.Errorf("xhyve requires OS X 10.10.3 or later for Hypervisor.framework, you are running %s.\n\tPlease upgrade macOS", osVersion)
+	}
+
+	for _, q := range macOSQuirks {
+		if versionLess(ver, q.min) || (q.max != nil && !versionLess(ver, q.max)) {
+			continue
+		}
+		if q.fatal {
+			return fmt.Errorf("macOS %s: %s", osVersion, q.message)
+		}
+		log.Warnf("macOS %s: %s", osVersion, q.message)
+	}
+
+	if isAppleSilicon(r) {
+		return fmt.Errorf("xhyve only runs on Intel Macs, this host has an Apple Silicon CPU.\n\tUse --xhyve-hypervisor %s to run the machine with Virtualization.framework", hypervisorVZ)
+	}
+
+	if !versionLess(ver, []int{11}) {
+		if err := checkHypervisorEntitlement(r, binary); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isAppleSilicon reports whether the host has an arm64 CPU, including when
+// the driver itself runs translated by Rosetta.
+func isAppleSilicon(r CommandRunner) bool {
+	if v, err := sysctl(r, "hw.optional.arm64"); err == nil && v == "1" {
+		return true
+	}
+	if v, err := sysctl(r, "sysctl.proc_translated"); err == nil && v == "1" {
+		return true
+	}
+	return false
+}
+
+// checkHypervisorEntitlement makes sure binary, which runs the hypervisor, is
+// signed with the entitlement macOS 11 requires to use Hypervisor.framework.
+func checkHypervisorEntitlement(r CommandRunner, binary string) error {
+	out, err := r.CombinedOutput(exec.Command("codesign", "-d", "--entitlements", ":-", binary))
+	if err != nil {
+		log.Debugf("codesign failed: %s: %s", err, out)
+	}
+	if !strings.Contains(string(out), hypervisorEntitlement) {
+		return fmt.Errorf("%s is not signed with the %s entitlement required by macOS 11 and later.\n"+
+			"\tSign it with: codesign --entitlements <plist granting %s> --force -s - %s",
+			binary, hypervisorEntitlement, hypervisorEntitlement, binary)
+	}
+	return nil
+}
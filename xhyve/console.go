@@ -0,0 +1,169 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	consoleLogFilename    = "console.log"
+	consoleLogPidFilename = "console-log.pid"
+
+	// kernelConsole is the guest device backed by com2. The kernel log is
+	// routed there so com1 stays free for an interactive login shell.
+	kernelConsole = "console=ttyS1"
+
+	// ConsoleLogEnv is the environment variable used to hand the console log
+	// path over to the hypervisor process.
+	ConsoleLogEnv = "XHYVE_CONSOLE_LOG"
+)
+
+func (d *Driver) consoleLogPath() string {
+	return d.ResolveStorePath(consoleLogFilename)
+}
+
+// hyperkitConsolePath is the symlink hyperkit makes to its com2 pty.
+func (d *Driver) hyperkitConsolePath() string {
+	return d.ResolveStorePath("tty2")
+}
+
+// consoleLogTask copies the com2 pty of hyperkit to the console log, in
+// place of the one of the previous boot. The previous pty is unlinked before
+// hyperkit starts.
+var consoleLogTask = &backgroundTask{
+	command:     "console-log",
+	name:        "console log",
+	pidFilename: consoleLogPidFilename,
+	logFilename: hypervisorLogFilename,
+	enabled:     func(d *Driver) bool { return d.Hypervisor == hypervisorHyperkit },
+	replace:     true,
+	run:         (*Driver).copyConsole,
+}
+
+// copyConsole waits for the com2 pty of hyperkit and copies it to the console
+// log until hyperkit closes it.
+func (d *Driver) copyConsole() error {
+	const (
+		ptyTimeout   = 30 * time.Second
+		pollInterval = 200 * time.Millisecond
+	)
+
+	for deadline := time.Now().Add(ptyTimeout); ; time.Sleep(pollInterval) {
+		pty, err := os.Readlink(d.hyperkitConsolePath())
+		if err == nil {
+			return LogConsole(pty, d.consoleLogPath())
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("hyperkit did not link its console to %s: %s", d.hyperkitConsolePath(), err)
+		}
+	}
+}
+
+// rotateConsoleLog keeps the log of the previous boot as console.log.1 so the
+// current boot starts with an empty console.log.
+func (d *Driver) rotateConsoleLog() {
+	logPath := d.consoleLogPath()
+	if _, err := os.Stat(logPath); err == nil {
+		os.Rename(logPath, logPath+".1")
+	}
+}
+
+// readTail returns at most the last size bytes of the file path.
+func readTail(path string, size int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err == nil && fi.Size() > size {
+		if _, err := f.Seek(-size, io.SeekEnd); err != nil {
+			return nil, err
+		}
+	}
+	return ioutil.ReadAll(f)
+}
+
+// followConsole calls fn for every line written to the console log until stop
+// is closed. The log file does not need to exist yet.
+func (d *Driver) followConsole(stop <-chan struct{}, fn func(line string)) {
+	const pollInterval = 200 * time.Millisecond
+
+	var f *os.File
+	for f == nil {
+		var err error
+		if f, err = os.Open(d.consoleLogPath()); err != nil {
+			select {
+			case <-stop:
+				return
+			case <-time.After(pollInterval):
+			}
+		}
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var partial string
+	for {
+		line, err := r.ReadString('\n')
+		partial += line
+		if err == nil {
+			fn(strings.TrimRight(partial, "\r\n"))
+			partial = ""
+			continue
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// kernelCmdline returns the boot command with the kernel log redirected to
+// com2, or to the virtio console with Virtualization.framework.
+func (d *Driver) kernelCmdline() string {
+	console := kernelConsole
+	if d.Hypervisor == hypervisorVZ {
+		console = vzConsole
+	}
+	cmdline := strings.TrimSpace(d.BootCmd + " " + d.BootCmdExtra)
+	if strings.Contains(cmdline, console) {
+		return cmdline
+	}
+	return strings.TrimSpace(cmdline + " " + console)
+}
+
+// LogConsole copies everything the guest writes on the pty into logPath.
+// It blocks until the pty is closed.
+func LogConsole(pty, logPath string) error {
+	out, err := openPrivateLog(logPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	return copyConsole(pty, out)
+}
+
+// copyConsole copies everything the guest writes on the pty into out until
+// the pty is closed.
+func copyConsole(pty string, out io.Writer) error {
+	in, err := os.OpenFile(pty, os.O_RDONLY|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
@@ -0,0 +1,356 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/ssh"
+	"github.com/docker/machine/libmachine/state"
+)
+
+// createStateFilename checkpoints the progress of Create in the machine
+// directory. It is removed once the machine is fully created.
+const createStateFilename = "create-state.json"
+
+// createStep is a checkpointed step of Create.
+type createStep struct {
+	name string
+	run  func(d *Driver) error
+}
+
+var createSteps = []createStep{
+	{"download", (*Driver).createDownload},
+	{"extract", (*Driver).createExtract},
+	{"keygen", (*Driver).createKeygen},
+	{"disk", (*Driver).createDisk},
+	{"seed", (*Driver).generateSeedISO},
+	{"uuid", (*Driver).createUUID},
+	{"static-ip", (*Driver).createStaticIP},
+	{"start", (*Driver).createStart},
+	{"wait-ip", (*Driver).createWaitIP},
+	{"userdata", (*Driver).installUserdata},
+	{"wait-docker", (*Driver).createWaitDocker},
+}
+
+// createState is the content of the create state file.
+type createState struct {
+	// Completed lists the names of the steps already done.
+	Completed []string
+	// Driver is the driver configuration after the last completed step.
+	Driver json.RawMessage
+}
+
+func (d *Driver) createStatePath() string {
+	return d.ResolveStorePath(createStateFilename)
+}
+
+func (d *Driver) loadCreateState() (*createState, error) {
+	data, err := ioutil.ReadFile(d.createStatePath())
+	if err != nil {
+		return nil, err
+	}
+	var st createState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, fmt.Errorf("Invalid %s: %s", d.createStatePath(), err)
+	}
+	return &st, nil
+}
+
+func (d *Driver) saveCreateState(completed []string) error {
+	driver, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(createState{completed, driver})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(d.createStatePath(), data, 0600)
+}
+
+// runCreateSteps runs the steps of Create not in st, checkpointing each of
+// them. The files left over by a failed step are removed, the previous steps
+// are kept so that the creation can be resumed.
+func (d *Driver) runCreateSteps(st *createState) error {
+	done := make(map[string]bool)
+	var completed []string
+	if st != nil {
+		for _, name := range st.Completed {
+			done[name] = true
+		}
+		completed = st.Completed
+	}
+
+	if d.ShowConsole {
+		stop := make(chan struct{})
+		defer close(stop)
+		go d.followConsole(stop, func(line string) {
+			log.Infof("[console] %s", line)
+		})
+	}
+
+	var (
+		mu       sync.Mutex
+		existing map[string]bool
+	)
+	stopCleanup := cleanupOnInterrupt(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		d.rollbackCreate(existing)
+	})
+	defer stopCleanup()
+
+	for _, step := range createSteps {
+		if done[step.name] {
+			log.Debugf("Create step %s already done", step.name)
+			continue
+		}
+
+		log.Debugf("Create step %s", step.name)
+		d.emitEvent("create", step.name, eventStarted, nil)
+		mu.Lock()
+		existing = d.machineFiles()
+		mu.Unlock()
+		err := step.run(d)
+		d.endEvent("create", step.name, err)
+		if err != nil {
+			d.rollbackCreate(existing)
+			return fmt.Errorf("%s. Run \"docker-machine start %s\" to resume the creation", err, d.MachineName)
+		}
+
+		completed = append(completed, step.name)
+		if err := d.saveCreateState(completed); err != nil {
+			return err
+		}
+	}
+
+	return os.Remove(d.createStatePath())
+}
+
+// resumeCreate resumes an interrupted Create. It reports whether there was
+// one to resume.
+func (d *Driver) resumeCreate() (bool, error) {
+	st, err := d.loadCreateState()
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return true, err
+	}
+
+	if err := json.Unmarshal(st.Driver, d); err != nil {
+		return true, err
+	}
+	log.Infof("Resuming the creation of %s after steps %v...", d.MachineName, st.Completed)
+	return true, d.runCreateSteps(st)
+}
+
+func (d *Driver) createDownload() error {
+	if err := os.MkdirAll(d.ResolveStorePath("."), privateDirMode); err != nil {
+		return err
+	}
+	if d.Ephemeral {
+		if err := d.mountEphemeralVolume(); err != nil {
+			return err
+		}
+	}
+	if d.DiskDir != "" {
+		if err := os.MkdirAll(d.DiskDir, privateDirMode); err != nil {
+			return err
+		}
+	}
+
+	if d.Template != "" {
+		return d.cloneTemplate()
+	}
+
+	if d.NodeBase != "" {
+		return d.cloneBase()
+	}
+
+	if d.Hypervisor == hypervisorFake {
+		// the fake machine boots no image
+		return nil
+	}
+
+	if d.preset().cloudImage {
+		return d.fetchCloudImage()
+	}
+
+	if err := d.CopyIsoToMachineDir(d.Boot2DockerURL, d.MachineName); err != nil {
+		return err
+	}
+	return d.verifyISO()
+}
+
+func (d *Driver) createExtract() error {
+	log.Infof("Creating VM...")
+	if d.Template != "" {
+		// the kernel and boot command of the template are cloned
+		return d.expandBootCmds()
+	}
+	if d.preset().cloudImage {
+		if err := d.extractKernelOptions(); err != nil {
+			return err
+		}
+	} else if d.Hypervisor == hypervisorFake {
+		log.Infof("Creating a fake machine, which boots no kernel")
+	} else if d.Bootrom != "" {
+		log.Infof("Booting %s with the %s firmware", isoFilename, d.Bootrom)
+	} else if err := d.extractKernelImages(); err != nil {
+		return err
+	}
+	return d.expandBootCmds()
+}
+
+func (d *Driver) createKeygen() error {
+	if d.Template != "" {
+		return nil
+	}
+	if d.SSHKey != "" {
+		return d.copySSHKey()
+	}
+	if d.SSHAgent {
+		return d.installSSHAgentKeys()
+	}
+	log.Infof("Creating SSH key...")
+	return ssh.GenerateSSHKey(d.privateSSHKeyPath())
+}
+
+func (d *Driver) createDisk() error {
+	if d.Template != "" {
+		return nil
+	}
+	if d.ImportDisk != "" {
+		return d.importDisk()
+	}
+	if d.NodeBase != "" && d.sharesBaseDisk() {
+		return d.cloneBaseDisk()
+	}
+	log.Infof("Generating %dMB disk image...", d.DiskSize)
+	// the disk only takes the space of the blocks written, its size is not
+	// known ahead
+	defer watchPath("Generating "+filepath.Base(d.diskImagePath()), d.diskImagePath(), -1)()
+
+	if d.preset().cloudImage {
+		return d.generateCloudDiskImage(d.DiskSize)
+	} else if d.Qcow2 {
+		return d.generateQcow2Image(d.DiskSize)
+	} else if d.RawDisk {
+		return d.generateRawDiskImage(d.DiskSize)
+	}
+	return d.generateSparseBundleDiskImage(d.DiskSize)
+}
+
+func (d *Driver) createUUID() error {
+	// Fix file permission root to current user for vmnet.framework
+	log.Infof("Fix file permission...")
+	os.Chown(d.ResolveStorePath("."), syscall.Getuid(), syscall.Getegid())
+	files, _ := ioutil.ReadDir(d.ResolveStorePath("."))
+	for _, f := range files {
+		log.Debugf(d.ResolveStorePath(f.Name()))
+		os.Chown(d.ResolveStorePath(f.Name()), syscall.Getuid(), syscall.Getegid())
+	}
+
+	if d.UUID == "" && d.DeterministicUUID {
+		d.UUID = nameUUID(d.MachineName)
+		log.Infof("Using the UUID of the machine name: %s", d.UUID)
+	} else if d.UUID == "" {
+		log.Infof("Generate UUID...")
+		uuid, err := uuidgen()
+		if err != nil {
+			return err
+		}
+		d.UUID = uuid
+		log.Debugf("Generated UUID: %s", d.UUID)
+	} else {
+		log.Infof("Using Supplied UUID: %s", d.UUID)
+	}
+
+	log.Infof("Convert UUID to MAC address...")
+	rawUUID, err := d.backend().macAddress(d)
+	if err != nil {
+		return fmt.Errorf("Could not convert the UUID to MAC address: %s", err.Error())
+	}
+	d.MacAddr = trimMacAddress(rawUUID)
+	log.Debugf("Converted MAC address: %s", d.MacAddr)
+	return nil
+}
+
+func (d *Driver) createStart() error {
+	log.Infof("Starting %s...", d.MachineName)
+	if err := d.runHook(hookPreStart); err != nil {
+		return err
+	}
+	return d.launch()
+}
+
+func (d *Driver) createWaitIP() error {
+	// the machine is killed when waiting for its IP fails, resuming restarts it
+	if s, err := d.processState(); err == nil && s != state.Running {
+		if err := d.launch(); err != nil {
+			return err
+		}
+	}
+
+	if err := d.waitForIP(); err != nil {
+		return err
+	}
+	if err := d.setupMounts(); err != nil {
+		return err
+	}
+	d.runPostHook(hookPostStart)
+	return nil
+}
+
+// createWaitDocker waits for the docker daemon of the guest to listen on the
+// docker port, so that a daemon that never comes up fails Create instead of
+// the provisioning of docker-machine.
+func (d *Driver) createWaitDocker() error {
+	if !d.preset().startsDocker || d.Hypervisor == hypervisorFake {
+		return nil
+	}
+	if s, err := d.processState(); err == nil && s != state.Running {
+		if err := d.createWaitIP(); err != nil {
+			return err
+		}
+	}
+
+	addr := net.JoinHostPort(d.IPAddress, strconv.Itoa(dockerPort))
+	timeout, interval := d.BootTimeout, d.IPPollInterval
+	if timeout < 1 {
+		timeout = defaultBootTimeout
+	}
+	if interval < 1 {
+		interval = defaultIPPollInterval
+	}
+
+	log.Infof("Waiting for the docker daemon...")
+	deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+	for {
+		conn, err := net.DialTimeout("tcp", addr, time.Duration(interval)*time.Second)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("The docker daemon of %s never came up on %s after %d seconds: %s. Run \"docker-machine ssh %s cat /var/log/docker.log\" for details",
+				d.MachineName, addr, timeout, err, d.MachineName)
+		}
+		log.Debugf("The docker daemon is not there yet: %s", err)
+		time.Sleep(time.Duration(interval) * time.Second)
+	}
+}
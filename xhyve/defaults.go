@@ -0,0 +1,161 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/machine/commands/mcndirs"
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/mcnflag"
+)
+
+const (
+	// DefaultsFileEnv is the environment variable naming the flag defaults
+	// file, instead of xhyve.json in the docker-machine store.
+	DefaultsFileEnv = "XHYVE_DEFAULTS_FILE"
+
+	defaultsFilename = "xhyve.json"
+)
+
+func defaultsFilePath(storePath string) string {
+	if path := os.Getenv(DefaultsFileEnv); path != "" {
+		return path
+	}
+	if storePath != "" {
+		return filepath.Join(storePath, defaultsFilename)
+	}
+	return filepath.Join(mcndirs.GetBaseDir(), defaultsFilename)
+}
+
+// loadFlagDefaults reads the flag defaults file, a JSON object of flag names,
+// with or without their "xhyve-" prefix, to their default values. It returns
+// nil when there is no defaults file.
+func loadFlagDefaults(path string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("Invalid %s: %s", path, err)
+	}
+	defaults := make(map[string]interface{}, len(raw))
+	for name, v := range raw {
+		if !strings.HasPrefix(name, "xhyve-") {
+			name = "xhyve-" + name
+		}
+		defaults[name] = v
+	}
+	return defaults, nil
+}
+
+// applyFlagDefaults replaces the default values of flags by the ones of
+// defaults. Boolean flags have no default value, they are handled by
+// boolDefaults.
+func applyFlagDefaults(flags []mcnflag.Flag, defaults map[string]interface{}) ([]mcnflag.Flag, error) {
+	known := make(map[string]bool)
+	for i, f := range flags {
+		known[f.String()] = true
+		v, ok := defaults[f.String()]
+		if !ok {
+			continue
+		}
+
+		switch flag := f.(type) {
+		case mcnflag.StringFlag:
+			switch v := v.(type) {
+			case string:
+				flag.Value = v
+			case float64:
+				flag.Value = fmt.Sprint(v)
+			default:
+				return nil, fmt.Errorf("%s must be a string in %s", f, defaultsFilename)
+			}
+			flags[i] = flag
+		case mcnflag.IntFlag:
+			n, ok := v.(float64)
+			if !ok || n != float64(int(n)) {
+				return nil, fmt.Errorf("%s must be an integer in %s", f, defaultsFilename)
+			}
+			flag.Value = int(n)
+			flags[i] = flag
+		case mcnflag.StringSliceFlag:
+			values, ok := v.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s must be an array of strings in %s", f, defaultsFilename)
+			}
+			flag.Value = nil
+			for _, s := range values {
+				s, ok := s.(string)
+				if !ok {
+					return nil, fmt.Errorf("%s must be an array of strings in %s", f, defaultsFilename)
+				}
+				flag.Value = append(flag.Value, s)
+			}
+			flags[i] = flag
+		case mcnflag.BoolFlag:
+			if _, ok := v.(bool); !ok {
+				return nil, fmt.Errorf("%s must be a boolean in %s", f, defaultsFilename)
+			}
+		}
+	}
+
+	for name := range defaults {
+		if !known[name] {
+			return nil, fmt.Errorf("Unknown flag %s in %s", name, defaultsFilename)
+		}
+	}
+	return flags, nil
+}
+
+// withFlagDefaults applies the defaults file to flags. An invalid file is
+// reported and ignored, the flags can not fail.
+func withFlagDefaults(storePath string, flags []mcnflag.Flag) []mcnflag.Flag {
+	path := defaultsFilePath(storePath)
+	defaults, err := loadFlagDefaults(path)
+	if err == nil {
+		var withDefaults []mcnflag.Flag
+		if withDefaults, err = applyFlagDefaults(flags, defaults); err == nil {
+			return withDefaults
+		}
+	}
+	log.Warnf("Ignoring the flag defaults of %s: %s", path, err)
+	return flags
+}
+
+// boolDefaults are driver options whose unset boolean flags default to the
+// true values of the defaults file. Those can not be turned off on the
+// command line.
+type boolDefaults struct {
+	drivers.DriverOptions
+	defaults map[string]interface{}
+}
+
+func (o boolDefaults) Bool(key string) bool {
+	if v, ok := o.defaults[key].(bool); ok && v {
+		return true
+	}
+	return o.DriverOptions.Bool(key)
+}
+
+// withBoolDefaults applies the boolean defaults of the defaults file to flags.
+func withBoolDefaults(storePath string, flags drivers.DriverOptions) drivers.DriverOptions {
+	defaults, err := loadFlagDefaults(defaultsFilePath(storePath))
+	if err != nil || defaults == nil {
+		return flags
+	}
+	return boolDefaults{flags, defaults}
+}
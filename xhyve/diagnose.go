@@ -0,0 +1,101 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/zchee/docker-machine-driver-xhyve/vmnet"
+)
+
+// diagnoseLogTail is how much of the end of each log is reported
+const diagnoseLogTail = 16 * 1024
+
+// Diagnose writes a report of the host and of the machine name of the
+// docker-machine store storePath to w, to be attached to bug reports.
+func Diagnose(storePath, name string, w io.Writer) error {
+	d, err := loadHostDriver(filepath.Join(storePath, "machines", name))
+	if err != nil {
+		return err
+	}
+	d.diagnose(w)
+	return nil
+}
+
+// diagnose writes the report of the machine. A part that can not be
+// collected is reported with its error instead.
+func (d *Driver) diagnose(w io.Writer) {
+	value := func(v string, err error) string {
+		if err != nil {
+			return fmt.Sprintf("unknown (%s)", err)
+		}
+		return v
+	}
+
+	fmt.Fprintf(w, "Host:\n")
+	fmt.Fprintf(w, "  macOS:           %s\n", value(macOSVersion(d.commands())))
+	fmt.Fprintf(w, "  kern.hv_support: %s\n", value(sysctl(d.commands(), "kern.hv_support")))
+	fmt.Fprintf(w, "  hw.model:        %s\n", value(sysctl(d.commands(), "hw.model")))
+	fmt.Fprintf(w, "  driver:          %s (%s)\n", Version, GitCommit)
+	fmt.Fprintf(w, "  hypervisor:      %s %s\n", d.Hypervisor, value(d.backend().version(d)))
+	fmt.Fprintf(w, "  vmnet config:    %s\n", value("ok", vmnet.CheckConfig()))
+
+	s, err := d.GetState()
+	fmt.Fprintf(w, "Machine:\n")
+	fmt.Fprintf(w, "  name:            %s\n", d.MachineName)
+	fmt.Fprintf(w, "  image preset:    %s\n", d.ImagePreset)
+	fmt.Fprintf(w, "  config version:  %d\n", d.ConfigVersion)
+	fmt.Fprintf(w, "  state:           %s\n", value(s.String(), err))
+	fmt.Fprintf(w, "  UUID:            %s\n", d.UUID)
+	fmt.Fprintf(w, "  MAC address:     %s\n", d.MacAddr)
+	fmt.Fprintf(w, "  IP address:      %s\n", d.IPAddress)
+	if code, err := d.loadExitStatus(); err == nil {
+		fmt.Fprintf(w, "  exit status:     %d\n", code)
+	}
+	if pid, err := d.GetPid(); err == nil {
+		out, err := d.commands().Output(exec.Command("ps", "-o", "pid=,state=,etime=,rss=,command=", "-p", fmt.Sprintf("%d", pid)))
+		fmt.Fprintf(w, "  process:         %s\n", value(strings.TrimSpace(string(out)), err))
+	} else {
+		fmt.Fprintf(w, "  process:         none (%s)\n", err)
+	}
+
+	fmt.Fprintf(w, "DHCP leases of %s:\n", d.MacAddr)
+	leases, err := vmnet.GetLeasesByMACAddress(d.MacAddr)
+	if err != nil {
+		fmt.Fprintf(w, "  %s\n", err)
+	}
+	for _, l := range leases {
+		fmt.Fprintf(w, "  name=%s ip_address=%s identifier=%s lease=%s\n", l.Name, l.IPAddress, l.ID, l.Lease)
+	}
+
+	logs := []string{consoleLogFilename, hypervisorLogFilename}
+	if d.Supervise {
+		logs = append(logs, supervisorLogFilename)
+	}
+	if d.ClockSyncInterval > 0 && !d.Supervise {
+		logs = append(logs, clockSyncLogFilename)
+	}
+	if d.TTL > 0 && !d.Supervise {
+		logs = append(logs, ttlLogFilename)
+	}
+	if d.Metrics != "" && !d.Supervise {
+		logs = append(logs, metricsLogFilename)
+	}
+	for _, name := range logs {
+		fmt.Fprintf(w, "Tail of %s:\n", name)
+		data, err := readTail(d.ResolveStorePath(name), diagnoseLogTail)
+		if err != nil {
+			fmt.Fprintf(w, "  %s\n", err)
+			continue
+		}
+		for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+			fmt.Fprintf(w, "  %s\n", line)
+		}
+	}
+}
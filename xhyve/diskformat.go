@@ -0,0 +1,173 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// The formats of the disk images. xhyve boots the raw, qcow2 and sparse
+// bundle ones.
+const (
+	diskFormatRaw          = "raw"
+	diskFormatQcow2        = "qcow2"
+	diskFormatSparseBundle = "sparsebundle"
+	diskFormatQcow         = "qcow"
+	diskFormatVMDK         = "vmdk"
+	diskFormatVDI          = "vdi"
+	diskFormatVHD          = "vhd"
+	diskFormatVHDX         = "vhdx"
+)
+
+// foreignDiskFormats are the disk image formats xhyve can not boot, by the
+// magic at the start of the image.
+var foreignDiskFormats = []struct {
+	offset int64
+	magic  []byte
+	format string
+}{
+	{0, []byte("KDMV"), diskFormatVMDK},
+	{0, []byte("# Disk DescriptorFile"), diskFormatVMDK},
+	{0x40, []byte{0x7f, 0x10, 0xda, 0xbe}, diskFormatVDI},
+	{0, []byte("vhdxfile"), diskFormatVHDX},
+	{0, []byte("conectix"), diskFormatVHD},
+}
+
+// qcowMagic starts the qcow and qcow2 images, followed by their version.
+var qcowMagic = []byte{'Q', 'F', 'I', 0xfb}
+
+// diskImageFormat returns the format of the disk image at path from its
+// header. Images of no known format are raw.
+func diskImageFormat(path string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if fi.IsDir() {
+		if _, err := os.Stat(filepath.Join(path, "Info.plist")); err != nil {
+			return "", fmt.Errorf("%s is not a sparse bundle, it has no Info.plist", path)
+		}
+		return diskFormatSparseBundle, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	header := make([]byte, 512)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	header = header[:n]
+
+	if bytes.HasPrefix(header, qcowMagic) && len(header) >= 8 {
+		if version := binary.BigEndian.Uint32(header[4:8]); version != 2 && version != 3 {
+			return diskFormatQcow, nil
+		}
+		return diskFormatQcow2, nil
+	}
+	for _, f := range foreignDiskFormats {
+		if int64(len(header)) >= f.offset+int64(len(f.magic)) && bytes.Equal(header[f.offset:f.offset+int64(len(f.magic))], f.magic) {
+			return f.format, nil
+		}
+	}
+	return diskFormatRaw, nil
+}
+
+// sniffDiskFormat returns the format of the disk image at path from its
+// header. Images which are not in a format xhyve boots are an error.
+func sniffDiskFormat(path string) (string, error) {
+	format, err := diskImageFormat(path)
+	if err != nil {
+		return "", err
+	}
+	switch format {
+	case diskFormatRaw, diskFormatQcow2, diskFormatSparseBundle:
+		return format, nil
+	case diskFormatQcow:
+		return "", fmt.Errorf("%s is a qcow version 1 image, xhyve only boots qcow2 and qcow3 images", path)
+	}
+	return "", fmt.Errorf("%s is a %s image, which xhyve can not boot. Convert it with \"qemu-img convert -O raw\"", path, strings.ToUpper(format))
+}
+
+// diskFormatPaths returns the disk image paths of the machine by format.
+func (d *Driver) diskFormatPaths() map[string]string {
+	return map[string]string{
+		diskFormatRaw:          d.rawDiskPath(),
+		diskFormatQcow2:        d.qcow2DiskPath(),
+		diskFormatSparseBundle: d.sparseBundlePath(),
+	}
+}
+
+func (d *Driver) diskFormat() string {
+	switch {
+	case d.Qcow2:
+		return diskFormatQcow2
+	case d.RawDisk:
+		return diskFormatRaw
+	}
+	return diskFormatSparseBundle
+}
+
+// setDiskFormat makes the machine boot its disk image as format.
+func (d *Driver) setDiskFormat(format string) {
+	d.Qcow2 = format == diskFormatQcow2
+	d.RawDisk = format == diskFormatRaw
+}
+
+// detectDiskFormat configures the block device of the machine for the
+// format of the disk image it has, from the header of the image rather than
+// the format it was created with: a disk image converted with qemu-img, or
+// an imported one, boots as it is. An image named after another format is
+// renamed after its own.
+func (d *Driver) detectDiskFormat() error {
+	paths := d.diskFormatPaths()
+	configured := d.diskFormat()
+	path := paths[configured]
+	if _, err := os.Stat(path); err != nil {
+		path = ""
+		for _, format := range []string{diskFormatRaw, diskFormatQcow2, diskFormatSparseBundle} {
+			if _, err := os.Stat(paths[format]); err == nil {
+				path = paths[format]
+				break
+			}
+		}
+	}
+	if path == "" {
+		return fmt.Errorf("The disk image of %s is missing, expected %s", d.MachineName, paths[configured])
+	}
+
+	format, err := sniffDiskFormat(path)
+	if err != nil {
+		return err
+	}
+	if path != paths[format] {
+		if format == diskFormatSparseBundle || path == paths[diskFormatSparseBundle] {
+			return fmt.Errorf("%s is a %s image, not a %s", path, format, filepath.Ext(path)[1:])
+		}
+		log.Infof("%s is a %s image, renaming it to %s", filepath.Base(path), format, filepath.Base(paths[format]))
+		if err := os.Rename(path, paths[format]); err != nil {
+			return err
+		}
+	}
+	if d.Hypervisor == hypervisorVZ && format != diskFormatRaw {
+		return fmt.Errorf("The %s hypervisor only boots raw disk images, the disk of %s is a %s image", hypervisorVZ, d.MachineName, format)
+	}
+	if format != configured {
+		log.Infof("The disk of %s is a %s image, booting it as such", d.MachineName, format)
+		d.setDiskFormat(format)
+	}
+	return nil
+}
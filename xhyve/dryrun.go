@@ -0,0 +1,112 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DryRun validates the machine name of the docker-machine store storePath
+// and writes the hypervisor command line, environment and files of the
+// machine to w, without starting it.
+func DryRun(storePath, name string, w io.Writer) error {
+	d, err := loadHostDriver(filepath.Join(storePath, "machines", name))
+	if err != nil {
+		return err
+	}
+	return d.dryRun(w)
+}
+
+func (d *Driver) dryRun(w io.Writer) error {
+	var problems []string
+	if err := d.PreCommandCheck(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := splitExtraArgs(d.ExtraArgs); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	cmd, err := d.hypervisorCommand()
+	if err != nil {
+		return err
+	}
+
+	quoted := make([]string, len(cmd.Args))
+	for i, arg := range cmd.Args {
+		quoted[i] = shellQuote(arg)
+	}
+	fmt.Fprintf(w, "Command:\n  %s\n", strings.Join(quoted, " "))
+
+	environ := make(map[string]bool)
+	for _, e := range os.Environ() {
+		environ[e] = true
+	}
+	fmt.Fprintf(w, "Environment:\n")
+	for _, e := range cmd.Env {
+		if !environ[e] {
+			fmt.Fprintf(w, "  %s\n", e)
+		}
+	}
+
+	fmt.Fprintf(w, "Files:\n")
+	for _, f := range d.dryRunFiles() {
+		status := "ok"
+		if _, err := os.Stat(f.path); err != nil {
+			status = "missing"
+			if f.required {
+				problems = append(problems, fmt.Sprintf("%s %s is missing", f.name, f.path))
+			}
+		}
+		fmt.Fprintf(w, "  %-8s %s (%s)\n", f.name, f.path, status)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%s would not start:\n\t%s", d.MachineName, strings.Join(problems, "\n\t"))
+	}
+	return nil
+}
+
+type dryRunFile struct {
+	name     string
+	path     string
+	required bool
+}
+
+// dryRunFiles lists the files the hypervisor of the machine uses.
+func (d *Driver) dryRunFiles() []dryRunFile {
+	files := []dryRunFile{
+		{"disk", d.diskImagePath(), true},
+		{"pidfile", d.pidfilePath(), false},
+		{"console", d.consoleLogPath(), false},
+	}
+	if d.Bootrom != "" {
+		files = append(files, dryRunFile{"bootrom", d.Bootrom, d.Hypervisor != hypervisorVZ})
+	} else {
+		files = append(files,
+			dryRunFile{"kernel", d.ResolveStorePath(d.Vmlinuz), true},
+			dryRunFile{"initrd", d.ResolveStorePath(d.Initrd), true})
+	}
+	if !d.preset().cloudImage {
+		files = append(files, dryRunFile{"iso", d.ResolveStorePath(isoFilename), true})
+	}
+	if d.preset().seed != nil {
+		files = append(files, dryRunFile{"seed", d.seedISOPath(), true})
+	}
+	return files
+}
+
+// shellQuote quotes s for a POSIX shell when needed.
+func shellQuote(s string) string {
+	if s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./:,=@%+", r))
+	}) < 0 {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
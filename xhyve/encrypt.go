@@ -0,0 +1,95 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+const (
+	// diskKeyService is the service of the keychain items holding the
+	// passphrases of the encrypted disks.
+	diskKeyService = "docker-machine-driver-xhyve"
+
+	// diskEncryption is the hdiutil encryption of the encrypted disks
+	diskEncryption = "AES-256"
+)
+
+// validateEncryptDisk checks the disk of the machine is a sparsebundle, the
+// only disk image hdiutil encrypts.
+func (d *Driver) validateEncryptDisk() error {
+	switch {
+	case d.Qcow2 || d.RawDisk:
+		return fmt.Errorf("--xhyve-encrypt-disk only encrypts sparsebundle disks, it can not be used with --xhyve-qcow2, --xhyve-rawdisk or the %s and %s hypervisors", hypervisorVZ, hypervisorFake)
+	case d.Template != "" || d.ImportDisk != "" || d.preset().cloudImage:
+		return fmt.Errorf("--xhyve-encrypt-disk can not be used with --xhyve-template, --xhyve-import-disk or a cloud image preset, they bring their own disk")
+	}
+	return nil
+}
+
+// newDiskKey generates the passphrase of the encrypted disk and stores it in
+// the login keychain, under a keychain item of its own which is not renamed
+// with the machine.
+func (d *Driver) newDiskKey() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	passphrase := hex.EncodeToString(buf)
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	d.DiskKeyName = d.MachineName + "-" + hex.EncodeToString(suffix)
+
+	// security reads the command from its standard input, the passphrase
+	// is not on the command line of a process
+	cmd := exec.Command("security", "-i")
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("add-generic-password -a %s -s %s -l %s -w %s\n",
+		d.DiskKeyName, diskKeyService, strconv.Quote("xhyve disk of "+d.MachineName), passphrase))
+	if out, err := d.commands().CombinedOutput(cmd); err != nil {
+		return "", fmt.Errorf("Could not store the disk key in the keychain: %s %s", err, strings.TrimSpace(string(out)))
+	}
+	log.Infof("Stored the key of the encrypted disk in the login keychain as %s", d.DiskKeyName)
+	return passphrase, nil
+}
+
+// diskKey reads the passphrase of the encrypted disk from the keychain. The
+// command is run with the runner of the driver but not traced, its output is
+// the passphrase.
+func (d *Driver) diskKey() (string, error) {
+	out, err := untraced(d.commands()).Output(exec.Command("security", "find-generic-password", "-a", d.DiskKeyName, "-s", diskKeyService, "-w"))
+	if err != nil {
+		return "", fmt.Errorf("Could not read the key %s of the encrypted disk of %s from the keychain: %s", d.DiskKeyName, d.MachineName, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// removeDiskKey removes the passphrase of the removed encrypted disk from the
+// keychain.
+func (d *Driver) removeDiskKey() error {
+	if d.DiskKeyName == "" {
+		return nil
+	}
+	if out, err := d.commands().CombinedOutput(exec.Command("security", "delete-generic-password", "-a", d.DiskKeyName, "-s", diskKeyService)); err != nil {
+		return fmt.Errorf("Could not remove the disk key %s from the keychain: %s", d.DiskKeyName, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// stdinPassCommand returns the hdiutil command of args reading the
+// passphrase of the encrypted disk from its standard input.
+func stdinPassCommand(passphrase string, args ...string) *exec.Cmd {
+	cmd := exec.Command("hdiutil", append(args, "-stdinpass")...)
+	cmd.Stdin = strings.NewReader(passphrase)
+	return cmd
+}
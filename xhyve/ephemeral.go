@@ -0,0 +1,94 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+const (
+	// ephemeralVolumePrefix names the RAM disk volumes of the ephemeral
+	// machines
+	ephemeralVolumePrefix = "docker-machine-"
+
+	// ephemeralVolumeOverhead is the share of the RAM disk added to the disk
+	// size for the HFS+ metadata
+	ephemeralVolumeOverhead = 10
+)
+
+// ephemeralDiskDir returns the --xhyve-disk-dir of the ephemeral machine: a
+// directory of its RAM disk volume, or of the temporary directory for the
+// fake hypervisor.
+func (d *Driver) ephemeralDiskDir() string {
+	volume := filepath.Join("/Volumes", ephemeralVolumePrefix+d.MachineName)
+	if d.Hypervisor == hypervisorFake {
+		volume = filepath.Join(os.TempDir(), ephemeralVolumePrefix+d.MachineName)
+	}
+	return filepath.Join(volume, d.MachineName)
+}
+
+// mountEphemeralVolume creates and mounts the RAM disk volume the disk image
+// of the ephemeral machine is created in, unless it is mounted already.
+func (d *Driver) mountEphemeralVolume() error {
+	volume := filepath.Dir(d.DiskDir)
+	if _, err := os.Stat(volume); err == nil {
+		return nil
+	}
+	if d.Hypervisor == hypervisorFake {
+		return os.MkdirAll(volume, 0755)
+	}
+
+	size := d.DiskSize * (100 + ephemeralVolumeOverhead) / 100
+	log.Infof("Creating a %dMB RAM disk for the ephemeral disk image...", size)
+	out, err := d.commands().Output(exec.Command("hdiutil", "attach", "-nomount", fmt.Sprintf("ram://%d", size*2048)))
+	if err != nil {
+		return fmt.Errorf("Could not create the RAM disk: %s", err)
+	}
+	dev := strings.TrimSpace(string(out))
+	if out, err := d.commands().CombinedOutput(exec.Command("diskutil", "erasevolume", "HFS+", filepath.Base(volume), dev)); err != nil {
+		runCommand(d.commands(), exec.Command("hdiutil", "detach", dev))
+		return fmt.Errorf("Could not format the RAM disk %s: %s", dev, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// unmountEphemeralVolume ejects the RAM disk volume of the ephemeral machine,
+// which frees its memory.
+func (d *Driver) unmountEphemeralVolume() error {
+	volume := filepath.Dir(d.DiskDir)
+	if d.Hypervisor == hypervisorFake {
+		return os.RemoveAll(volume)
+	}
+	if _, err := os.Stat(volume); err != nil {
+		return nil
+	}
+	if out, err := d.commands().CombinedOutput(exec.Command("hdiutil", "detach", "-force", volume)); err != nil {
+		return fmt.Errorf("Could not eject the RAM disk %s: %s", volume, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// recreateEphemeralDisk creates the disk image of the ephemeral machine again
+// after its RAM disk was lost, when the host restarted. The containers and
+// images are lost with it.
+func (d *Driver) recreateEphemeralDisk() error {
+	if d.Template != "" || d.preset().cloudImage {
+		return fmt.Errorf("The ephemeral disk of %s was lost, remove and create the machine again", d.MachineName)
+	}
+	log.Warnf("The ephemeral disk of %s was lost, creating an empty one...", d.MachineName)
+	if err := d.mountEphemeralVolume(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(d.DiskDir, privateDirMode); err != nil {
+		return err
+	}
+	return d.createDisk()
+}
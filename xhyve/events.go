@@ -0,0 +1,73 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// EventsFileEnv is the environment variable naming the file the events of
+// the operations run by this invocation of the driver are appended to.
+const EventsFileEnv = "XHYVE_EVENTS_FILE"
+
+// The statuses of the events of an operation or create step
+const (
+	eventStarted = "started"
+	eventDone    = "done"
+	eventFailed  = "failed"
+)
+
+// event is a JSON line of the events file.
+type event struct {
+	Time    time.Time `json:"time"`
+	Driver  string    `json:"driver"`
+	Op      string    `json:"op"`
+	Machine string    `json:"machine"`
+	Step    string    `json:"step,omitempty"`
+	Status  string    `json:"status"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// emitEvent appends the status of op, or of its step, as a JSON line to the
+// file of EventsFileEnv when it is set. err is the error of a failed one.
+// The file is opened for each event, the drivers of several machines append
+// to it at once.
+func (d *Driver) emitEvent(op, step, status string, err error) {
+	path := os.Getenv(EventsFileEnv)
+	if path == "" {
+		return
+	}
+	e := event{Time: time.Now().UTC(), Driver: d.DriverName(), Op: op, Machine: d.MachineName, Step: step, Status: status}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	data, jsonErr := json.Marshal(e)
+	if jsonErr != nil {
+		return
+	}
+
+	f, openErr := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, privateFileMode)
+	if openErr != nil {
+		log.Warnf("Could not write the events file: %s", openErr)
+		return
+	}
+	defer f.Close()
+	if _, writeErr := f.Write(append(data, '\n')); writeErr != nil {
+		log.Warnf("Could not write the events file: %s", writeErr)
+	}
+}
+
+// endEvent logs the end of op or of its step, done or failed with err.
+func (d *Driver) endEvent(op, step string, err error) {
+	if err != nil {
+		d.emitEvent(op, step, eventFailed, err)
+		return
+	}
+	d.emitEvent(op, step, eventDone, nil)
+}
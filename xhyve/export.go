@@ -0,0 +1,388 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/state"
+)
+
+// hostConfigFilename is the docker-machine host configuration of a machine.
+const hostConfigFilename = "config.json"
+
+// transientFiles are the machine files which only make sense on the host
+// running the machine, and are not exported.
+var transientFiles = map[string]bool{
+	consoleLogFilename:    true,
+	hypervisorLogFilename: true,
+	clockSyncLogFilename:  true,
+	ttlLogFilename:        true,
+	metricsLogFilename:    true,
+	exitStatusFilename:    true,
+	startingFilename:      true,
+	createStateFilename:   true,
+	isoMountPath:          true,
+	snapshotsDir:          true,
+	"tty":                 true,
+	"tty2":                true,
+}
+
+// tlsFiles are the TLS certificates and keys docker-machine writes to the
+// machine directory. They are signed by the CA of the exporting store, the
+// server key included, and are not exported: "docker-machine
+// regenerate-certs" makes new ones for the importing store.
+var tlsFiles = map[string]bool{
+	"ca.pem":         true,
+	"cert.pem":       true,
+	"key.pem":        true,
+	"server.pem":     true,
+	"server-key.pem": true,
+}
+
+// authPathFields are the fields of the AuthOptions of a host configuration
+// holding a path of the host, the remote paths are the ones of the guest.
+var authPathFields = []string{
+	"CertDir",
+	"CaCertPath",
+	"CaPrivateKeyPath",
+	"ServerCertPath",
+	"ServerKeyPath",
+	"ClientKeyPath",
+	"ClientCertPath",
+	"StorePath",
+}
+
+// isTransient reports whether the machine file name is left out of exports.
+func isTransient(name string) bool {
+	return transientFiles[name] || tlsFiles[name] || strings.HasSuffix(name, ".pid") || strings.HasPrefix(name, consoleLogFilename+".") ||
+		strings.HasPrefix(name, hypervisorLogFilename+".")
+}
+
+// loadHostDriver reads the driver of the machine directory dir.
+func loadHostDriver(dir string) (*Driver, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, hostConfigFilename))
+	if err != nil {
+		return nil, err
+	}
+
+	var config struct {
+		Driver *Driver
+	}
+	config.Driver = NewDriver("", "")
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("Could not read %s: %s", filepath.Join(dir, hostConfigFilename), err)
+	}
+	return config.Driver, nil
+}
+
+// storeMachines returns the drivers of the xhyve machines of the
+// docker-machine store storePath by machine name. The machines which can not
+// be read are left out.
+func storeMachines(storePath string) map[string]*Driver {
+	machines := make(map[string]*Driver)
+	configs, _ := filepath.Glob(filepath.Join(storePath, "machines", "*", hostConfigFilename))
+	for _, path := range configs {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var config struct {
+			DriverName string
+			Driver     *Driver
+		}
+		config.Driver = NewDriver("", "")
+		if err := json.Unmarshal(data, &config); err != nil || config.DriverName != config.Driver.DriverName() {
+			continue
+		}
+		machines[filepath.Base(filepath.Dir(path))] = config.Driver
+	}
+	return machines
+}
+
+// ExportMachine writes the stopped machine name of the docker-machine store
+// storePath to the gzipped tarball out. The disk image, ISO, SSH keys and
+// configuration are exported, the TLS certificates and keys are not.
+func ExportMachine(storePath, name, out string) error {
+	dir := filepath.Join(storePath, "machines", name)
+	d, err := loadHostDriver(dir)
+	if err != nil {
+		return err
+	}
+	if s, err := d.processState(); err == nil && (s == state.Running || s == state.Paused) {
+		return fmt.Errorf("%s is %s, stop it before exporting it", name, strings.ToLower(s.String()))
+	}
+
+	f, err := os.OpenFile(out, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	log.Infof("Exporting %s to %s...", name, out)
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	// the disk image of a --xhyve-disk-dir goes with the other files
+	for _, root := range []string{dir, d.DiskDir} {
+		if root == "" {
+			continue
+		}
+		err = filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil || rel == "." {
+				return err
+			}
+			if filepath.Dir(rel) == "." && isTransient(rel) {
+				if fi.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			// the ttys of the hypervisor are symlinks to /dev
+			if !fi.IsDir() && !fi.Mode().IsRegular() {
+				return nil
+			}
+			return addToTar(tw, path, filepath.ToSlash(rel), fi)
+		})
+		if err != nil {
+			break
+		}
+	}
+	if err != nil {
+		os.Remove(out)
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func addToTar(tw *tar.Writer, path, name string, fi os.FileInfo) error {
+	hdr, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// ImportMachine extracts the machine tarball in into the docker-machine store
+// storePath as the machine name. The paths of its configuration are moved to
+// the store, and its UUID and IP address are reset so the import gets its own
+// on this host. The TLS certificates are not exported, they have to be
+// regenerated.
+func ImportMachine(storePath, in, name string) error {
+	dir := filepath.Join(storePath, "machines", name)
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("Machine %s already exists", name)
+	}
+
+	f, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("%s is not a machine export: %s", in, err)
+	}
+
+	log.Infof("Importing %s as %s...", in, name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err := extractTar(tar.NewReader(gz), dir); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	if err := relocateHostConfig(filepath.Join(dir, hostConfigFilename), storePath, name); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+
+	log.Infof("Run \"docker-machine regenerate-certs %s\" after starting it", name)
+	return nil
+}
+
+func extractTar(tr *tar.Reader, dir string) error {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		path := filepath.Join(dir, filepath.FromSlash(hdr.Name))
+		if !strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			return fmt.Errorf("Invalid path %q in the machine export", hdr.Name)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0700); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, os.FileMode(hdr.Mode).Perm())
+			if err != nil {
+				return err
+			}
+			err = copySparse(f, tr, hdr.Size)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// copySparse copies the size bytes of r to f, leaving holes for the blocks of
+// zeros, so sparse disk images stay sparse.
+func copySparse(f *os.File, r io.Reader, size int64) error {
+	buf := make([]byte, 65536)
+	zero := make([]byte, len(buf))
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if bytes.Equal(buf[:n], zero[:n]) {
+				if _, err := f.Seek(int64(n), os.SEEK_CUR); err != nil {
+					return err
+				}
+			} else if _, err := f.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return f.Truncate(size)
+}
+
+// relocateHostConfig rewrites the host configuration file of an imported
+// machine for the store storePath and the machine name.
+func relocateHostConfig(file, storePath, name string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("%s is not a machine export: %s", filepath.Base(file), err)
+	}
+
+	var config map[string]interface{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return err
+	}
+	driver, ok := config["Driver"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%s has no driver configuration", file)
+	}
+	oldStorePath, _ := driver["StorePath"].(string)
+	oldName, _ := driver["MachineName"].(string)
+	if oldStorePath == "" || oldName == "" {
+		return fmt.Errorf("%s has no machine name or store path", file)
+	}
+
+	// move the paths of the exporting store, machine directory first
+	oldDir := filepath.Join(oldStorePath, "machines", oldName)
+	dir := filepath.Join(storePath, "machines", name)
+	move := func(path string) string {
+		if moved := relocatePath(path, oldDir, dir); moved != path {
+			return moved
+		}
+		return relocatePath(path, oldStorePath, storePath)
+	}
+	relocateAuthOptions(config, move)
+
+	config["Name"] = name
+	driver["MachineName"] = name
+	driver["StorePath"] = storePath
+	if sshKeyPath, _ := driver["SSHKeyPath"].(string); sshKeyPath != "" {
+		driver["SSHKeyPath"] = move(sshKeyPath)
+	}
+	// the files are renamed on the first start
+	if artifactName, _ := driver["ArtifactName"].(string); artifactName == "" {
+		driver["ArtifactName"] = oldName
+	}
+	driver["UUID"] = ""
+	driver["MacAddr"] = ""
+	driver["IPAddress"] = ""
+	// the static IP may be the one of the exported machine on this host, a
+	// new one is bound to the new MAC address
+	if staticIP, _ := driver["StaticIP"].(string); staticIP != "" {
+		driver["StaticIP"] = staticIPAuto
+	}
+	driver["DiskNumber"] = defaultDiskNumber
+	// the disk image is imported into the machine directory
+	driver["DiskDir"] = ""
+
+	out, err := json.MarshalIndent(config, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, out, 0600)
+}
+
+// relocatePath returns path moved from the directory oldDir to dir, or path
+// when it is not in oldDir.
+func relocatePath(path, oldDir, dir string) string {
+	if path == oldDir {
+		return dir
+	}
+	if strings.HasPrefix(path, oldDir+string(filepath.Separator)) {
+		return filepath.Join(dir, path[len(oldDir):])
+	}
+	return path
+}
+
+// relocateAuthOptions moves the host paths of the AuthOptions of the host
+// configuration config with move.
+func relocateAuthOptions(config map[string]interface{}, move func(string) string) {
+	hostOptions, _ := config["HostOptions"].(map[string]interface{})
+	authOptions, _ := hostOptions["AuthOptions"].(map[string]interface{})
+	for _, field := range authPathFields {
+		if path, _ := authOptions[field].(string); path != "" {
+			authOptions[field] = move(path)
+		}
+	}
+}
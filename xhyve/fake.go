@@ -0,0 +1,242 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/zchee/docker-machine-driver-xhyve/vmnet"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// hypervisorFake simulates the machine without running a guest, to test
+	// the driver on hosts without Hypervisor.framework nor root.
+	hypervisorFake = "fake"
+
+	// fakeLeasesFilename is the leases file of the fake machine, in the
+	// format of the vmnet DHCP server
+	fakeLeasesFilename = "fake-leases"
+
+	// fakeIP is the address of the fake machine, whose sshd listens on the
+	// host
+	fakeIP = "127.0.0.1"
+
+	// fakeOSRelease is the os-release of boot2docker the fake machine
+	// answers, so that docker-machine provisions it as a boot2docker guest
+	fakeOSRelease = "NAME=Boot2Docker\nVERSION=0.0.0-fake\nID=boot2docker\nID_LIKE=tcl\nVERSION_ID=0.0.0-fake\nPRETTY_NAME=\"Boot2Docker 0.0.0-fake (TCL 0.0)\"\n"
+)
+
+func init() {
+	backends[hypervisorFake] = fakeBackend{}
+}
+
+// fakeBackend runs FakeVM in a child process of the driver binary.
+type fakeBackend struct{}
+
+func (fakeBackend) command(d *Driver, args []string) (*exec.Cmd, error) {
+	config, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(d.driverBinary(), "fake-vm")
+	cmd.Stdin = bytes.NewReader(config)
+	return cmd, nil
+}
+
+func (fakeBackend) macAddress(d *Driver) (string, error) {
+	return macFromUUID(d.UUID)
+}
+
+// processName returns the truncated name of the driver binary, like the
+// embedded hypervisor.
+func (fakeBackend) processName(d *Driver) string { return "docker-machine" }
+
+func (fakeBackend) version(d *Driver) (string, error) {
+	return fmt.Sprintf("%s (fake)", Version), nil
+}
+
+func (fakeBackend) writesPidfile() bool { return false }
+
+// freePort returns a TCP port of the host nothing listens on.
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", net.JoinHostPort(fakeIP, "0"))
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+func (d *Driver) fakeLeasesPath() string {
+	return d.ResolveStorePath(fakeLeasesFilename)
+}
+
+// writeFakeLease leases fakeIP to the machine MAC address for a day.
+func (d *Driver) writeFakeLease() error {
+	lease := fmt.Sprintf("{\n\tname=%s\n\tip_address=%s\n\thw_address=1,%s\n\tidentifier=1,%s\n\tlease=0x%x\n}\n",
+		d.hostname(), fakeIP, d.MacAddr, d.MacAddr, time.Now().Add(24*time.Hour).Unix())
+	return ioutil.WriteFile(d.fakeLeasesPath(), []byte(lease), 0644)
+}
+
+// fakeLeaseIP returns the IP address of the fake lease of the machine.
+func (d *Driver) fakeLeaseIP() (string, error) {
+	leases, err := vmnet.ParseLeasesFile(d.fakeLeasesPath())
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	for _, l := range leases {
+		if l.HWAddress == d.MacAddr {
+			return l.IPAddress, nil
+		}
+	}
+	return "", fmt.Errorf("IP not found for MAC %s in DHCP leases", d.MacAddr)
+}
+
+// FakeVM runs the fake machine of the driver configuration read from r until
+// it is terminated: it leases fakeIP to the machine, logs a boot on the
+// console and answers SSH for the machine key, running no command.
+func FakeVM(r io.Reader) error {
+	d := NewDriver("", "")
+	if err := json.NewDecoder(r).Decode(d); err != nil {
+		return fmt.Errorf("Invalid driver configuration: %s", err)
+	}
+
+	config, err := d.fakeSSHConfig()
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(fakeIP, strconv.Itoa(d.SSHPort)))
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	console, err := openPrivateLog(d.consoleLogPath())
+	if err != nil {
+		return err
+	}
+	defer console.Close()
+	fmt.Fprintf(console, "Linux version 0.0.0-fake (%s)\n", d.MachineName)
+	fmt.Fprintf(console, "init fake started\n")
+
+	if err := d.writeFakeLease(); err != nil {
+		return err
+	}
+	fmt.Fprintf(console, "Lease of %s obtained\n", fakeIP)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeSSH(conn, config, console)
+		}
+	}()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	<-sigCh
+	fmt.Fprintf(console, "reboot: Power down\n")
+	return nil
+}
+
+// fakeSSHConfig accepts the public key of the machine, with a host key
+// generated for the run. The host key is an ECDSA one, the current ssh
+// clients refuse the ssh-rsa host keys.
+func (d *Driver) fakeSSHConfig() (*ssh.ServerConfig, error) {
+	data, err := ioutil.ReadFile(d.publicSSHKeyPath())
+	if err != nil {
+		return nil, err
+	}
+	authorized, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s: %s", d.publicSSHKeyPath(), err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("Unknown public key for %s", conn.User())
+		},
+	}
+	config.AddHostKey(signer)
+	return config, nil
+}
+
+// serveFakeSSH serves the SSH connection conn. The commands are logged on
+// console and succeed without output, but "cat /etc/os-release" which
+// answers fakeOSRelease. The shells exit at once.
+func serveFakeSSH(conn net.Conn, config *ssh.ServerConfig, console io.Writer) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		log.Debugf("Fake SSH handshake failed: %s", err)
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer channel.Close()
+			for req := range requests {
+				switch req.Type {
+				case "exec", "shell":
+					if req.Type == "exec" {
+						var payload struct{ Command string }
+						ssh.Unmarshal(req.Payload, &payload)
+						fmt.Fprintf(console, "ssh: %s\n", payload.Command)
+						if strings.TrimSpace(payload.Command) == "cat /etc/os-release" {
+							io.WriteString(channel, fakeOSRelease)
+						}
+					}
+					req.Reply(true, nil)
+					channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+					return
+				default:
+					// pty, environment and the like
+					if req.WantReply {
+						req.Reply(true, nil)
+					}
+				}
+			}
+		}()
+	}
+}
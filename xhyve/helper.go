@@ -0,0 +1,271 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// HelperName is the name of the setuid root copy of the driver binary which
+// only runs the hypervisor. vmnet.framework needs root, with the helper
+// installed the driver itself runs unprivileged.
+const HelperName = "docker-machine-xhyve-helper"
+
+// driverBinary returns the path of the driver binary which runs the embedded
+// hypervisor, the supervisor and the clock sync: the DriverBinary set by a
+// tool embedding the driver package, else the running binary.
+func (d *Driver) driverBinary() string {
+	if d.DriverBinary != "" {
+		return d.DriverBinary
+	}
+	return os.Args[0]
+}
+
+// helperBinary returns the path of the helper, given with
+// --xhyve-helper-path, installed next to the driver or in the PATH. It
+// returns "" when there is no helper.
+func (d *Driver) helperBinary() string {
+	if d.HelperPath != "" {
+		return d.HelperPath
+	}
+	next := filepath.Join(filepath.Dir(d.driverBinary()), HelperName)
+	if _, err := os.Stat(next); err == nil {
+		return next
+	}
+	if path, err := exec.LookPath(HelperName); err == nil {
+		return path
+	}
+	return ""
+}
+
+// privilegedBinary returns the binary which has to be setuid root to run
+// the hypervisor of the machine, or "" when it runs unprivileged.
+func (d *Driver) privilegedBinary() string {
+	if d.Hypervisor == hypervisorVZ {
+		// Virtualization.framework provides its own NAT networking
+		return ""
+	}
+	if d.Hypervisor == hypervisorFake {
+		return ""
+	}
+	// hyperkit and --xhyve-binary inherit the privileges of the driver
+	if d.Hypervisor == hypervisorEmbedded && d.XhyveBinary == "" {
+		if helper := d.helperBinary(); helper != "" {
+			return helper
+		}
+	}
+	return d.driverBinary()
+}
+
+// hypervisorBinary returns the binary running the hypervisor of the machine:
+// hyperkit, the --xhyve-binary, the helper or the driver itself.
+func (d *Driver) hypervisorBinary() (string, error) {
+	if d.Hypervisor == hypervisorHyperkit {
+		return d.hyperkitBinary()
+	}
+	if d.Hypervisor == hypervisorEmbedded && d.XhyveBinary != "" {
+		return d.XhyveBinary, nil
+	}
+	if d.Hypervisor == hypervisorEmbedded {
+		if helper := d.helperBinary(); helper != "" {
+			return helper, nil
+		}
+	}
+	return d.driverBinary(), nil
+}
+
+// checkSetuidRoot makes sure bin is owned by root with the setuid bit, which
+// vmnet.framework needs, and explains how to get there.
+func (d *Driver) checkSetuidRoot(bin string) error {
+	fi, err := os.Stat(bin)
+	if err != nil {
+		return err
+	}
+	if int(fi.Sys().(*syscall.Stat_t).Uid) == 0 && fi.Mode()&os.ModeSetuid != 0 {
+		return nil
+	}
+
+	return fmt.Errorf("%s needs root owner and the setuid bit to use vmnet.framework. Either run\n"+
+		"\tsudo chown root:wheel %s && sudo chmod u+s %s\n"+
+		"or install a helper running only the hypervisor as root and keep the driver unprivileged:\n"+
+		"\tsudo cp %s %s && sudo chown root:wheel %s && sudo chmod u+s %s\n"+
+		"See https://github.com/zchee/docker-machine-driver-xhyve#install",
+		fi.Name(), bin, bin, d.driverBinary(), filepath.Join(filepath.Dir(d.driverBinary()), HelperName),
+		filepath.Join(filepath.Dir(d.driverBinary()), HelperName), filepath.Join(filepath.Dir(d.driverBinary()), HelperName))
+}
+
+// helperCommand returns the command running the hypervisor of args with the
+// helper. The helper does not take hypervisor arguments: it builds them from
+// the configuration of the machine given on its stdin, or only asks vmnet for
+// the MAC address of the UUID of the machine.
+func (d *Driver) helperCommand(helper string, args []string) (*exec.Cmd, error) {
+	if args[len(args)-1] == "-M" {
+		return exec.Command(helper, "mac-address", d.UUID), nil
+	}
+	if len(d.Virtio9p) > 0 || len(d.ExtraArgs) > 0 {
+		return nil, fmt.Errorf("The %s helper does not run machines with --xhyve-virtio-9p or --xhyve-extra-args, "+
+			"the hypervisor would use them as root. Make the driver itself setuid root instead, see %s", HelperName, d.driverBinary())
+	}
+	config, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(helper, "run")
+	cmd.Stdin = bytes.NewReader(config)
+	return cmd, nil
+}
+
+// HelperVM is a machine the helper runs: its hypervisor arguments refer to
+// the disk and boot files the helper opened for the user running it.
+type HelperVM struct {
+	// Args are the hypervisor arguments of the machine
+	Args []string
+
+	files   []*os.File
+	console *os.File
+}
+
+// OpenHelperVM reads the configuration of the machine to run from r, and
+// opens its disk, boot files, pidfile and console log with the privileges of
+// the user running the helper, in a machine directory of that user. The
+// hypervisor gets their descriptors: it never opens a path of the user as
+// root, nor gets a shared folder or an argument of the user.
+func OpenHelperVM(r io.Reader) (*HelperVM, error) {
+	d, err := readHelperMachine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(d.Virtio9p) > 0 || len(d.ExtraArgs) > 0 {
+		return nil, fmt.Errorf("%s does not run machines with shared folders or extra arguments", HelperName)
+	}
+
+	vm := &HelperVM{}
+	err = asUser(func() error {
+		if err := d.checkHelperMachineOwner(); err != nil {
+			return err
+		}
+
+		var err error
+		if vm.Args, err = d.xhyveArgsWith(vm.open); err != nil {
+			return err
+		}
+		// the hypervisor runs in the helper, which writes the pidfile
+		if err := ioutil.WriteFile(d.pidfilePath(), []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+			return err
+		}
+		vm.console, err = openPrivateLog(d.consoleLogPath())
+		return err
+	})
+	if err != nil {
+		vm.Close()
+		return nil, err
+	}
+	return vm, nil
+}
+
+// RemoveHelperLease removes the DHCP leases of the machine configured on r,
+// in a machine directory of the user running the helper. Only the MAC
+// address of that machine is removed, not the leases of the machines of the
+// other users.
+func RemoveHelperLease(r io.Reader) error {
+	d, err := readHelperMachine(r)
+	if err != nil {
+		return err
+	}
+	if err := asUser(d.checkHelperMachineOwner); err != nil {
+		return err
+	}
+	return RemoveLease(d.MacAddr)
+}
+
+// readHelperMachine reads the configuration of the machine the helper works
+// for from r.
+func readHelperMachine(r io.Reader) (*Driver, error) {
+	d := NewDriver("", "")
+	if err := json.NewDecoder(r).Decode(d); err != nil {
+		return nil, err
+	}
+	if d.MachineName == "" || filepath.Base(d.MachineName) != d.MachineName || d.MachineName == ".." {
+		return nil, fmt.Errorf("Invalid machine name %q", d.MachineName)
+	}
+	return d, nil
+}
+
+// checkHelperMachineOwner makes sure the machine directory belongs to the
+// user running the helper.
+func (d *Driver) checkHelperMachineOwner() error {
+	dir := d.ResolveStorePath(".")
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Getuid() {
+		return fmt.Errorf("The machine directory %s does not belong to the user running %s", dir, HelperName)
+	}
+	return nil
+}
+
+// open opens the file path of the machine, writable or not, and returns the
+// path of its descriptor.
+func (vm *HelperVM) open(path string, write bool) (string, error) {
+	flag := os.O_RDONLY
+	if write {
+		flag = os.O_RDWR
+	}
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return "", err
+	}
+	vm.files = append(vm.files, f)
+	return fmt.Sprintf("/dev/fd/%d", f.Fd()), nil
+}
+
+// LogConsole copies everything the guest writes on the pty into the console
+// log of the machine. It blocks until the pty is closed.
+func (vm *HelperVM) LogConsole(pty string) error {
+	return copyConsole(pty, vm.console)
+}
+
+// Close closes the files of the machine.
+func (vm *HelperVM) Close() {
+	for _, f := range vm.files {
+		f.Close()
+	}
+	if vm.console != nil {
+		vm.console.Close()
+	}
+}
+
+// HelperMACArgs returns the hypervisor arguments asking vmnet for the MAC
+// address of the machine UUID uuid, which boot nothing.
+func HelperMACArgs(uuid string) ([]string, error) {
+	if !uuidRegexp.MatchString(uuid) {
+		return nil, fmt.Errorf("Invalid UUID %q", uuid)
+	}
+	return []string{"xhyve", "-U", uuid, "-s", "0:0,hostbridge", "-s", "31,lpc", "-s", "2:0,virtio-net", "-f", "kexec,/dev/null,,", "-M"}, nil
+}
+
+// asUser runs fn with the effective user ID of the user running the setuid
+// root helper, and gets root back for vmnet.framework.
+func asUser(fn func() error) error {
+	euid := os.Geteuid()
+	if err := syscall.Seteuid(os.Getuid()); err != nil {
+		return err
+	}
+	err := fn()
+	if e := syscall.Seteuid(euid); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
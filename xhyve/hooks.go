@@ -0,0 +1,110 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/log"
+)
+
+// The lifecycle hooks. The pre hooks failing fail the operation, the post
+// hooks failing only warn.
+const (
+	hookPreStart   = "pre-start"
+	hookPostStart  = "post-start"
+	hookPreStop    = "pre-stop"
+	hookPostRemove = "post-remove"
+)
+
+// hooks are the lifecycle hooks, in the order of their flags.
+var hooks = []string{hookPreStart, hookPostStart, hookPreStop, hookPostRemove}
+
+// hookScripts returns the fields keeping the scripts of the hooks.
+func (d *Driver) hookScripts() map[string]*string {
+	return map[string]*string{
+		hookPreStart:   &d.PreStartHook,
+		hookPostStart:  &d.PostStartHook,
+		hookPreStop:    &d.PreStopHook,
+		hookPostRemove: &d.PostRemoveHook,
+	}
+}
+
+// hookFlag is the flag setting the script of the hook.
+func hookFlag(hook string) string {
+	return "xhyve-" + hook + "-hook"
+}
+
+// setHookScripts reads the hook flags. The scripts must be executable, they
+// are kept as absolute paths.
+func (d *Driver) setHookScripts(flags drivers.DriverOptions) error {
+	scripts := d.hookScripts()
+	for _, hook := range hooks {
+		path := flags.String(hookFlag(hook))
+		if path != "" {
+			abs, err := filepath.Abs(path)
+			if err != nil {
+				return err
+			}
+			if fi, err := os.Stat(abs); err != nil || fi.IsDir() || fi.Mode()&0111 == 0 {
+				return fmt.Errorf("The --%s %s is not an executable file", hookFlag(hook), path)
+			}
+			path = abs
+		}
+		*scripts[hook] = path
+	}
+	return nil
+}
+
+// hookEnv returns the machine metadata handed to the hook scripts.
+func (d *Driver) hookEnv(hook string) []string {
+	return []string{
+		"XHYVE_HOOK=" + hook,
+		"XHYVE_MACHINE_NAME=" + d.MachineName,
+		"XHYVE_MACHINE_DIR=" + d.ResolveStorePath("."),
+		"XHYVE_MACHINE_UUID=" + d.UUID,
+		"XHYVE_MACHINE_MAC=" + d.MacAddr,
+		"XHYVE_MACHINE_IP=" + d.IPAddress,
+		"XHYVE_SSH_USER=" + d.SSHUser,
+		"XHYVE_SSH_PORT=" + strconv.Itoa(d.SSHPort),
+		"XHYVE_SSH_KEY=" + d.GetSSHKeyPath(),
+	}
+}
+
+// runHook runs the script of the hook, if any, in the machine directory.
+func (d *Driver) runHook(hook string) error {
+	script := *d.hookScripts()[hook]
+	if script == "" {
+		return nil
+	}
+
+	log.Infof("Running the %s hook %s...", hook, script)
+	cmd := exec.Command(script)
+	cmd.Dir = d.ResolveStorePath(".")
+	cmd.Env = append(os.Environ(), d.hookEnv(hook)...)
+	out, err := d.commands().CombinedOutput(cmd)
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if line != "" {
+			log.Infof("%s: %s", hook, line)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("The %s hook %s failed: %s", hook, script, err)
+	}
+	return nil
+}
+
+// runPostHook runs the post hook, whose failure only warns.
+func (d *Driver) runPostHook(hook string) {
+	if err := d.runHook(hook); err != nil {
+		log.Warnf("%s", err)
+	}
+}
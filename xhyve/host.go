@@ -0,0 +1,219 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// hypervisorKexts lists the kernel extensions of other hypervisors which
+// claim VT-x for themselves. Loaded versions older than minVersion make the
+// host kernel panic as soon as xhyve starts a guest.
+var hypervisorKexts = []struct {
+	bundleID   string
+	product    string
+	minVersion []int
+}{
+	{"org.virtualbox.kext.VBoxDrv", "VirtualBox", []int{5}},
+	{"com.vmware.kext.vmx86", "VMware Fusion", nil},
+	{"com.parallels.kext.hypervisor", "Parallels Desktop", nil},
+}
+
+// kextstatRegexp matches a "kextstat -l" line, capturing the bundle ID and version.
+var kextstatRegexp = regexp.MustCompile(`\s([\w.-]+) \(([\d.]+)\)`)
+
+// loadedKexts returns the versions of the loaded kernel extensions, keyed by bundle ID.
+func loadedKexts(r CommandRunner) (map[string]string, error) {
+	out, err := r.Output(exec.Command("kextstat", "-l"))
+	if err != nil {
+		return nil, fmt.Errorf("kextstat failed: %s", err)
+	}
+	return parseKextstat(string(out)), nil
+}
+
+func parseKextstat(out string) map[string]string {
+	kexts := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		if m := kextstatRegexp.FindStringSubmatch(line); m != nil {
+			kexts[m[1]] = m[2]
+		}
+	}
+	return kexts
+}
+
+// checkHypervisorConflicts fails if a loaded hypervisor is known to crash the
+// host together with xhyve, and warns about the ones which may still compete
+// for VT-x.
+func checkHypervisorConflicts(r CommandRunner) error {
+	kexts, err := loadedKexts(r)
+	if err != nil {
+		log.Warnf("Could not check for conflicting hypervisors: %s", err)
+		return nil
+	}
+
+	for _, k := range hypervisorKexts {
+		version, ok := kexts[k.bundleID]
+		if !ok {
+			continue
+		}
+		log.Debugf("Found %s kernel extension %s (%s)", k.product, k.bundleID, version)
+
+		if k.minVersion == nil {
+			log.Warnf("%s is loaded. Running its virtual machines at the same time as xhyve may fail", k.product)
+			continue
+		}
+
+		ver, err := parseVersion(version)
+		if err != nil {
+			log.Warnf("Could not parse the %s version: %s", k.product, err)
+			continue
+		}
+		if versionLess(ver, k.minVersion) {
+			return fmt.Errorf("%s %s is loaded and will cause a kernel panic if xhyve tries to run.\n"+
+				"\tPlease upgrade %s or unload %s", k.product, version, k.product, k.bundleID)
+		}
+	}
+
+	return nil
+}
+
+// sysctl returns the value of the named kernel state variable.
+func sysctl(r CommandRunner, name string) (string, error) {
+	out, err := r.Output(exec.Command("sysctl", "-n", name))
+	if err != nil {
+		return "", fmt.Errorf("sysctl %s failed: %s", name, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// macOSVersion returns the product version of the host, like "10.12.5".
+func macOSVersion(r CommandRunner) (string, error) {
+	out, err := r.Output(exec.Command("sw_vers", "-productVersion"))
+	if err != nil {
+		return "", fmt.Errorf("sw_vers failed: %s", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// parseVersion splits a dotted version string into its numeric components.
+func parseVersion(v string) ([]int, error) {
+	var parts []int
+	for _, p := range strings.Split(strings.TrimSpace(v), ".") {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version %q", v)
+		}
+		parts = append(parts, n)
+	}
+	return parts, nil
+}
+
+// versionLess reports whether version a is lower than version b.
+func versionLess(a, b []int) bool {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			return x < y
+		}
+	}
+	return false
+}
+
+// checkHypervisorSupport makes sure the host can run Hypervisor.framework guests.
+func checkHypervisorSupport(r CommandRunner) error {
+	hvSupport, err := sysctl(r, "kern.hv_support")
+	if err != nil {
+		return fmt.Errorf("Could not detect Hypervisor.framework support: %s", err)
+	}
+	if hvSupport != "1" {
+		return fmt.Errorf("Hypervisor.framework is not supported on this host (kern.hv_support=%s).\n"+
+			"\txhyve needs a 2010 or later Mac whose CPU supports EPT and unrestricted guests.\n"+
+			"\tIf you are running macOS inside a virtual machine, enable nested virtualization for it.", hvSupport)
+	}
+
+	return nil
+}
+
+// hostCPUs returns the number of logical CPUs of the host.
+func hostCPUs(r CommandRunner) (int, error) {
+	out, err := sysctl(r, "hw.ncpu")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(out)
+}
+
+// hostMemory returns the physical memory of the host in MB.
+func hostMemory(r CommandRunner) (int, error) {
+	out, err := sysctl(r, "hw.memsize")
+	if err != nil {
+		return 0, err
+	}
+	size, err := strconv.ParseInt(out, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return int(size / 1048576), nil
+}
+
+// freeDiskSpace returns the space available to the current user on the
+// volume holding path, in MB.
+func freeDiskSpace(path string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return int64(uint64(st.Bavail) * uint64(st.Bsize) / 1048576), nil
+}
+
+// validateResources checks the requested memory and disk sizes against
+// what the host can actually provide. The disk of an ephemeral machine takes
+// memory, its RAM disk, instead of disk space.
+func (d *Driver) validateResources() error {
+	memory, err := hostMemory(d.commands())
+	if err != nil {
+		return err
+	}
+	if d.Memory >= memory {
+		return fmt.Errorf("--xhyve-memory-size %dMB must be lower than the %dMB of memory of this host", d.Memory, memory)
+	}
+	if d.Ephemeral {
+		ramDisk := d.DiskSize * (100 + ephemeralVolumeOverhead) / 100
+		if int64(d.Memory)+ramDisk >= int64(memory) {
+			return fmt.Errorf("--xhyve-memory-size %dMB and the %dMB RAM disk of the --xhyve-disk-size of the ephemeral machine must be lower than the %dMB of memory of this host",
+				d.Memory, ramDisk, memory)
+		}
+		return nil
+	}
+
+	// the --xhyve-disk-dir is created with the machine
+	volume := d.StorePath
+	if d.DiskDir != "" {
+		volume = filepath.Dir(d.DiskDir)
+	}
+	free, err := freeDiskSpace(volume)
+	if err != nil {
+		return err
+	}
+	if d.DiskSize > free {
+		return fmt.Errorf("--xhyve-disk-size %dMB exceeds the %dMB available on the volume of %s", d.DiskSize, free, volume)
+	}
+
+	return nil
+}
@@ -0,0 +1,259 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	// hypervisorEmbedded runs the xhyve code linked into the driver binary.
+	hypervisorEmbedded = "embedded"
+	// hypervisorHyperkit runs an external hyperkit binary, like the one
+	// shipped with Docker for Mac.
+	hypervisorHyperkit = "hyperkit"
+
+	defaultHypervisor = hypervisorEmbedded
+)
+
+// hyperkitSearchPaths are tried in order when --xhyve-hyperkit-path is not given.
+var hyperkitSearchPaths = []string{
+	"hyperkit",
+	"/Applications/Docker.app/Contents/Resources/bin/com.docker.hyperkit",
+	"/Applications/Docker.app/Contents/MacOS/com.docker.hyperkit",
+}
+
+var virtio9pArgRegexp = regexp.MustCompile(`^(\d+),virtio-9p,(host-\d+)=(.+)$`)
+
+// cpuYieldArgs are the xhyve arguments making the vCPUs exit to the host,
+// which can run something else, when the guest executes the instruction.
+var cpuYieldArgs = map[string]string{
+	"hlt":   "-H",
+	"pause": "-P",
+}
+
+// defaultCPUYield makes an idle guest yield its vCPUs to the host.
+var defaultCPUYield = []string{"hlt", "pause"}
+
+// parseCPUYield parses the --xhyve-cpu-yield value, a comma separated list
+// of instructions or "none".
+func parseCPUYield(s string) ([]string, error) {
+	if s == "none" {
+		return []string{}, nil
+	}
+	var yield []string
+	for _, insn := range strings.Split(s, ",") {
+		if _, ok := cpuYieldArgs[insn]; !ok {
+			return nil, fmt.Errorf("--xhyve-cpu-yield must be hlt, pause, hlt,pause or none, got %q", s)
+		}
+		yield = append(yield, insn)
+	}
+	return yield, nil
+}
+
+// backend runs the hypervisor process of a machine.
+type backend interface {
+	// command returns the command running the machine. args are the xhyve
+	// arguments generated by the driver, the first one being the "xhyve"
+	// placeholder expected by the embedded hypervisor.
+	command(d *Driver, args []string) (*exec.Cmd, error)
+	// macAddress returns the MAC address the guest gets on the shared network.
+	macAddress(d *Driver) (string, error)
+	// processName returns the (possibly truncated) executable name of the
+	// running hypervisor process.
+	processName(d *Driver) string
+	// version returns the version of the hypervisor.
+	version(d *Driver) (string, error)
+	// writesPidfile reports whether the hypervisor writes its own pidfile.
+	writesPidfile() bool
+}
+
+var backends = map[string]backend{
+	hypervisorEmbedded: embeddedBackend{},
+	hypervisorHyperkit: hyperkitBackend{},
+}
+
+func validateHypervisor(name string) error {
+	if _, ok := backends[name]; ok {
+		return nil
+	}
+	return fmt.Errorf("unknown hypervisor %q, must be one of %s", name, strings.Join(hypervisorNames(), ", "))
+}
+
+// backend returns the backend selected for the machine. Machines created
+// before the hypervisor was configurable use the embedded one.
+func (d *Driver) backend() backend {
+	if b, ok := backends[d.Hypervisor]; ok {
+		return b
+	}
+	return backends[defaultHypervisor]
+}
+
+// splitExtraArgs splits the --xhyve-extra-args values, like "-s 6,virtio-rnd",
+// into hypervisor arguments.
+func splitExtraArgs(values []string) ([]string, error) {
+	var args []string
+	for _, v := range values {
+		fields := strings.Fields(v)
+		if len(fields) == 0 {
+			continue
+		}
+		if !strings.HasPrefix(fields[0], "-") {
+			return nil, fmt.Errorf("--xhyve-extra-args %q must start with an option, like \"-s 6,virtio-rnd\"", v)
+		}
+		args = append(args, fields...)
+	}
+	return args, nil
+}
+
+// xhyveMACAddress asks an xhyve compatible hypervisor for the MAC address
+// vmnet derives from the machine UUID.
+func xhyveMACAddress(d *Driver, b backend) (string, error) {
+	args := append(d.xhyveArgs(), "-M")
+
+	cmd, err := b.command(d, args) // TODO: Should be possible without exec
+	if err != nil {
+		return "", err
+	}
+	out, err := d.commands().Output(cmd)
+	if err != nil {
+		return "", err
+	}
+
+	mac := bytes.TrimPrefix(out, []byte("MAC: "))
+	mac = bytes.TrimSpace(mac)
+
+	hw, err := net.ParseMAC(string(mac))
+	if err != nil {
+		return "", err
+	}
+	return hw.String(), nil
+}
+
+// embeddedBackend runs the xhyve code linked into the driver binary.
+// A locally built xhyve binary given with --xhyve-binary replaces it.
+type embeddedBackend struct{}
+
+func (embeddedBackend) command(d *Driver, args []string) (*exec.Cmd, error) {
+	if d.XhyveBinary != "" {
+		return exec.Command(d.XhyveBinary, args[1:]...), nil
+	}
+	if helper := d.helperBinary(); helper != "" {
+		return d.helperCommand(helper, args)
+	}
+	return exec.Command(d.driverBinary(), args...), nil
+}
+
+func (b embeddedBackend) macAddress(d *Driver) (string, error) {
+	return xhyveMACAddress(d, b)
+}
+
+func (embeddedBackend) processName(d *Driver) string {
+	if d.XhyveBinary != "" {
+		return filepath.Base(d.XhyveBinary)
+	}
+	// process name is truncated to 'docker-machine-d' or 'docker-machine-x'
+	return "docker-machine"
+}
+
+func (embeddedBackend) version(d *Driver) (string, error) {
+	if d.XhyveBinary != "" {
+		return d.binaryVersion(d.XhyveBinary)
+	}
+	return fmt.Sprintf("%s (embedded)", HypervisorVersion), nil
+}
+
+func (embeddedBackend) writesPidfile() bool { return true }
+
+// hyperkitBackend runs an external hyperkit binary.
+type hyperkitBackend struct{}
+
+func (hyperkitBackend) command(d *Driver, args []string) (*exec.Cmd, error) {
+	bin, err := d.hyperkitBinary()
+	if err != nil {
+		return nil, err
+	}
+	return exec.Command(bin, d.hyperkitArgs(args[1:])...), nil
+}
+
+func (b hyperkitBackend) macAddress(d *Driver) (string, error) {
+	return xhyveMACAddress(d, b)
+}
+
+func (hyperkitBackend) processName(d *Driver) string { return "hyperkit" }
+
+func (hyperkitBackend) version(d *Driver) (string, error) {
+	bin, err := d.hyperkitBinary()
+	if err != nil {
+		return "", err
+	}
+	return d.binaryVersion(bin)
+}
+
+func (hyperkitBackend) writesPidfile() bool { return true }
+
+// binaryVersion returns the version printed by "<bin> -v", which xhyve and
+// hyperkit write on the first line of stderr.
+func (d *Driver) binaryVersion(bin string) (string, error) {
+	out, _ := d.commands().CombinedOutput(exec.Command(bin, "-v"))
+	line := strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+	if line == "" {
+		return "", fmt.Errorf("could not get the version of %s", bin)
+	}
+	if i := strings.Index(line, ": "); i >= 0 {
+		line = line[i+2:]
+	}
+	return line, nil
+}
+
+// hyperkitBinary returns the path of the hyperkit binary to run.
+func (d *Driver) hyperkitBinary() (string, error) {
+	if d.HyperkitPath != "" {
+		return exec.LookPath(d.HyperkitPath)
+	}
+	for _, p := range hyperkitSearchPaths {
+		if path, err := exec.LookPath(p); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("hyperkit not found, install Docker for Mac or use --xhyve-hyperkit-path")
+}
+
+// hyperkitArgs translates the xhyve arguments into their hyperkit equivalents.
+func (d *Driver) hyperkitArgs(args []string) []string {
+	translated := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if i+1 < len(args) && (arg == "-l" || arg == "-s") {
+			translated = append(translated, arg, d.hyperkitDevice(args[i+1]))
+			i++
+			continue
+		}
+		translated = append(translated, arg)
+	}
+	return translated
+}
+
+func (d *Driver) hyperkitDevice(dev string) string {
+	switch {
+	case dev == "com1,autopty":
+		// hyperkit symlinks the pty so users can find it in the machine directory
+		return fmt.Sprintf("com1,autopty=%s", d.ResolveStorePath("tty"))
+	case dev == "com2,autopty":
+		// the console log copies the pty hyperkit links in the machine
+		// directory, see ConsoleLog
+		return fmt.Sprintf("com2,autopty=%s", d.hyperkitConsolePath())
+	case virtio9pArgRegexp.MatchString(dev):
+		m := virtio9pArgRegexp.FindStringSubmatch(dev)
+		return fmt.Sprintf("%s,virtio-9p,path=%s,tag=%s", m[1], filepath.Clean(m[3]), m[2])
+	}
+	return dev
+}
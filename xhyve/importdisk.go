@@ -0,0 +1,418 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// rawConverters convert the disk images of a format into raw images when
+// qemu-img is not installed.
+var rawConverters = map[string]func(src *os.File, dst *os.File) error{
+	diskFormatQcow2: qcow2ToRaw,
+	diskFormatVDI:   vdiToRaw,
+	diskFormatVMDK:  vmdkToRaw,
+}
+
+// validateImportDisk checks the --xhyve-import-disk is a disk image file.
+func validateImportDisk(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("Could not use the --xhyve-import-disk %s: %s", path, err)
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("Could not use the --xhyve-import-disk %s: not a disk image file", path)
+	}
+	_, err = diskImageFormat(path)
+	return err
+}
+
+// qemuImgBinary returns the qemu-img next to the driver binary, else the one
+// of the PATH, or "" when it is not installed.
+func (d *Driver) qemuImgBinary() string {
+	next := filepath.Join(filepath.Dir(d.driverBinary()), "qemu-img")
+	if _, err := os.Stat(next); err == nil {
+		return next
+	}
+	if path, err := exec.LookPath("qemu-img"); err == nil {
+		return path
+	}
+	return ""
+}
+
+// needsQemuImg is the error of the disk images only qemu-img converts.
+func needsQemuImg(path, reason string) error {
+	return fmt.Errorf("%s %s, converting it needs qemu-img, install it with \"brew install qemu\"", path, reason)
+}
+
+// importDisk converts the --xhyve-import-disk into the disk of the machine:
+// a qcow2 image with --xhyve-qcow2, else a raw image grown to the disk size.
+// qemu-img converts the images when it is installed, else the qcow2, VDI and
+// VMDK images are converted into raw images by the driver.
+func (d *Driver) importDisk() error {
+	format, err := diskImageFormat(d.ImportDisk)
+	if err != nil {
+		return err
+	}
+	target := diskFormatRaw
+	if d.Qcow2 {
+		target = diskFormatQcow2
+	}
+	log.Infof("Importing the %s image %s...", format, filepath.Base(d.ImportDisk))
+
+	qemuImg := d.qemuImgBinary()
+	switch {
+	case format == target:
+		if err := d.cloneFile(d.ImportDisk, d.diskFormatPaths()[target]); err != nil {
+			return err
+		}
+	case qemuImg != "":
+		dst := d.diskFormatPaths()[target]
+		if out, err := d.commands().CombinedOutput(exec.Command(qemuImg, "convert", "-O", target, d.ImportDisk, dst)); err != nil {
+			os.Remove(dst)
+			return fmt.Errorf("qemu-img convert %s failed: %s", d.ImportDisk, strings.TrimSpace(string(out)))
+		}
+	default:
+		convert, ok := rawConverters[format]
+		if !ok {
+			return needsQemuImg(d.ImportDisk, fmt.Sprintf("is a %s image", strings.ToUpper(format)))
+		}
+		if target != diskFormatRaw {
+			log.Infof("qemu-img is not installed, importing %s as a raw image", filepath.Base(d.ImportDisk))
+			target = diskFormatRaw
+		}
+		if err := convertToRaw(convert, d.ImportDisk, d.rawDiskPath()); err != nil {
+			return err
+		}
+	}
+	d.setDiskFormat(target)
+	if target != diskFormatRaw {
+		return nil
+	}
+
+	fi, err := os.Stat(d.rawDiskPath())
+	if err != nil {
+		return err
+	}
+	if fi.Size() > d.DiskSize*1048576 {
+		log.Warnf("The imported disk is larger than --xhyve-disk-size, keeping its %dMB", fi.Size()/1048576)
+		return nil
+	}
+	return os.Truncate(d.rawDiskPath(), d.DiskSize*1048576)
+}
+
+// convertToRaw writes the raw image dst of the disk image src with convert.
+func convertToRaw(convert func(src *os.File, dst *os.File) error, src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, privateFileMode)
+	if err != nil {
+		return err
+	}
+	if err := convert(in, out); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// copyBlock copies the n bytes at srcOff of src to dstOff of dst. The blocks
+// of zeros are not written, they stay holes of the sparse raw image.
+func copyBlock(src io.ReaderAt, srcOff int64, dst *os.File, dstOff, n int64) error {
+	buf := make([]byte, n)
+	if _, err := src.ReadAt(buf, srcOff); err != nil && err != io.EOF {
+		return err
+	}
+	if isZero(buf) {
+		return nil
+	}
+	_, err := dst.WriteAt(buf, dstOff)
+	return err
+}
+
+func isZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// qcow2OffsetMask masks the host offset of the qcow2 L1 and L2 entries.
+const qcow2OffsetMask = 0x00fffffffffffe00
+
+// qcow2ToRaw converts the qcow2 image src, which has no backing file,
+// encryption or compressed clusters.
+func qcow2ToRaw(src *os.File, dst *os.File) error {
+	h := make([]byte, 104)
+	if _, err := src.ReadAt(h, 0); err != nil && err != io.EOF {
+		return err
+	}
+	version := binary.BigEndian.Uint32(h[4:])
+	clusterBits := binary.BigEndian.Uint32(h[20:])
+	size := int64(binary.BigEndian.Uint64(h[24:]))
+	l1Size := int64(binary.BigEndian.Uint32(h[36:]))
+	l1Offset := int64(binary.BigEndian.Uint64(h[40:]))
+	switch {
+	case binary.BigEndian.Uint64(h[8:]) != 0:
+		return needsQemuImg(src.Name(), "has a backing file")
+	case binary.BigEndian.Uint32(h[32:]) != 0:
+		return needsQemuImg(src.Name(), "is encrypted")
+	case version >= 3 && binary.BigEndian.Uint64(h[72:])&^1 != 0:
+		// only the dirty bit of the lazy refcounts is supported
+		return needsQemuImg(src.Name(), "uses incompatible qcow2 features")
+	case clusterBits < 9 || clusterBits > 21:
+		return fmt.Errorf("%s is not a valid qcow2 image, its cluster bits are %d", src.Name(), clusterBits)
+	}
+	if err := dst.Truncate(size); err != nil {
+		return err
+	}
+
+	clusterSize := int64(1) << clusterBits
+	l2Entries := clusterSize / 8
+	l1 := make([]byte, l1Size*8)
+	if _, err := src.ReadAt(l1, l1Offset); err != nil {
+		return err
+	}
+	l2 := make([]byte, clusterSize)
+	for i := int64(0); i < l1Size; i++ {
+		l2Offset := int64(binary.BigEndian.Uint64(l1[i*8:]) & qcow2OffsetMask)
+		if l2Offset == 0 {
+			continue
+		}
+		if _, err := src.ReadAt(l2, l2Offset); err != nil {
+			return err
+		}
+		for j := int64(0); j < l2Entries; j++ {
+			entry := binary.BigEndian.Uint64(l2[j*8:])
+			guest := (i*l2Entries + j) * clusterSize
+			if guest >= size {
+				break
+			}
+			if entry&(1<<62) != 0 {
+				return needsQemuImg(src.Name(), "has compressed clusters")
+			}
+			offset := int64(entry & qcow2OffsetMask)
+			if offset == 0 || (version >= 3 && entry&1 != 0) {
+				continue
+			}
+			if err := copyBlock(src, offset, dst, guest, minInt64(clusterSize, size-guest)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// The VDI image types converted without qemu-img.
+const (
+	vdiTypeDynamic = 1
+	vdiTypeFixed   = 2
+)
+
+// vdiToRaw converts the dynamic or fixed VirtualBox image src.
+func vdiToRaw(src *os.File, dst *os.File) error {
+	h := make([]byte, 0x190)
+	if _, err := src.ReadAt(h, 0); err != nil {
+		return err
+	}
+	if major := binary.LittleEndian.Uint32(h[0x44:]) >> 16; major != 1 {
+		return needsQemuImg(src.Name(), fmt.Sprintf("is a VDI version %d image", major))
+	}
+	if t := binary.LittleEndian.Uint32(h[0x4c:]); t != vdiTypeDynamic && t != vdiTypeFixed {
+		return needsQemuImg(src.Name(), "is a differencing VDI image")
+	}
+	blocksOffset := int64(binary.LittleEndian.Uint32(h[0x154:]))
+	dataOffset := int64(binary.LittleEndian.Uint32(h[0x158:]))
+	size := int64(binary.LittleEndian.Uint64(h[0x170:]))
+	blockSize := int64(binary.LittleEndian.Uint32(h[0x178:]))
+	blockExtra := int64(binary.LittleEndian.Uint32(h[0x17c:]))
+	blocks := int64(binary.LittleEndian.Uint32(h[0x180:]))
+	if blockSize == 0 {
+		return fmt.Errorf("%s is not a valid VDI image, its block size is 0", src.Name())
+	}
+	if err := dst.Truncate(size); err != nil {
+		return err
+	}
+
+	blockMap := make([]byte, blocks*4)
+	if _, err := src.ReadAt(blockMap, blocksOffset); err != nil {
+		return err
+	}
+	for i := int64(0); i < blocks; i++ {
+		block := binary.LittleEndian.Uint32(blockMap[i*4:])
+		guest := i * blockSize
+		// the free and zero blocks are not allocated
+		if block >= 0xfffffffe || guest >= size {
+			continue
+		}
+		offset := dataOffset + int64(block)*(blockSize+blockExtra) + blockExtra
+		if err := copyBlock(src, offset, dst, guest, minInt64(blockSize, size-guest)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// vmdkSparseMagic starts the hosted sparse VMDK extents.
+var vmdkSparseMagic = []byte("KDMV")
+
+// vmdkExtentRegexp matches the extent lines of a VMDK descriptor: access,
+// size in sectors, type, file and offset in sectors.
+var vmdkExtentRegexp = regexp.MustCompile(`^(RW|RDONLY|NOACCESS)\s+(\d+)\s+(\w+)(?:\s+"([^"]+)"(?:\s+(\d+))?)?`)
+
+// vmdkToRaw converts the monolithic sparse VMDK image src, or the flat and
+// sparse extents of the VMDK descriptor src.
+func vmdkToRaw(src *os.File, dst *os.File) error {
+	magic := make([]byte, len(vmdkSparseMagic))
+	if _, err := src.ReadAt(magic, 0); err != nil {
+		return err
+	}
+	if bytes.Equal(magic, vmdkSparseMagic) {
+		return vmdkSparseExtent(src, dst, 0)
+	}
+
+	descriptor, err := ioutil.ReadAll(io.LimitReader(src, 1048576))
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(descriptor, []byte("parentFileNameHint")) {
+		return needsQemuImg(src.Name(), "is a differencing VMDK image")
+	}
+	var guest int64
+	for _, line := range strings.Split(string(descriptor), "\n") {
+		m := vmdkExtentRegexp.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		sectors, _ := strconv.ParseInt(m[2], 10, 64)
+		if err := vmdkExtent(src.Name(), m[3], m[4], m[5], dst, guest, sectors*512); err != nil {
+			return err
+		}
+		guest += sectors * 512
+	}
+	if guest == 0 {
+		return fmt.Errorf("%s is not a valid VMDK descriptor, it has no extents", src.Name())
+	}
+	return dst.Truncate(guest)
+}
+
+// vmdkExtent copies the extent of file and type of the descriptor, of size
+// bytes, to guest of dst.
+func vmdkExtent(descriptor, kind, file, offset string, dst *os.File, guest, size int64) error {
+	if kind == "ZERO" {
+		return nil
+	}
+	if file == "" {
+		return fmt.Errorf("%s is not a valid VMDK descriptor, a %s extent has no file", descriptor, kind)
+	}
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(filepath.Dir(descriptor), file)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	switch kind {
+	case "FLAT", "VMFS":
+		sectors, _ := strconv.ParseInt(offset, 10, 64)
+		const chunk = 1048576
+		for done := int64(0); done < size; done += chunk {
+			if err := copyBlock(f, sectors*512+done, dst, guest+done, minInt64(chunk, size-done)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "SPARSE":
+		return vmdkSparseExtent(f, dst, guest)
+	}
+	return needsQemuImg(descriptor, fmt.Sprintf("has %s extents", kind))
+}
+
+// vmdkSparseExtent copies the grains of the hosted sparse extent src to
+// guest of dst, growing dst to the end of the extent.
+func vmdkSparseExtent(src *os.File, dst *os.File, guest int64) error {
+	h := make([]byte, 512)
+	if _, err := src.ReadAt(h, 0); err != nil {
+		return err
+	}
+	if !bytes.Equal(h[:4], vmdkSparseMagic) {
+		return fmt.Errorf("%s is not a sparse VMDK extent", src.Name())
+	}
+	capacity := int64(binary.LittleEndian.Uint64(h[12:]))
+	grainSize := int64(binary.LittleEndian.Uint64(h[20:]))
+	gtEntries := int64(binary.LittleEndian.Uint32(h[44:]))
+	gdOffset := binary.LittleEndian.Uint64(h[56:])
+	if gdOffset == 0xffffffffffffffff || binary.LittleEndian.Uint16(h[77:]) != 0 {
+		return needsQemuImg(src.Name(), "is a stream optimized VMDK image")
+	}
+	if grainSize == 0 || gtEntries == 0 {
+		return fmt.Errorf("%s is not a valid sparse VMDK extent", src.Name())
+	}
+	if fi, err := dst.Stat(); err != nil {
+		return err
+	} else if fi.Size() < guest+capacity*512 {
+		if err := dst.Truncate(guest + capacity*512); err != nil {
+			return err
+		}
+	}
+
+	gtCoverage := gtEntries * grainSize
+	gd := make([]byte, (capacity+gtCoverage-1)/gtCoverage*4)
+	if _, err := src.ReadAt(gd, int64(gdOffset)*512); err != nil {
+		return err
+	}
+	gt := make([]byte, gtEntries*4)
+	for i := int64(0); i < int64(len(gd))/4; i++ {
+		gtOffset := int64(binary.LittleEndian.Uint32(gd[i*4:]))
+		if gtOffset == 0 {
+			continue
+		}
+		if _, err := src.ReadAt(gt, gtOffset*512); err != nil {
+			return err
+		}
+		for j := int64(0); j < gtEntries; j++ {
+			sector := (i*gtEntries + j) * grainSize
+			if sector >= capacity {
+				break
+			}
+			// 0 is an unallocated grain, 1 a zeroed one
+			grain := int64(binary.LittleEndian.Uint32(gt[j*4:]))
+			if grain <= 1 {
+				continue
+			}
+			if err := copyBlock(src, grain*512, dst, guest+sector*512, minInt64(grainSize, capacity-sector)*512); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
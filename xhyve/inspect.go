@@ -0,0 +1,68 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"syscall"
+)
+
+// runtimeDetails describe the machine as it runs, shown by
+// "docker-machine inspect". They are computed whenever the configuration is
+// saved and ignored when it is loaded.
+type runtimeDetails struct {
+	// Pid is the pid of the running hypervisor.
+	Pid int `json:",omitempty"`
+	// Hypervisor is the backend running the machine.
+	Hypervisor string
+	UUID       string
+	MACAddress string
+	// Devices are the devices attached to the machine, as given to the
+	// hypervisor.
+	Devices []string
+	// ConsoleLog and HypervisorLog are the paths of the guest console log
+	// and of the log of the hypervisor process.
+	ConsoleLog    string
+	HypervisorLog string
+}
+
+func (d *Driver) runtimeDetails() *runtimeDetails {
+	r := &runtimeDetails{
+		Hypervisor:    d.Hypervisor,
+		UUID:          d.UUID,
+		MACAddress:    d.MacAddr,
+		Devices:       d.devices(),
+		ConsoleLog:    d.consoleLogPath(),
+		HypervisorLog: d.hypervisorLogPath(),
+	}
+	if r.Hypervisor == "" {
+		r.Hypervisor = defaultHypervisor
+	}
+	if pid, err := d.GetPid(); err == nil && syscall.Kill(pid, 0) == nil {
+		r.Pid = pid
+	}
+	return r
+}
+
+// devices returns the devices of the hypervisor command line: the -s slots
+// of xhyve and hyperkit, the --device of vfkit.
+func (d *Driver) devices() []string {
+	flag, args := "-s", d.hypervisorArgs()
+	if d.Hypervisor == hypervisorVZ {
+		cmd, err := vzBackend{}.command(d, args)
+		if err != nil {
+			return nil
+		}
+		flag, args = "--device", cmd.Args
+	}
+
+	var devices []string
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == flag {
+			devices = append(devices, args[i+1])
+			i++
+		}
+	}
+	return devices
+}
@@ -0,0 +1,124 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+const kernelCacheMetadata = "kernel.json"
+
+// cachedKernel describes the boot files extracted from an ISO.
+type cachedKernel struct {
+	Vmlinuz string
+	Initrd  string
+	// BootCmd is the boot command parsed from the ISO, if any.
+	BootCmd string
+}
+
+// kernelCacheDir returns the directory of the boot files extracted from the
+// ISO with the SHA256 checksum sum. The preset is part of the key because it
+// decides which files are extracted.
+func (d *Driver) kernelCacheDir(sum string) string {
+	preset := d.ImagePreset
+	if _, ok := imagePresets[preset]; !ok {
+		preset = defaultImagePreset
+	}
+	return filepath.Join(d.StorePath, "cache", "kernels", sum+"-"+preset)
+}
+
+// loadCachedKernel links or copies the cached boot files of the ISO into the
+// machine directory. It reports whether they were found.
+func (d *Driver) loadCachedKernel(sum string) bool {
+	dir := d.kernelCacheDir(sum)
+	data, err := ioutil.ReadFile(filepath.Join(dir, kernelCacheMetadata))
+	if err != nil {
+		return false
+	}
+	var k cachedKernel
+	if err := json.Unmarshal(data, &k); err != nil {
+		return false
+	}
+
+	bootCmd := d.BootCmd
+	if bootCmd == "" {
+		bootCmd = d.preset().bootCmd
+	}
+	if bootCmd == "" {
+		bootCmd = k.BootCmd
+	}
+	if bootCmd == "" {
+		return false
+	}
+
+	for _, name := range []string{k.Vmlinuz, k.Initrd} {
+		if err := linkOrCopy(filepath.Join(dir, name), d.ResolveStorePath(name)); err != nil {
+			log.Debugf("Could not use the cached %s: %s", name, err)
+			return false
+		}
+	}
+
+	log.Infof("Using the kernel cached in %s", dir)
+	d.BootCmd = bootCmd
+	d.Vmlinuz, d.Initrd = k.Vmlinuz, k.Initrd
+	return true
+}
+
+// saveCachedKernel caches the boot files of the machine for the other
+// machines created from the same ISO.
+func (d *Driver) saveCachedKernel(sum, bootCmd string) error {
+	dir := d.kernelCacheDir(sum)
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+
+	tmp, err := ioutil.TempDir(filepath.Dir(dir), "tmp")
+	if os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(dir), 0700); err != nil {
+			return err
+		}
+		tmp, err = ioutil.TempDir(filepath.Dir(dir), "tmp")
+	}
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	for _, name := range []string{d.Vmlinuz, d.Initrd} {
+		if err := CopyFile(d.ResolveStorePath(name), filepath.Join(tmp, name)); err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(cachedKernel{d.Vmlinuz, d.Initrd, bootCmd})
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, kernelCacheMetadata), data, 0600); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, dir); err != nil {
+		// another machine may have cached the same kernel meanwhile
+		if _, statErr := os.Stat(dir); statErr == nil {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// linkOrCopy hard links src to dst, or copies it across volumes.
+func linkOrCopy(src, dst string) error {
+	os.Remove(dst)
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	return CopyFile(src, dst)
+}
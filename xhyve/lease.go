@@ -0,0 +1,83 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/zchee/docker-machine-driver-xhyve/vmnet"
+)
+
+// leaseMACRegexp matches the MAC addresses of the leases file, whose bytes
+// have no leading zero.
+var leaseMACRegexp = regexp.MustCompile(`^[0-9a-f]{1,2}(:[0-9a-f]{1,2}){5}$`)
+
+// RemoveLease removes the DHCP leases of the MAC address mac from the leases
+// file of the vmnet DHCP server. It needs root, the helper runs it for the
+// unprivileged driver.
+func RemoveLease(mac string) error {
+	if !leaseMACRegexp.MatchString(mac) {
+		return fmt.Errorf("Invalid MAC address %q", mac)
+	}
+	n, err := vmnet.RemoveLeasesByMACAddress(mac)
+	if err != nil {
+		return fmt.Errorf("Could not remove the DHCP lease of %s: %s", mac, err)
+	}
+	log.Debugf("Removed %d DHCP leases of %s", n, mac)
+	return nil
+}
+
+// removeLease frees the DHCP lease of the removed machine, so the lease pool
+// does not fill up with the leases of removed machines and their IP addresses
+// are given again. The lease of a machine with a --xhyve-deterministic-uuid
+// is kept for the machine created again, the fake lease of a fake machine
+// goes with its directory.
+func (d *Driver) removeLease() error {
+	if d.MacAddr == "" || d.DeterministicUUID || d.Hypervisor == hypervisorFake {
+		return nil
+	}
+	if os.Geteuid() == 0 {
+		return RemoveLease(d.MacAddr)
+	}
+	helper := d.helperBinary()
+	if helper == "" {
+		return fmt.Errorf("Removing DHCP leases needs root, install the %s helper or remove the entries of %s from %s by hand",
+			HelperName, d.MacAddr, vmnet.DHCPD_LEASES_FILE)
+	}
+	// the helper removes the lease of a machine of the user running it
+	config, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(helper, "remove-lease")
+	cmd.Stdin = bytes.NewReader(config)
+	if out, err := d.commands().CombinedOutput(cmd); err != nil {
+		return fmt.Errorf("%s remove-lease failed: %s %s", HelperName, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// removeLeases removes the DHCP leases of the MAC addresses macs, which
+// belong to no machine. It needs the setuid root driver, or sudo: the helper
+// only removes the lease of a machine of the user running it.
+func removeLeases(macs []string) error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("Removing the DHCP leases of removed machines needs root, run it with sudo or remove the entries of %s from %s by hand",
+			strings.Join(macs, ", "), vmnet.DHCPD_LEASES_FILE)
+	}
+	for _, mac := range macs {
+		if err := RemoveLease(mac); err != nil {
+			return err
+		}
+	}
+	return nil
+}
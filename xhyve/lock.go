@@ -0,0 +1,51 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+const (
+	// isoCacheLock serializes the updates of the global ISO cache.
+	isoCacheLock = "boot2docker.lock"
+	// hdiutilLock serializes the attachments of disk images.
+	hdiutilLock = "hdiutil.lock"
+)
+
+// lockFile takes an exclusive advisory lock on path, creating it if needed,
+// and returns the function releasing it. It blocks while another driver
+// process holds the lock.
+func lockFile(path string) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		log.Infof("Waiting for another driver process to release %s...", filepath.Base(path))
+		if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// lockCache locks the named lock of the machine store cache directory.
+func (d *Driver) lockCache(name string) (func(), error) {
+	return lockFile(filepath.Join(d.StorePath, "cache", name))
+}
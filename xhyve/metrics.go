@@ -0,0 +1,188 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/state"
+)
+
+const (
+	metricsPidFilename = "metrics.pid"
+	metricsLogFilename = "metrics.log"
+
+	defaultMetricsInterval = 60
+
+	// metricsPrefix prefixes the statsd metric names
+	metricsPrefix = "docker_machine_xhyve"
+)
+
+// metric is a sample of the machine, a JSON line of the metrics file.
+type metric struct {
+	Time          time.Time `json:"time"`
+	Machine       string    `json:"machine"`
+	CPUPercent    float64   `json:"cpu_percent"`
+	RSS           int64     `json:"rss_bytes"`
+	DiskImageSize int64     `json:"disk_image_bytes"`
+	UptimeSeconds int64     `json:"uptime_seconds"`
+}
+
+// validateMetrics checks the --xhyve-metrics value: a file path, or a
+// statsd://host:port UDP endpoint.
+func validateMetrics(metrics string) error {
+	if !strings.Contains(metrics, "://") {
+		return nil
+	}
+	u, err := url.Parse(metrics)
+	if err != nil || u.Scheme != "statsd" || u.Port() == "" {
+		return fmt.Errorf("--xhyve-metrics must be a file path or statsd://host:port, got %q", metrics)
+	}
+	return nil
+}
+
+// allocatedSize returns the disk space the file path, or the files of the
+// directory path, take: the raw disk images are sparse.
+func allocatedSize(path string) int64 {
+	var size int64
+	filepath.Walk(path, func(_ string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return nil
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			size += st.Blocks * 512
+		} else {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// sampleMetric samples the running hypervisor process pid.
+func (d *Driver) sampleMetric(pid int) (*metric, error) {
+	cpu, rss, err := d.sampleProcess(pid)
+	if err != nil {
+		return nil, err
+	}
+	m := &metric{
+		Time:          time.Now().UTC(),
+		Machine:       d.MachineName,
+		CPUPercent:    cpu,
+		RSS:           rss,
+		DiskImageSize: allocatedSize(d.diskImagePath()),
+	}
+	if fi, err := os.Stat(d.pidfilePath()); err == nil {
+		m.UptimeSeconds = int64(time.Since(fi.ModTime()) / time.Second)
+	}
+	return m, nil
+}
+
+// statsdLines returns the metric as statsd gauges.
+func (m *metric) statsdLines() []byte {
+	var b bytes.Buffer
+	name := metricsPrefix + "." + strings.Replace(m.Machine, ".", "_", -1)
+	fmt.Fprintf(&b, "%s.cpu_percent:%g|g\n", name, m.CPUPercent)
+	fmt.Fprintf(&b, "%s.rss_bytes:%d|g\n", name, m.RSS)
+	fmt.Fprintf(&b, "%s.disk_image_bytes:%d|g\n", name, m.DiskImageSize)
+	fmt.Fprintf(&b, "%s.uptime_seconds:%d|g\n", name, m.UptimeSeconds)
+	return b.Bytes()
+}
+
+// writeMetric appends the metric to the metrics file as a JSON line, or
+// sends it to the statsd endpoint.
+func (d *Driver) writeMetric(m *metric) error {
+	if strings.HasPrefix(d.Metrics, "statsd://") {
+		u, _ := url.Parse(d.Metrics)
+		conn, err := net.Dial("udp", u.Host)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, err = conn.Write(m.statsdLines())
+		return err
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(d.Metrics, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// emitMetrics samples the machine every MetricsInterval seconds. It returns
+// when the machine stops, or when stop is closed, but in the supervisor.
+func (d *Driver) emitMetrics(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(d.MetricsInterval) * time.Second)
+	defer ticker.Stop()
+
+	started := time.Now()
+	running := false
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		s, err := d.processState()
+		if err != nil || (s != state.Running && s != state.Paused) {
+			// the hypervisor may not have written its pidfile yet, or is
+			// restarted by the supervisor
+			if d.Supervise {
+				continue
+			}
+			if running || time.Since(started) > time.Duration(d.BootTimeout)*time.Second {
+				return
+			}
+			continue
+		}
+		running = true
+
+		pid, err := d.GetPid()
+		if err != nil {
+			continue
+		}
+		m, err := d.sampleMetric(pid)
+		if err == nil {
+			err = d.writeMetric(m)
+		}
+		if err != nil {
+			log.Debugf("Could not emit the metrics of %s: %s", d.MachineName, err)
+		}
+	}
+}
+
+// metricsTask emits the metrics of the machine, in place of the one of the
+// previous start.
+var metricsTask = &backgroundTask{
+	command:     "metrics",
+	name:        "metrics",
+	pidFilename: metricsPidFilename,
+	logFilename: metricsLogFilename,
+	enabled:     func(d *Driver) bool { return d.Metrics != "" },
+	supervised:  true,
+	replace:     true,
+	run: func(d *Driver) error {
+		d.emitMetrics(nil)
+		return nil
+	},
+}
@@ -0,0 +1,108 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// configMigrations upgrade the saved driver configuration of a machine.
+// configMigrations[i] upgrades version i to version i+1, machines saved
+// before the configuration was versioned are version 0.
+var configMigrations = []func(d *Driver){
+	migrateUnversionedConfig,
+	migrateClockSync,
+	migrateCPUYield,
+}
+
+// configVersion is the version of the driver configuration of this driver.
+var configVersion = len(configMigrations)
+
+// migrateUnversionedConfig fills in the fields added before the configuration
+// was versioned with the behavior those machines already had.
+func migrateUnversionedConfig(d *Driver) {
+	if d.Hypervisor == "" {
+		d.Hypervisor = defaultHypervisor
+	}
+	if d.ImagePreset == "" {
+		d.ImagePreset = defaultImagePreset
+	}
+	if d.OrphanPolicy == "" {
+		d.OrphanPolicy = defaultOrphanPolicy
+	}
+	if d.BootTimeout < 1 {
+		d.BootTimeout = defaultBootTimeout
+	}
+	if d.IPPollInterval < 1 {
+		d.IPPollInterval = defaultIPPollInterval
+	}
+	// --xhyve-boot-kernel and --xhyve-boot-initrd are deprecated
+	if d.VmlinuzPath == "" {
+		d.VmlinuzPath, d.BootKernel = d.BootKernel, ""
+	}
+	if d.InitrdPath == "" {
+		d.InitrdPath, d.BootInitrd = d.BootInitrd, ""
+	}
+	if d.BaseDriver != nil {
+		if d.SSHUser == "" {
+			d.SSHUser = d.preset().sshUser
+		}
+		if d.SSHPort == 0 {
+			d.SSHPort = defaultSSHPort
+		}
+		if d.MachineName != "" && d.StorePath != "" {
+			d.ArtifactName = d.artifactName()
+		}
+	}
+}
+
+// migrateClockSync keeps the machines created before
+// --xhyve-clock-sync-interval without clock sync, which runs "sudo date" in
+// their guest at every interval. They get it when created again.
+func migrateClockSync(d *Driver) {
+	d.ClockSyncInterval = 0
+}
+
+// migrateCPUYield keeps the idle machines created before --xhyve-cpu-yield
+// from burning a host core.
+func migrateCPUYield(d *Driver) {
+	d.CPUYield = defaultCPUYield
+}
+
+// migrateConfig upgrades the driver configuration to configVersion.
+func (d *Driver) migrateConfig() error {
+	if d.ConfigVersion > configVersion {
+		return fmt.Errorf("The configuration of %s is version %d, this driver only knows up to version %d. Please upgrade docker-machine-driver-xhyve",
+			d.MachineName, d.ConfigVersion, configVersion)
+	}
+	for ; d.ConfigVersion < configVersion; d.ConfigVersion++ {
+		log.Debugf("Migrating the configuration of %s from version %d", d.MachineName, d.ConfigVersion)
+		configMigrations[d.ConfigVersion](d)
+	}
+	return nil
+}
+
+// UnmarshalJSON reads a saved driver configuration, or the one minikube
+// gives, and migrates it to the current version.
+func (d *Driver) UnmarshalJSON(data []byte) error {
+	data, minikube, err := fromMinikubeConfig(data)
+	if err != nil {
+		return err
+	}
+	if minikube {
+		log.Debugf("Reading a driver configuration written by minikube")
+	}
+	type config Driver
+	if err := json.Unmarshal(data, (*config)(d)); err != nil {
+		return err
+	}
+	if err := d.migrateConfig(); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import "encoding/json"
+
+// minikubeConfig is the part of the driver configuration minikube writes
+// which differs from the one of this driver: the 9p share is a single
+// folder, enabled by a boolean.
+type minikubeConfig struct {
+	Virtio9p       bool
+	Virtio9pFolder string
+}
+
+// fromMinikubeConfig translates the driver configuration data written by
+// minikube, whose Virtio9p is a boolean, into the configuration of a
+// minikube preset machine. Other configurations are returned as they are.
+func fromMinikubeConfig(data []byte) ([]byte, bool, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return data, false, nil
+	}
+	if v := string(fields["Virtio9p"]); v != "true" && v != "false" {
+		return data, false, nil
+	}
+
+	var mk minikubeConfig
+	if err := json.Unmarshal(data, &mk); err != nil {
+		return nil, false, err
+	}
+	var shares []string
+	if mk.Virtio9p && mk.Virtio9pFolder != "" {
+		shares = []string{mk.Virtio9pFolder}
+	}
+	var err error
+	if fields["Virtio9p"], err = json.Marshal(shares); err != nil {
+		return nil, false, err
+	}
+	if _, ok := fields["ImagePreset"]; !ok {
+		fields["ImagePreset"], _ = json.Marshal(presetMinikube)
+	}
+	if _, ok := fields["Virtio9pRoot"]; !ok {
+		fields["Virtio9pRoot"], _ = json.Marshal(imagePresets[presetMinikube].virtio9pRoot)
+	}
+	data, err = json.Marshal(fields)
+	return data, true, err
+}
@@ -0,0 +1,238 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/log"
+)
+
+// nodeBaseReadyFilename marks the base of the nodes as complete, a base left
+// by an interrupted creation is made again.
+const nodeBaseReadyFilename = "base-ready"
+
+// nodePrefixRegexp matches the node prefixes making the machine names
+// docker-machine accepts.
+var nodePrefixRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9.-]*$`)
+
+// baseFiles are the boot files a node clones from the base of its nodes.
+var baseFiles = []string{isoFilename, cloudKernelFilename, cloudInitrdFilename, cloudImageFilename}
+
+// nodeName returns the name of the node index of prefix, counted from 1.
+func nodeName(prefix string, index int) string {
+	return fmt.Sprintf("%s-%d", prefix, index)
+}
+
+// nodeBaseName returns the name of the hidden machine directory holding the
+// base of the nodes of prefix, which docker-machine does not list.
+func nodeBaseName(prefix string) string {
+	return "." + prefix + "-base"
+}
+
+// CreateNodes creates the machines <prefix>-1 to <prefix>-<count> of the
+// docker-machine store storePath, for swarm clusters and test fleets. Each
+// node is created in parallel by "docker-machine create -d xhyve" with the
+// create flags createArgs, so that docker-machine provisions and lists it
+// like any other machine. It writes the result of each node to w, and
+// returns an error when a node failed.
+//
+// The nodes share a base, see --xhyve-node-base, which is removed once they
+// are created.
+func CreateNodes(storePath, prefix string, count int, createArgs []string, w io.Writer) error {
+	return createNodes(execRunner{}, storePath, prefix, count, createArgs, w)
+}
+
+func createNodes(r CommandRunner, storePath, prefix string, count int, createArgs []string, w io.Writer) error {
+	if count < 1 {
+		return fmt.Errorf("The count of nodes must be positive, got %d", count)
+	}
+	if err := validateNodePrefix(prefix); err != nil {
+		return err
+	}
+	for i := 1; i <= count; i++ {
+		name := nodeName(prefix, i)
+		if _, err := os.Stat(filepath.Join(storePath, "machines", name)); err == nil {
+			return fmt.Errorf("Machine %s already exists", name)
+		}
+	}
+	defer os.RemoveAll(filepath.Join(storePath, "machines", nodeBaseName(prefix)))
+
+	fmt.Fprintf(w, "Creating %d nodes %s to %s...\n", count, nodeName(prefix, 1), nodeName(prefix, count))
+	var (
+		mu     sync.Mutex
+		failed []string
+		wg     sync.WaitGroup
+	)
+	for i := 1; i <= count; i++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			args := append([]string{"--storage-path", storePath, "create", "-d", "xhyve"}, createArgs...)
+			args = append(args, "--xhyve-node-base", prefix, name)
+			out, err := r.CombinedOutput(exec.Command("docker-machine", args...))
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				fmt.Fprintf(w, "Could not create %s: %s\n%s\n", name, err, strings.TrimSpace(string(out)))
+				failed = append(failed, name)
+				return
+			}
+			fmt.Fprintf(w, "Created %s\n", name)
+		}(nodeName(prefix, i))
+	}
+	wg.Wait()
+
+	if len(failed) > 0 {
+		return fmt.Errorf("Could not create %d of the %d nodes: %s", len(failed), count, strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// validateNodePrefix checks the nodes of prefix get valid machine names.
+func validateNodePrefix(prefix string) error {
+	if !nodePrefixRegexp.MatchString(prefix) {
+		return fmt.Errorf("Invalid node prefix %q, it has to start with a letter or a digit and contain only letters, digits, dots and dashes", prefix)
+	}
+	return nil
+}
+
+// nodeBase returns the base of the nodes of d.NodeBase. The first node to
+// need it fetches its boot files and generates its disk image, the other
+// nodes wait for it and find it ready.
+func (d *Driver) nodeBase() (*Driver, error) {
+	unlock, err := d.lockCache(nodeBaseName(d.NodeBase) + ".lock")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	base, err := d.nodeBaseDriver()
+	if err != nil {
+		return nil, err
+	}
+	dir := base.ResolveStorePath(".")
+	if _, err := os.Stat(base.ResolveStorePath(nodeBaseReadyFilename)); err == nil {
+		return base, nil
+	}
+	os.RemoveAll(dir)
+
+	log.Infof("Creating the base of the nodes %s...", d.NodeBase)
+	if err := base.createDownload(); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	if d.sharesBaseDisk() {
+		if err := base.generateBaseDisk(); err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+	}
+	if err := ioutil.WriteFile(base.ResolveStorePath(nodeBaseReadyFilename), nil, 0600); err != nil {
+		return nil, err
+	}
+	return base, nil
+}
+
+// nodeBaseDriver returns the driver of the base of the nodes of d, a copy
+// of the configuration of d in the hidden machine directory of the base.
+// The base is not a template, nor has a disk directory of its own.
+func (d *Driver) nodeBaseDriver() (*Driver, error) {
+	config, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	base := NewDriver("", "")
+	if err := json.Unmarshal(config, base); err != nil {
+		return nil, err
+	}
+	base.BaseDriver = &drivers.BaseDriver{
+		MachineName: nodeBaseName(d.NodeBase),
+		StorePath:   d.StorePath,
+	}
+	base.NodeBase = ""
+	base.Template = ""
+	base.DiskDir = ""
+	base.Ephemeral = false
+	base.runner = d.runner
+	return base, nil
+}
+
+// cloneBase clones the boot files of the base of the nodes into the
+// machine directory, instead of fetching them again.
+func (d *Driver) cloneBase() error {
+	base, err := d.nodeBase()
+	if err != nil {
+		return err
+	}
+	log.Infof("Cloning the boot files of %s...", d.MachineName)
+	for _, name := range baseFiles {
+		src := base.ResolveStorePath(name)
+		if _, err := os.Stat(src); err != nil {
+			continue
+		}
+		if err := d.cloneFile(src, d.ResolveStorePath(name)); err != nil {
+			return err
+		}
+	}
+	if d.preset().cloudImage {
+		d.Vmlinuz = cloudKernelFilename
+		d.Initrd = cloudInitrdFilename
+	}
+	return nil
+}
+
+// sharesBaseDisk reports whether the node clones the empty disk image of the
+// base of its nodes. The disk of a cloud image is cloned with the boot
+// files, the qcow2 disks and the encrypted disks are created per node.
+func (d *Driver) sharesBaseDisk() bool {
+	return !d.preset().cloudImage && !d.Qcow2 && !d.EncryptDisk
+}
+
+// generateBaseDisk generates the empty raw or sparsebundle disk image the
+// nodes clone.
+func (d *Driver) generateBaseDisk() error {
+	log.Infof("Generating the %dMB base disk image of the nodes...", d.DiskSize)
+	defer watchPath("Generating the base disk image", d.diskImagePath(), -1)()
+	if d.RawDisk {
+		return createRawDisk(d.rawDiskPath(), d.DiskSize)
+	}
+	return d.hdiutil("create", "-megabytes", fmt.Sprintf("%d", d.DiskSize), "-type", "SPARSEBUNDLE", d.diskFilePath(rootVolumeName))
+}
+
+// cloneBaseDisk clones the disk image of the base of the nodes into the disk
+// of the node, and writes the userdata.tar with its SSH key at its start.
+// The clone only takes the space of the blocks the node writes.
+func (d *Driver) cloneBaseDisk() error {
+	base, err := d.nodeBase()
+	if err != nil {
+		return err
+	}
+	log.Infof("Cloning the base disk image of %s...", d.MachineName)
+	if d.RawDisk {
+		if err := d.cloneFile(base.rawDiskPath(), d.rawDiskPath()); err != nil {
+			return err
+		}
+		return d.writeKeyBundle(d.rawDiskPath())
+	}
+	if err := d.cloneFile(base.sparseBundlePath(), d.sparseBundlePath()); err != nil {
+		return err
+	}
+	if err := d.attachDiskImage(); err != nil {
+		return err
+	}
+	return d.writeKeyBundle(fmt.Sprintf("/dev/rdisk%d", d.DiskNumber))
+}
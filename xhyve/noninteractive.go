@@ -0,0 +1,47 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+)
+
+// ciError is the single line JSON error reported in non-interactive mode.
+type ciError struct {
+	Driver  string `json:"driver"`
+	Op      string `json:"op"`
+	Machine string `json:"machine"`
+	Error   string `json:"error"`
+}
+
+// machineReadable emits the event of the end of op and replaces
+// *err by its single line JSON form in non-interactive mode, so CI jobs can
+// parse the failures of op.
+func (d *Driver) machineReadable(op string, err *error) {
+	d.endEvent(op, "", *err)
+	if !d.NonInteractive || *err == nil {
+		return
+	}
+	data, jsonErr := json.Marshal(ciError{d.DriverName(), op, d.MachineName, (*err).Error()})
+	if jsonErr != nil {
+		return
+	}
+	*err = errors.New(string(data))
+}
+
+// checkNonInteractiveSudo fails fast in non-interactive mode when the NFS
+// shares would make sudo prompt for a password.
+func (d *Driver) checkNonInteractiveSudo() error {
+	if !d.NonInteractive || len(d.NFSShares) == 0 {
+		return nil
+	}
+	if err := runCommand(d.commands(), exec.Command("sudo", "-n", "true")); err != nil {
+		return fmt.Errorf("--xhyve-experimental-nfs-share needs sudo without password in non-interactive mode, allow it with NOPASSWD in sudoers")
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+const (
+	// orphanAdopt records a running hypervisor of the machine in its pidfile.
+	orphanAdopt = "adopt"
+	// orphanKill terminates a running hypervisor of the machine.
+	orphanKill = "kill"
+	// orphanIgnore leaves a running hypervisor of the machine alone.
+	orphanIgnore = "ignore"
+
+	defaultOrphanPolicy = orphanAdopt
+)
+
+// process is a running process and its command line.
+type process struct {
+	pid     int
+	command string
+}
+
+// listProcesses returns the processes of the host.
+func listProcesses(r CommandRunner) ([]process, error) {
+	out, err := r.Output(exec.Command("ps", "-axww", "-o", "pid=,command="))
+	if err != nil {
+		return nil, fmt.Errorf("ps failed: %s", err)
+	}
+	return parsePs(string(out)), nil
+}
+
+// parsePs parses the output of "ps -o pid=,command=".
+func parsePs(out string) []process {
+	var procs []process
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.SplitN(strings.TrimSpace(line), " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		pid, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		procs = append(procs, process{pid, strings.TrimSpace(fields[1])})
+	}
+	return procs
+}
+
+func validateOrphanPolicy(policy string) error {
+	switch policy {
+	case orphanAdopt, orphanKill, orphanIgnore:
+		return nil
+	}
+	return fmt.Errorf("unknown orphan policy %q, must be one of %s, %s, %s", policy, orphanAdopt, orphanIgnore, orphanKill)
+}
+
+// isMachineProcess reports whether the command line runs the hypervisor of
+// the machine, by its UUID or by the files of its machine directory.
+func (d *Driver) isMachineProcess(command string) bool {
+	if !strings.Contains(command, d.backend().processName(d)) {
+		return false
+	}
+	if d.UUID != "" && strings.Contains(command, "-U "+d.UUID) {
+		return true
+	}
+	return strings.Contains(command, d.ResolveStorePath(".")+"/")
+}
+
+// findOrphan returns the pid of a running hypervisor of the machine which is
+// not recorded in its pidfile, or 0.
+func (d *Driver) findOrphan() int {
+	procs, err := listProcesses(d.commands())
+	if err != nil {
+		log.Debugf("Could not look for orphaned hypervisors: %s", err)
+		return 0
+	}
+	for _, p := range procs {
+		if d.isMachineProcess(p.command) {
+			return p.pid
+		}
+	}
+	return 0
+}
+
+// handleOrphan applies the orphan policy of the machine to a hypervisor
+// running without pidfile. It reports whether the machine is running.
+func (d *Driver) handleOrphan() bool {
+	if d.OrphanPolicy == orphanIgnore {
+		return false
+	}
+	pid := d.findOrphan()
+	if pid == 0 {
+		return false
+	}
+
+	if d.OrphanPolicy == orphanKill {
+		log.Warnf("Killing the orphaned hypervisor of %s (pid %d)", d.MachineName, pid)
+		if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+			log.Warnf("Could not kill pid %d: %s", pid, err)
+		}
+		return false
+	}
+
+	log.Infof("Adopting the running hypervisor of %s (pid %d)", d.MachineName, pid)
+	if err := ioutil.WriteFile(d.pidfilePath(), []byte(strconv.Itoa(pid)), 0644); err != nil {
+		log.Warnf("Could not record pid %d: %s", pid, err)
+		return false
+	}
+	return true
+}
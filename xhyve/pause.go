@@ -0,0 +1,81 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/state"
+)
+
+// isProcessStopped reports whether the process pid was stopped by a signal,
+// which ps shows with a state starting with "T".
+func (d *Driver) isProcessStopped(pid int) bool {
+	out, err := d.commands().Output(exec.Command("ps", "-o", "state=", "-p", fmt.Sprintf("%d", pid)))
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(strings.TrimSpace(string(out)), "T")
+}
+
+// Pause freezes the running machine by stopping its hypervisor process. The
+// guest memory, and so the containers, are kept until Resume.
+func (d *Driver) Pause() error {
+	s, err := d.processState()
+	if err != nil {
+		return err
+	}
+	if s != state.Running {
+		return fmt.Errorf("%s is not running", d.MachineName)
+	}
+
+	log.Infof("Pausing %s...", d.MachineName)
+	return d.SendSignal(syscall.SIGSTOP)
+}
+
+// Resume continues the paused machine and resyncs its clock, frozen while it
+// was paused.
+func (d *Driver) Resume() error {
+	s, err := d.processState()
+	if err != nil {
+		return err
+	}
+	if s != state.Paused {
+		return fmt.Errorf("%s is not paused", d.MachineName)
+	}
+
+	log.Infof("Resuming %s...", d.MachineName)
+	if err := d.SendSignal(syscall.SIGCONT); err != nil {
+		return err
+	}
+
+	if err := d.syncClock(); err != nil {
+		log.Warnf("Could not sync the clock of %s: %s", d.MachineName, err)
+	}
+	return nil
+}
+
+// PauseMachine pauses the machine name of the docker-machine store storePath.
+func PauseMachine(storePath, name string) error {
+	d, err := loadHostDriver(filepath.Join(storePath, "machines", name))
+	if err != nil {
+		return err
+	}
+	return d.Pause()
+}
+
+// ResumeMachine resumes the machine name of the docker-machine store storePath.
+func ResumeMachine(storePath, name string) error {
+	d, err := loadHostDriver(filepath.Join(storePath, "machines", name))
+	if err != nil {
+		return err
+	}
+	return d.Resume()
+}
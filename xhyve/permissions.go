@@ -0,0 +1,92 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+)
+
+const (
+	// privateFileMode is the mode of the keys, logs and disk images the
+	// driver writes, only their owner reads them
+	privateFileMode = 0600
+
+	// privateDirMode is the mode of the machine directories
+	privateDirMode = 0700
+
+	// keyModeMask are the mode bits an existing private key must not have,
+	// like ssh refuses the keys the other users can read
+	keyModeMask = 0077
+
+	// userdataModeMask are the mode bits an existing userdata file must not
+	// have: it is not readable nor writable by all users
+	userdataModeMask = 0006
+
+	// scriptModeMask are the mode bits an existing boot script must not
+	// have: the other users could change what root runs in the guest
+	scriptModeMask = 0022
+)
+
+// checkPrivateFile checks the existing file path, a key or a userdata file
+// the driver is given, belongs to the user running the driver, or to root,
+// and has none of the mode bits of mask.
+func checkPrivateFile(path, what string, mask os.FileMode) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Getuid() && st.Uid != 0 {
+		return fmt.Errorf("The %s %s belongs to the user %d, not to the user running the driver", what, path, st.Uid)
+	}
+	if perm := fi.Mode().Perm(); perm&mask != 0 {
+		return fmt.Errorf("The %s %s is accessible by other users (mode %#o), run \"chmod %#o %s\"", what, path, perm, perm&^mask, path)
+	}
+	return nil
+}
+
+// checkSSHKey checks the private SSH key of the machine, when it has one,
+// before the machine is started and docker-machine connects with it.
+func (d *Driver) checkSSHKey() error {
+	path := d.privateSSHKeyPath()
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	return checkPrivateFile(path, "SSH key", keyModeMask)
+}
+
+// writePrivateFile writes data to path with the privateFileMode, also when
+// path already exists with another mode.
+func writePrivateFile(path string, data []byte) error {
+	if err := ioutil.WriteFile(path, data, privateFileMode); err != nil {
+		return err
+	}
+	return os.Chmod(path, privateFileMode)
+}
+
+// openPrivateLog opens the log path for appending with the privateFileMode:
+// the console and hypervisor logs show the boot of the guest, with its
+// secrets. An existing log has to belong to the user running the driver, or
+// to root, and its mode is only fixed when it belongs to that user.
+func openPrivateLog(path string) (*os.File, error) {
+	if _, err := os.Stat(path); err == nil {
+		if err := checkPrivateFile(path, "log", 0); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, privateFileMode)
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := f.Stat(); err == nil {
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Uid) == os.Getuid() {
+			// the log is written all the same when its mode is not fixed
+			f.Chmod(privateFileMode)
+		}
+	}
+	return f, nil
+}
@@ -0,0 +1,305 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+const (
+	presetBoot2Docker = "boot2docker"
+	presetRancherOS   = "rancheros"
+	presetCoreOS      = "coreos"
+	presetCloudInit   = "cloud-init"
+	presetMinikube    = "minikube"
+
+	defaultImagePreset = presetBoot2Docker
+
+	seedISOFilename = "seed.iso"
+)
+
+// imagePreset describes how to boot and provision a guest OS image.
+type imagePreset struct {
+	// bootCmd is the kernel command line used when --xhyve-boot-cmd is not
+	// given. When empty, it is parsed from the isolinux.cfg of the ISO.
+	// It is expanded as a bootCmdData template.
+	bootCmd string
+	// dataLabel is the label of the filesystem keeping the guest state.
+	dataLabel string
+	// sshUser is the user the SSH key is installed for.
+	sshUser string
+	// seed writes the ISO carrying the guest configuration, if the image
+	// does not read it from the boot2docker userdata.tar.
+	seed func(d *Driver) error
+	// kernel and initrd match the paths of the boot files inside the ISO.
+	kernel, initrd *regexp.Regexp
+	// leaseByHostname is set when the DHCP client of the guest does not
+	// identify itself with its MAC address, so its lease is looked up by
+	// machine name.
+	leaseByHostname bool
+	// cloudImage is set when the machine boots a cloud disk image with an
+	// external kernel and initrd instead of an ISO.
+	cloudImage bool
+	// startsDocker is set when the image starts the docker daemon on the
+	// docker port at boot, before docker-machine provisions it.
+	startsDocker bool
+	// virtio9pRoot is the guest directory the 9p shares are mounted in when
+	// --xhyve-virtio-9p-root is not given.
+	virtio9pRoot string
+}
+
+var imagePresets = map[string]*imagePreset{
+	presetBoot2Docker: {
+		sshUser:      "docker",
+		dataLabel:    "boot2docker-data",
+		kernel:       kernelRegexp,
+		initrd:       initrdRegexp,
+		startsDocker: true,
+	},
+	presetRancherOS: {
+		bootCmd: "rancher.autologin=ttyS0 rancher.state.dev=LABEL={{.DataLabel}} rancher.state.autoformat=[/dev/sda,/dev/vda] rancher.state.wait " +
+			"rancher.cloud_init.datasources=[configdrive:/media/config-2] console=ttyS0",
+		sshUser:   "rancher",
+		dataLabel: "RANCHER_STATE",
+		seed:      (*Driver).generateCloudConfigDrive,
+		kernel:    kernelRegexp,
+		initrd:    initrdRegexp,
+	},
+	presetCoreOS: {
+		bootCmd:         "coreos.first_boot=1 coreos.oem.id=openstack coreos.autologin=ttyS0 console=ttyS0",
+		sshUser:         "core",
+		seed:            (*Driver).generateIgnitionConfigDrive,
+		kernel:          regexp.MustCompile(`/coreos/vmlinuz$`),
+		initrd:          regexp.MustCompile(`/coreos/cpio\.gz$`),
+		leaseByHostname: true,
+	},
+	presetCloudInit: {
+		bootCmd:         "root=/dev/vda1 ro console=ttyS0",
+		sshUser:         "docker",
+		seed:            (*Driver).generateNoCloudSeed,
+		leaseByHostname: true,
+		cloudImage:      true,
+	},
+	// the minikube ISO, booted like the minikube xhyve driver does
+	presetMinikube: {
+		bootCmd: "loglevel=3 user=docker console=ttyS0 console=tty0 noembed nomodeset norestore waitusb=10 " +
+			"systemd.legacy_systemd_cgroup_controller=yes base host={{.Hostname}}",
+		sshUser:      "docker",
+		dataLabel:    "boot2docker-data",
+		kernel:       regexp.MustCompile(`/boot/bzimage$`),
+		initrd:       regexp.MustCompile(`/boot/initrd$`),
+		startsDocker: true,
+		virtio9pRoot: "/",
+	},
+}
+
+func validateImagePreset(name string) error {
+	if _, ok := imagePresets[name]; ok {
+		return nil
+	}
+	return fmt.Errorf("unknown image preset %q, must be one of %s", name, strings.Join(imagePresetNames(), ", "))
+}
+
+// preset returns the image preset of the machine. Machines created before
+// presets existed are boot2docker machines.
+func (d *Driver) preset() *imagePreset {
+	if p, ok := imagePresets[d.ImagePreset]; ok {
+		return p
+	}
+	return imagePresets[defaultImagePreset]
+}
+
+// bootCmdData is the data the boot commands are expanded with.
+type bootCmdData struct {
+	MachineName string
+	Hostname    string
+	DataLabel   string
+}
+
+// hostnameRegexp matches the RFC 1123 hostnames.
+var hostnameRegexp = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$`)
+
+// hostname returns the hostname of the guest, the machine name unless
+// --xhyve-hostname is given.
+func (d *Driver) hostname() string {
+	if d.Hostname != "" {
+		return d.Hostname
+	}
+	return d.MachineName
+}
+
+// isolinuxHostRegexp matches the hostname option of the boot2docker boot command.
+var isolinuxHostRegexp = regexp.MustCompile(`\bhost=\S+`)
+
+// expandBootCmd expands the bootCmdData template cmd for the machine.
+func (d *Driver) expandBootCmd(cmd string) (string, error) {
+	tmpl, err := template.New("boot-cmd").Parse(cmd)
+	if err != nil {
+		return "", fmt.Errorf("Invalid boot command %q: %s", cmd, err)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, bootCmdData{d.MachineName, d.hostname(), d.preset().dataLabel}); err != nil {
+		return "", fmt.Errorf("Invalid boot command %q: %s", cmd, err)
+	}
+	return buf.String(), nil
+}
+
+// expandBootCmds expands the boot command and its extra options.
+func (d *Driver) expandBootCmds() error {
+	var err error
+	if d.BootCmd, err = d.expandBootCmd(d.BootCmd); err != nil {
+		return err
+	}
+	if d.BootCmdExtra, err = d.expandBootCmd(d.BootCmdExtra); err != nil {
+		return err
+	}
+
+	log.Debugf("Kernel command line %q", d.kernelCmdline())
+	return nil
+}
+
+func (d *Driver) seedISOPath() string {
+	return d.ResolveStorePath(seedISOFilename)
+}
+
+// generateSeedISO writes the configuration ISO of the preset, if any.
+func (d *Driver) generateSeedISO() error {
+	seed := d.preset().seed
+	if seed == nil {
+		return nil
+	}
+
+	log.Infof("Creating %s...", seedISOFilename)
+	return seed(d)
+}
+
+// makeISO creates an ISO9660/Joliet image labeled volumeName at out, with
+// files mapping paths inside the image to their contents.
+func (d *Driver) makeISO(out, volumeName string, files map[string][]byte) error {
+	dir, err := ioutil.TempDir("", "xhyve-seed")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(p, content, 0600); err != nil {
+			return err
+		}
+	}
+
+	os.Remove(out)
+	if err := d.hdiutil("makehybrid", "-iso", "-joliet", "-default-volume-name", volumeName, "-o", out, dir); err != nil {
+		return err
+	}
+	// the seed holds the SSH key and the user-data of the guest
+	return os.Chmod(out, privateFileMode)
+}
+
+// cloudConfig returns a minimal #cloud-config document installing the
+// public SSH key of the machine.
+func (d *Driver) cloudConfig() ([]byte, error) {
+	keys, err := d.authorizedKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	config := fmt.Sprintf("#cloud-config\nhostname: %s\nssh_authorized_keys:\n  - %s\n",
+		d.hostname(), strings.Join(keys, "\n  - "))
+	return []byte(config), nil
+}
+
+// generateCloudConfigDrive writes an OpenStack config drive carrying the
+// cloud-config of the machine.
+func (d *Driver) generateCloudConfigDrive() error {
+	userData, err := d.cloudConfig()
+	if err != nil {
+		return err
+	}
+
+	return d.makeISO(d.seedISOPath(), "config-2", map[string][]byte{
+		"openstack/latest/user_data": userData,
+	})
+}
+
+// ignitionConfig returns an Ignition config installing the public SSH key of
+// the machine for the core user and enabling docker. The docker TLS
+// certificates are installed later by the CoreOS provisioner over SSH.
+func (d *Driver) ignitionConfig() ([]byte, error) {
+	keys, err := d.authorizedKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	type file struct {
+		Filesystem string `json:"filesystem"`
+		Path       string `json:"path"`
+		Mode       int    `json:"mode"`
+		Contents   struct {
+			Source string `json:"source"`
+		} `json:"contents"`
+	}
+	type unit struct {
+		Name     string `json:"name"`
+		Enable   bool   `json:"enable,omitempty"`
+		Contents string `json:"contents,omitempty"`
+	}
+
+	hostname := file{Filesystem: "root", Path: "/etc/hostname", Mode: 0644}
+	hostname.Contents.Source = "data:," + d.hostname()
+
+	config := map[string]interface{}{
+		"ignition": map[string]string{"version": "2.0.0"},
+		"passwd": map[string]interface{}{
+			"users": []map[string]interface{}{{
+				"name":              "core",
+				"sshAuthorizedKeys": keys,
+			}},
+		},
+		"storage": map[string]interface{}{
+			"files": []file{hostname},
+		},
+		"systemd": map[string]interface{}{
+			"units": []unit{{Name: "docker.service", Enable: true}},
+		},
+		"networkd": map[string]interface{}{
+			// send the MAC address as DHCP client identifier instead of the
+			// DUID, so the vmnet lease can be matched by MAC too
+			"units": []unit{{
+				Name:     "00-eth0.network",
+				Contents: "[Match]\nName=eth0\n\n[Network]\nDHCP=yes\n\n[DHCP]\nClientIdentifier=mac\n",
+			}},
+		},
+	}
+	return json.Marshal(config)
+}
+
+// generateIgnitionConfigDrive writes an OpenStack config drive carrying the
+// Ignition config of the machine.
+func (d *Driver) generateIgnitionConfigDrive() error {
+	userData, err := d.ignitionConfig()
+	if err != nil {
+		return err
+	}
+
+	return d.makeISO(d.seedISOPath(), "config-2", map[string][]byte{
+		"openstack/latest/user_data": userData,
+	})
+}
@@ -0,0 +1,62 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// priorityBackground runs the hypervisor with the Darwin background
+	// policy: lowest CPU, I/O and timer priority, for build machines which
+	// must not make the host UI stutter.
+	priorityBackground = "background"
+	// priorityForeground clears the background policy which the hypervisor
+	// inherits when docker-machine runs in a background process.
+	priorityForeground = "foreground"
+)
+
+// validateProcessPriority checks the --xhyve-process-priority value: empty,
+// a Darwin policy or a nice level.
+func validateProcessPriority(priority string) error {
+	switch priority {
+	case "", priorityBackground, priorityForeground:
+		return nil
+	}
+	if nice, err := strconv.Atoi(priority); err == nil && nice >= -20 && nice <= 20 {
+		return nil
+	}
+	return fmt.Errorf("--xhyve-process-priority must be %s, %s or a nice level from -20 to 20, got %q", priorityBackground, priorityForeground, priority)
+}
+
+// setProcessPriority applies the --xhyve-process-priority of the machine to
+// its hypervisor process pid. A nice level below 0 needs root.
+func (d *Driver) setProcessPriority(pid int) error {
+	switch d.ProcessPriority {
+	case "":
+		return nil
+	case priorityBackground, priorityForeground:
+		flag := "-b"
+		if d.ProcessPriority == priorityForeground {
+			flag = "-B"
+		}
+		if out, err := d.commands().CombinedOutput(exec.Command("taskpolicy", flag, "-p", strconv.Itoa(pid))); err != nil {
+			return fmt.Errorf("Could not set the %s policy of the hypervisor: %s %s", d.ProcessPriority, err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+	nice, err := strconv.Atoi(d.ProcessPriority)
+	if err != nil {
+		return err
+	}
+	if err := syscall.Setpriority(syscall.PRIO_PROCESS, pid, nice); err != nil {
+		return fmt.Errorf("Could not set the nice level of the hypervisor to %d: %s", nice, err)
+	}
+	return nil
+}
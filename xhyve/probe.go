@@ -0,0 +1,90 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ipProbeTimeout is how long a leased IP address has to answer
+	ipProbeTimeout = time.Second
+	// ipCheckTimeout is how long the saved IP address has to answer
+	ipCheckTimeout = 300 * time.Millisecond
+)
+
+// ipReachable reports whether a host answers on ip, by accepting or refusing
+// a connection to the SSH port.
+func ipReachable(ip string, port int) bool {
+	if port == 0 {
+		port = defaultSSHPort
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, strconv.Itoa(port)), ipCheckTimeout)
+	if err != nil {
+		return strings.Contains(err.Error(), "refused")
+	}
+	conn.Close()
+	return true
+}
+
+var arpMACRegexp = regexp.MustCompile(` at ([0-9A-Fa-f]{1,2}(?::[0-9A-Fa-f]{1,2}){5}) `)
+
+// arpMAC returns the MAC address of the ARP table entry of ip, "" when it has
+// none. arp writes the MAC addresses without leading zeros, like the leases.
+func (d *Driver) arpMAC(ip string) (string, error) {
+	out, err := d.commands().Output(exec.Command("arp", "-n", ip))
+	if err != nil {
+		return "", err
+	}
+	return parseArpMAC(string(out)), nil
+}
+
+func parseArpMAC(out string) string {
+	m := arpMACRegexp.FindStringSubmatch(out)
+	if m == nil {
+		return ""
+	}
+	return trimMacAddress(strings.ToLower(m[1]))
+}
+
+// verifyIP checks the machine answers on its leased IP address, and not
+// another guest a stale lease of a reused MAC address points to. Connecting
+// to the SSH port fills the ARP table, the connection being refused is fine
+// while sshd is not started yet.
+func (d *Driver) verifyIP(ip string) error {
+	port := d.SSHPort
+	if port == 0 {
+		port = defaultSSHPort
+	}
+	conn, dialErr := net.DialTimeout("tcp", net.JoinHostPort(ip, strconv.Itoa(port)), ipProbeTimeout)
+	if dialErr == nil {
+		conn.Close()
+	}
+
+	// arp only knows IPv4 neighbors, the fake machine is the host itself
+	if strings.Contains(ip, ":") || d.Hypervisor == hypervisorFake {
+		if dialErr != nil && !strings.Contains(dialErr.Error(), "refused") {
+			return dialErr
+		}
+		return nil
+	}
+	mac, err := d.arpMAC(ip)
+	if err != nil {
+		return dialErr
+	}
+	if mac == "" {
+		return fmt.Errorf("%s does not answer", ip)
+	}
+	if !strings.EqualFold(mac, d.MacAddr) {
+		return fmt.Errorf("%s is answered by %s instead of %s, the DHCP lease is stale", ip, mac, d.MacAddr)
+	}
+	return nil
+}
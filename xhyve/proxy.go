@@ -0,0 +1,79 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// proxyVariables are the proxy settings passed to the docker daemon.
+var proxyVariables = []string{"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY"}
+
+var (
+	scutilKeyRegexp   = regexp.MustCompile(`^\s*([A-Za-z]\w*) : (.*)$`)
+	scutilEntryRegexp = regexp.MustCompile(`^\s*\d+ : (.*)$`)
+)
+
+// hostProxyEnv returns the proxy settings of the host as VARIABLE=value
+// strings: the proxy variables of the environment, upper or lower case, and
+// the system proxies of macOS when none is set.
+func hostProxyEnv(r CommandRunner) []string {
+	var env []string
+	for _, name := range proxyVariables {
+		value := os.Getenv(name)
+		if value == "" {
+			value = os.Getenv(strings.ToLower(name))
+		}
+		if value != "" {
+			env = append(env, name+"="+value)
+		}
+	}
+	if len(env) > 0 {
+		return env
+	}
+
+	out, err := r.Output(exec.Command("scutil", "--proxy"))
+	if err != nil {
+		return nil
+	}
+	return parseScutilProxy(string(out))
+}
+
+// parseScutilProxy returns the enabled HTTP and HTTPS proxies and the proxy
+// exceptions listed by "scutil --proxy".
+func parseScutilProxy(out string) []string {
+	keys := make(map[string]string)
+	var exceptions []string
+	inExceptions := false
+	for _, line := range strings.Split(out, "\n") {
+		if m := scutilKeyRegexp.FindStringSubmatch(line); m != nil {
+			keys[m[1]] = m[2]
+			inExceptions = m[1] == "ExceptionsList"
+			continue
+		}
+		if m := scutilEntryRegexp.FindStringSubmatch(line); m != nil && inExceptions {
+			exceptions = append(exceptions, m[1])
+			continue
+		}
+		if strings.TrimSpace(line) == "}" {
+			inExceptions = false
+		}
+	}
+
+	var env []string
+	for _, p := range []struct{ name, key string }{{"HTTP_PROXY", "HTTP"}, {"HTTPS_PROXY", "HTTPS"}} {
+		if keys[p.key+"Enable"] == "1" && keys[p.key+"Proxy"] != "" {
+			env = append(env, fmt.Sprintf("%s=http://%s:%s", p.name, keys[p.key+"Proxy"], keys[p.key+"Port"]))
+		}
+	}
+	if len(env) > 0 && len(exceptions) > 0 {
+		env = append(env, "NO_PROXY="+strings.Join(exceptions, ","))
+	}
+	return env
+}
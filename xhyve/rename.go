@@ -0,0 +1,106 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/johanneswuerbach/nfsexports"
+)
+
+// namedArtifacts are the extensions of the machine files named after the machine.
+var namedArtifacts = []string{".rawdisk", ".qcow2", ".pid"}
+
+func (d *Driver) pidfilePath() string {
+	return d.ResolveStorePath(d.MachineName + ".pid")
+}
+
+func (d *Driver) qcow2DiskPath() string {
+	return d.diskFilePath(d.MachineName + ".qcow2")
+}
+
+// artifactName returns the machine name the files of the machine are named
+// after. Machines created before it was saved are guessed from their disk image.
+func (d *Driver) artifactName() string {
+	if d.ArtifactName != "" {
+		return d.ArtifactName
+	}
+	for _, ext := range namedArtifacts[:2] {
+		if _, err := os.Stat(d.diskFilePath(d.MachineName + ext)); err == nil {
+			return d.MachineName
+		}
+		if m, _ := filepath.Glob(d.diskFilePath("*" + ext)); len(m) == 1 {
+			return strings.TrimSuffix(filepath.Base(m[0]), ext)
+		}
+	}
+	return d.MachineName
+}
+
+// followRename updates the machine files after the machine was renamed, by
+// moving its machine directory and changing the MachineName of its
+// config.json. The disk image and pidfile are renamed, and the hostname is
+// updated in the boot command and the seed ISO. The UUID, and so the MAC
+// address and DHCP lease of the machine, are kept.
+func (d *Driver) followRename() error {
+	old := d.artifactName()
+	if old == d.MachineName {
+		d.ArtifactName = d.MachineName
+		return nil
+	}
+
+	log.Infof("%s was renamed from %s, renaming its files...", d.MachineName, old)
+	for i, ext := range namedArtifacts {
+		path := d.ResolveStorePath
+		if i < 2 {
+			// the disk images
+			path = d.diskFilePath
+		}
+		src := path(old + ext)
+		if _, err := os.Stat(src); err != nil {
+			continue
+		}
+		if err := os.Rename(src, path(d.MachineName+ext)); err != nil {
+			return err
+		}
+	}
+	snapshots, _ := filepath.Glob(filepath.Join(d.diskFilePath(snapshotsDir), "*", old+".*"))
+	for _, src := range snapshots {
+		if err := os.Rename(src, filepath.Join(filepath.Dir(src), d.MachineName+strings.TrimPrefix(filepath.Base(src), old))); err != nil {
+			return err
+		}
+	}
+
+	// the hostname given with --xhyve-hostname is kept
+	if d.Hostname == "" {
+		d.BootCmd = renameHost(d.BootCmd, old, d.MachineName)
+		d.BootCmdExtra = renameHost(d.BootCmdExtra, old, d.MachineName)
+	}
+
+	if err := d.generateSeedISO(); err != nil {
+		return err
+	}
+
+	if len(d.NFSShares) > 0 {
+		log.Infof("Remove NFS share folder must be root. Please insert root password.")
+		for _, share := range d.NFSShares {
+			if _, err := nfsexports.Remove("", nfsExportIdentifier(old, share)); err != nil {
+				log.Warnf("Could not remove the NFS share %s of %s: %s", share, old, err)
+			}
+		}
+	}
+
+	d.ArtifactName = d.MachineName
+	return nil
+}
+
+// renameHost replaces the boot2docker hostname option old in the kernel command line cmd.
+func renameHost(cmd, old, name string) string {
+	re := regexp.MustCompile(`\bhost=` + regexp.QuoteMeta(old) + `(\s|$)`)
+	return re.ReplaceAllString(cmd, "host="+name+"$1")
+}
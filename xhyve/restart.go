@@ -0,0 +1,67 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/state"
+)
+
+// bootIDCmd prints the random ID the guest kernel generates at each boot.
+const bootIDCmd = "cat /proc/sys/kernel/random/boot_id"
+
+// rebootGuest restarts the running machine with a reboot inside the guest,
+// which stops the containers cleanly. xhyve and vfkit exit when the guest
+// resets, the hypervisor is then started again with the same UUID, and so
+// the same MAC and IP address. A hypervisor resetting the guest in place
+// keeps running.
+func (d *Driver) rebootGuest() error {
+	out, err := d.runSSHCommand(bootIDCmd)
+	if err != nil {
+		return err
+	}
+	bootID := strings.TrimSpace(out)
+	ip := d.IPAddress
+
+	log.Infof("Rebooting %s ...", d.MachineName)
+	// the connection is closed by the reboot, its error does not tell much
+	d.runSSHCommand("sudo reboot")
+
+	timeout, interval := d.BootTimeout, d.IPPollInterval
+	if timeout < 1 {
+		timeout = defaultBootTimeout
+	}
+	if interval < 1 {
+		interval = defaultIPPollInterval
+	}
+
+	for deadline := time.Now().Add(time.Duration(timeout) * time.Second); ; {
+		// supervisors start the hypervisor again by themselves
+		if s, err := d.processState(); err == nil && s != state.Running && !d.Supervise {
+			log.Debugf("The hypervisor of %s exited on reboot, starting it again", d.MachineName)
+			d.detachDiskImage()
+			if err := d.Start(); err != nil {
+				return err
+			}
+			break
+		}
+		if out, err := d.runSSHCommand(bootIDCmd); err == nil && strings.TrimSpace(out) != bootID {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s did not reboot after %d seconds", d.MachineName, timeout)
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+	}
+
+	if d.IPAddress != ip {
+		log.Warnf("The IP address of %s changed from %s to %s, run \"docker-machine regenerate-certs %s\"", d.MachineName, ip, d.IPAddress, d.MachineName)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// machineFiles returns the paths of the files in the machine directory and
+// in its --xhyve-disk-dir.
+func (d *Driver) machineFiles() map[string]bool {
+	files := make(map[string]bool)
+	for _, dir := range []string{d.ResolveStorePath("."), d.DiskDir} {
+		if dir == "" {
+			continue
+		}
+		infos, _ := ioutil.ReadDir(dir)
+		for _, fi := range infos {
+			files[filepath.Join(dir, fi.Name())] = true
+		}
+	}
+	return files
+}
+
+// rollbackCreate undoes a failed Create step: it kills the hypervisor if it
+// was started, detaches the disk images and removes the files of the machine
+// which are not in existing, so that the step can be retried.
+func (d *Driver) rollbackCreate(existing map[string]bool) {
+	log.Infof("Cleaning up the partially created %s...", d.MachineName)
+	d.releaseResources()
+
+	for path := range d.machineFiles() {
+		if existing[path] {
+			continue
+		}
+		log.Debugf("Removing %s", path)
+		if err := os.RemoveAll(path); err != nil {
+			log.Warnf("Could not remove %s: %s", path, err)
+		}
+	}
+	// the key of a removed encrypted disk is of no use
+	if d.DiskKeyName != "" && !existing[d.sparseBundlePath()] {
+		if err := d.removeDiskKey(); err != nil {
+			log.Warnf("%s", err)
+		}
+		d.DiskKeyName = ""
+	}
+}
+
+// releaseResources kills the hypervisor of the machine, if running, and
+// detaches its ISO mount and disk image.
+func (d *Driver) releaseResources() {
+	d.signalSupervisor(syscall.SIGKILL)
+	if err := d.SendSignal(syscall.SIGKILL); err == nil {
+		log.Debugf("Killed the hypervisor of %s", d.MachineName)
+	}
+
+	if _, err := os.Stat(d.ResolveStorePath(isoMountPath)); err == nil {
+		d.hdiutil("detach", d.ResolveStorePath(isoMountPath))
+	}
+	if d.DiskNumber > 0 {
+		if err := d.detachDiskImage(); err != nil {
+			log.Warnf("Could not detach /dev/disk%d: %s", d.DiskNumber, err)
+		}
+	}
+}
+
+// cleanupOnInterrupt runs cleanup and exits if the driver receives SIGINT or
+// SIGTERM, until the returned function is called. Without it, interrupting
+// a create leaves the hypervisor running and the ISO mounted.
+func cleanupOnInterrupt(cleanup func()) func() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-sigCh:
+			log.Warnf("Received %s, cleaning up...", sig)
+			cleanup()
+			os.Exit(1)
+		case <-done:
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigCh)
+		close(done)
+	}
+}
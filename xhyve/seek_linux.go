@@ -0,0 +1,12 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+// The whence of lseek finding the data and the holes of sparse files, see
+// <linux/fs.h>.
+const (
+	seekData = 3
+	seekHole = 4
+)
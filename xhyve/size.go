@@ -0,0 +1,74 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// minMemorySize is the default memory size of xhyve, below which the
+	// boot2docker kernel does not even unpack its initrd.
+	minMemorySize = 256
+	// minDiskSize leaves room for the 1000MB swap partition boot2docker
+	// creates when formatting the disk, and for its data partition.
+	minDiskSize = 2000
+)
+
+var sizeRegexp = regexp.MustCompile(`^(\d+)\s*([KMGT]?)B?$`)
+
+var sizeUnits = map[string]float64{
+	"K": 1.0 / 1024,
+	"":  1,
+	"M": 1,
+	"G": 1024,
+	"T": 1024 * 1024,
+}
+
+// parseSize parses a size like "2048", "512M" or "2G" into MB. Sizes
+// without unit are in MB.
+func parseSize(s string) (int64, error) {
+	m := sizeRegexp.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(s)))
+	if m == nil {
+		return 0, fmt.Errorf("invalid size %q, use a number of MB or a size like 512M or 2G", s)
+	}
+	n, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %s", s, err)
+	}
+	return int64(float64(n) * sizeUnits[m[2]]), nil
+}
+
+// parseMemorySize parses the --xhyve-memory-size value into MB.
+func parseMemorySize(s string) (int, error) {
+	size, err := parseSize(s)
+	if err != nil {
+		return 0, fmt.Errorf("--xhyve-memory-size: %s", err)
+	}
+	if size < minMemorySize {
+		err := fmt.Errorf("--xhyve-memory-size must be at least %dMB, got %dMB", minMemorySize, size)
+		if _, e := strconv.Atoi(strings.TrimSpace(s)); e == nil {
+			// sizes without unit are MB, "2" is 2MB, not 2GB
+			err = fmt.Errorf("%s. Did you mean %sG?", err, strings.TrimSpace(s))
+		}
+		return 0, err
+	}
+	return int(size), nil
+}
+
+// parseDiskSize parses the --xhyve-disk-size value into MB.
+func parseDiskSize(s string) (int64, error) {
+	size, err := parseSize(s)
+	if err != nil {
+		return 0, fmt.Errorf("--xhyve-disk-size: %s", err)
+	}
+	if size < minDiskSize {
+		return 0, fmt.Errorf("--xhyve-disk-size must be at least %dMB, got %dMB", minDiskSize, size)
+	}
+	return size, nil
+}
@@ -0,0 +1,267 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/state"
+	"github.com/zchee/docker-machine-driver-xhyve/b2d"
+)
+
+const (
+	// snapshotsDir keeps the clones of the raw and sparsebundle disk images,
+	// one directory per snapshot. qcow2 snapshots are internal to the image.
+	snapshotsDir = "snapshots"
+
+	// diskProgressInterval is how often the progress of a disk copy or
+	// generation is logged
+	diskProgressInterval = 5 * time.Second
+)
+
+var (
+	snapshotNameRegexp = regexp.MustCompile(`^[\w.-]+$`)
+	// qemuImgSnapshotRegexp matches a snapshot line of "qemu-img snapshot -l",
+	// capturing its tag.
+	qemuImgSnapshotRegexp = regexp.MustCompile(`^\d+\s+(\S+)\s`)
+)
+
+// diskImagePath returns the disk image of the machine.
+func (d *Driver) diskImagePath() string {
+	switch {
+	case d.Qcow2:
+		return d.qcow2DiskPath()
+	case d.RawDisk:
+		return d.rawDiskPath()
+	}
+	return d.sparseBundlePath()
+}
+
+func (d *Driver) snapshotPath(name string) string {
+	return filepath.Join(d.diskFilePath(snapshotsDir), name, filepath.Base(d.diskImagePath()))
+}
+
+// loadStoppedMachine reads the machine name of the docker-machine store
+// storePath, which has to be stopped to snapshot its disk consistently.
+func loadStoppedMachine(storePath, name string) (*Driver, error) {
+	d, err := loadHostDriver(filepath.Join(storePath, "machines", name))
+	if err != nil {
+		return nil, err
+	}
+	if s, err := d.processState(); err == nil && (s == state.Running || s == state.Paused) {
+		return nil, fmt.Errorf("%s is %s, stop it before snapshotting or restoring its disk", name, strings.ToLower(s.String()))
+	}
+	return d, nil
+}
+
+func validateSnapshotName(name string) error {
+	if !snapshotNameRegexp.MatchString(name) {
+		return fmt.Errorf("Invalid snapshot name %q, only letters, digits, '.', '_' and '-' are allowed", name)
+	}
+	return nil
+}
+
+// cloneFile copies src to dst with an APFS clone, which takes no time nor
+// space, and falls back to a regular copy on other filesystems.
+func (d *Driver) cloneFile(src, dst string) error {
+	if out, err := d.commands().CombinedOutput(exec.Command("cp", "-c", "-R", src, dst)); err != nil {
+		log.Debugf("Could not clone %s: %s", src, strings.TrimSpace(string(out)))
+		os.RemoveAll(dst)
+		log.Warnf("%s is not on APFS, copying it...", filepath.Base(src))
+		stop := watchCopy(src, dst)
+		out, err := d.commands().CombinedOutput(exec.Command("cp", "-R", src, dst))
+		stop()
+		if err != nil {
+			os.RemoveAll(dst)
+			return fmt.Errorf("Could not copy %s: %s", src, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+// watchCopy logs the progress of the copy of src to dst every
+// diskProgressInterval, until the returned function is called.
+func watchCopy(src, dst string) func() {
+	return watchPath("Copying "+filepath.Base(src), dst, pathSize(src))
+}
+
+// watchPath logs the size of path growing to total bytes, -1 when it is
+// unknown, every diskProgressInterval until the returned function is called.
+func watchPath(what, path string, total int64) func() {
+	progress := b2d.NewProgress(what, 0, total)
+	stop := make(chan struct{})
+	go func() {
+		t := time.NewTicker(diskProgressInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				progress.Log(pathSize(path))
+			}
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// pathSize returns the size of the file path, or of the files of the
+// directory path, like a sparsebundle.
+func pathSize(path string) int64 {
+	var size int64
+	filepath.Walk(path, func(_ string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+func (d *Driver) qemuImgSnapshot(args ...string) (string, error) {
+	bin := d.qemuImgBinary()
+	if bin == "" {
+		return "", fmt.Errorf("qcow2 snapshots need qemu-img, install it with \"brew install qemu\"")
+	}
+	out, err := d.commands().CombinedOutput(exec.Command(bin, append([]string{"snapshot"}, args...)...))
+	if err != nil {
+		return "", fmt.Errorf("qemu-img snapshot %s failed: %s", strings.Join(args, " "), strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+// CreateSnapshot saves the disk of the stopped machine as the snapshot name.
+func CreateSnapshot(storePath, machine, name string) error {
+	if err := validateSnapshotName(name); err != nil {
+		return err
+	}
+	d, err := loadStoppedMachine(storePath, machine)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Creating snapshot %s of %s...", name, machine)
+	if d.Qcow2 {
+		_, err := d.qemuImgSnapshot("-c", name, d.diskImagePath())
+		return err
+	}
+
+	dst := d.snapshotPath(name)
+	if _, err := os.Stat(dst); err == nil {
+		return fmt.Errorf("Snapshot %s of %s already exists", name, machine)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+	if err := d.cloneFile(d.diskImagePath(), dst); err != nil {
+		os.Remove(filepath.Dir(dst))
+		return err
+	}
+	return nil
+}
+
+// RestoreSnapshot replaces the disk of the stopped machine with the snapshot
+// name. The snapshot is kept.
+func RestoreSnapshot(storePath, machine, name string) error {
+	if err := validateSnapshotName(name); err != nil {
+		return err
+	}
+	d, err := loadStoppedMachine(storePath, machine)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Restoring snapshot %s of %s...", name, machine)
+	if d.Qcow2 {
+		_, err := d.qemuImgSnapshot("-a", name, d.diskImagePath())
+		return err
+	}
+
+	src := d.snapshotPath(name)
+	if _, err := os.Stat(src); err != nil {
+		return fmt.Errorf("Snapshot %s of %s does not exist", name, machine)
+	}
+	disk := d.diskImagePath()
+	tmp := disk + ".restore"
+	os.RemoveAll(tmp)
+	if err := d.cloneFile(src, tmp); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(disk); err != nil {
+		return err
+	}
+	return os.Rename(tmp, disk)
+}
+
+// DeleteSnapshot removes the snapshot name of the machine.
+func DeleteSnapshot(storePath, machine, name string) error {
+	if err := validateSnapshotName(name); err != nil {
+		return err
+	}
+	d, err := loadHostDriver(filepath.Join(storePath, "machines", machine))
+	if err != nil {
+		return err
+	}
+
+	if d.Qcow2 {
+		_, err := d.qemuImgSnapshot("-d", name, d.diskImagePath())
+		return err
+	}
+
+	dir := filepath.Dir(d.snapshotPath(name))
+	if _, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("Snapshot %s of %s does not exist", name, machine)
+	}
+	return os.RemoveAll(dir)
+}
+
+// ListSnapshots returns the sorted snapshot names of the machine.
+func ListSnapshots(storePath, machine string) ([]string, error) {
+	d, err := loadHostDriver(filepath.Join(storePath, "machines", machine))
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	if d.Qcow2 {
+		out, err := d.qemuImgSnapshot("-l", d.diskImagePath())
+		if err != nil {
+			return nil, err
+		}
+		names = parseQemuImgSnapshots(out)
+	} else {
+		files, err := ioutil.ReadDir(d.diskFilePath(snapshotsDir))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, f := range files {
+			if f.IsDir() {
+				names = append(names, f.Name())
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// parseQemuImgSnapshots returns the tags listed by "qemu-img snapshot -l".
+func parseQemuImgSnapshots(out string) []string {
+	var names []string
+	for _, line := range strings.Split(out, "\n") {
+		if m := qemuImgSnapshotRegexp.FindStringSubmatch(line); m != nil {
+			names = append(names, m[1])
+		}
+	}
+	return names
+}
@@ -0,0 +1,110 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// sshAgentKeys returns the public keys of the running ssh-agent in the
+// authorized_keys format.
+func sshAgentKeys() ([]byte, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, fmt.Errorf("--xhyve-ssh-agent needs a running ssh-agent, SSH_AUTH_SOCK is not set")
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, fmt.Errorf("Could not connect to the ssh-agent: %s", err)
+	}
+	defer conn.Close()
+
+	keys, err := agent.NewClient(conn).List()
+	if err != nil {
+		return nil, fmt.Errorf("Could not list the keys of the ssh-agent: %s", err)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("The ssh-agent has no keys, add one with \"ssh-add\"")
+	}
+
+	var buf bytes.Buffer
+	for _, k := range keys {
+		fmt.Fprintln(&buf, k.String())
+	}
+	return buf.Bytes(), nil
+}
+
+// checkSSHAgent checks the machine can be reached with the keys of the
+// ssh-agent. Only the external ssh client of docker-machine offers them, the
+// native one needs a key file.
+func checkSSHAgent() error {
+	if _, err := exec.LookPath("ssh"); err != nil {
+		return fmt.Errorf("--xhyve-ssh-agent needs the ssh binary: %s", err)
+	}
+	_, err := sshAgentKeys()
+	return err
+}
+
+// sshClient returns the SSH client the driver connects to the machine with:
+// the external ssh client offering the keys of the ssh-agent with
+// --xhyve-ssh-agent, else the native one with the key file of the machine.
+// The client is chosen per machine, the driver of another machine served
+// by the same plugin keeps its own.
+func (d *Driver) sshClient() (ssh.Client, error) {
+	if !d.SSHAgent {
+		return drivers.GetSSHClientFromDriver(d)
+	}
+	binary, err := exec.LookPath("ssh")
+	if err != nil {
+		return nil, fmt.Errorf("--xhyve-ssh-agent needs the ssh binary: %s", err)
+	}
+	address, err := d.GetSSHHostname()
+	if err != nil {
+		return nil, err
+	}
+	port, err := d.GetSSHPort()
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewExternalClient(binary, d.GetSSHUsername(), address, port, &ssh.Auth{})
+}
+
+// runSSHCommand runs command in the machine with the SSH client of the
+// driver, like drivers.RunSSHCommandFromDriver.
+func (d *Driver) runSSHCommand(command string) (string, error) {
+	client, err := d.sshClient()
+	if err != nil {
+		return "", err
+	}
+
+	log.Debugf("About to run SSH command:\n%s", command)
+	output, err := client.Output(command)
+	log.Debugf("SSH cmd err, output: %v: %s", err, output)
+	if err != nil {
+		return "", fmt.Errorf("SSH command error:\ncommand : %s\nerr     : %v\noutput  : %s", command, err, output)
+	}
+	return output, nil
+}
+
+// installSSHAgentKeys authorizes the keys of the ssh-agent in the guest. No
+// private key is written to the machine directory.
+func (d *Driver) installSSHAgentKeys() error {
+	pubKeys, err := sshAgentKeys()
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Authorizing the keys of the ssh-agent...")
+	return writePrivateFile(d.publicSSHKeyPath(), pubKeys)
+}
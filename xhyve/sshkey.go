@@ -0,0 +1,95 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// readSSHKey reads the existing private key path given with --xhyve-ssh-key
+// and returns it with its public key in the authorized_keys format. When the
+// key has a path.pub public key next to it, it has to match the private key,
+// and its comment is kept.
+func readSSHKey(path string) (privKey, pubKey []byte, err error) {
+	privKey, err = ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not read the --xhyve-ssh-key: %s", err)
+	}
+	if bytes.Contains(privKey, []byte("ENCRYPTED")) {
+		return nil, nil, fmt.Errorf("The --xhyve-ssh-key %s is protected by a passphrase, which docker-machine can not use", path)
+	}
+	signer, err := gossh.ParsePrivateKey(privKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("The --xhyve-ssh-key %s is not a PEM encoded RSA, ECDSA or DSA private key: %s", path, err)
+	}
+	pubKey = gossh.MarshalAuthorizedKey(signer.PublicKey())
+
+	data, err := ioutil.ReadFile(path + ".pub")
+	if os.IsNotExist(err) {
+		return privKey, pubKey, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	existing, _, _, _, err := gossh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid public key %s.pub: %s", path, err)
+	}
+	if !bytes.Equal(existing.Marshal(), signer.PublicKey().Marshal()) {
+		return nil, nil, fmt.Errorf("The public key %s.pub does not match the --xhyve-ssh-key %s", path, path)
+	}
+	return privKey, data, nil
+}
+
+// expandPath returns the absolute path of a host file given by a flag, "~"
+// standing for the home directory.
+func expandPath(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		path = filepath.Join(os.Getenv("HOME"), path[1:])
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return path
+}
+
+// authorizedKeys returns the public keys installed in the guest, one per
+// line of the public key file. The keys of the ssh-agent can be several.
+func (d *Driver) authorizedKeys() ([]string, error) {
+	data, err := ioutil.ReadFile(d.publicSSHKeyPath())
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			keys = append(keys, line)
+		}
+	}
+	return keys, nil
+}
+
+// copySSHKey installs the --xhyve-ssh-key as the SSH key of the machine. Its
+// public key is put in the userdata.tar or the seed ISO like a generated one.
+func (d *Driver) copySSHKey() error {
+	privKey, pubKey, err := readSSHKey(d.SSHKey)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Using the SSH key %s...", d.SSHKey)
+	if err := writePrivateFile(d.privateSSHKeyPath(), privKey); err != nil {
+		return err
+	}
+	return writePrivateFile(d.publicSSHKeyPath(), pubKey)
+}
@@ -0,0 +1,117 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/state"
+)
+
+const (
+	// startingFilename marks the machine waiting for its IP address and SSH
+	startingFilename = "starting"
+	// exitStatusFilename keeps the exit status of a hypervisor that failed
+	exitStatusFilename = "exit-status"
+
+	// consolePanicTail is how much of the end of the console log is searched
+	// for a kernel panic
+	consolePanicTail = 64 * 1024
+)
+
+// GetState returns the state of the machine: Starting until it has an IP
+// address and accepts SSH connections, Running or Paused, Error when the
+// guest kernel panicked or the hypervisor failed, else Stopped.
+func (d *Driver) GetState() (state.State, error) {
+	s, err := d.processState()
+	if err != nil {
+		return s, err
+	}
+
+	switch s {
+	case state.Running:
+		if d.consolePanic() != "" {
+			return state.Error, nil
+		}
+		if d.isStarting() {
+			return state.Starting, nil
+		}
+	case state.Stopped:
+		if code, err := d.loadExitStatus(); err == nil && hypervisorFailed(code) {
+			return state.Error, nil
+		}
+	}
+	return s, nil
+}
+
+// markStarting reports the machine Starting until the returned function is
+// called. The mark of a driver killed meanwhile expires after the boot and
+// SSH timeouts.
+func (d *Driver) markStarting() func() {
+	path := d.ResolveStorePath(startingFilename)
+	if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+		log.Debugf("Could not mark %s starting: %s", d.MachineName, err)
+	}
+	return func() {
+		os.Remove(path)
+	}
+}
+
+func (d *Driver) isStarting() bool {
+	fi, err := os.Stat(d.ResolveStorePath(startingFilename))
+	if err != nil {
+		return false
+	}
+	timeout := d.BootTimeout + d.SSHTimeout
+	if timeout < 1 {
+		timeout = defaultBootTimeout + defaultSSHTimeout
+	}
+	return time.Since(fi.ModTime()) < time.Duration(timeout)*time.Second
+}
+
+// consolePanic returns the kernel panic at the end of the console log of the
+// current boot.
+func (d *Driver) consolePanic() string {
+	data, err := readTail(d.consoleLogPath(), consolePanicTail)
+	if err != nil {
+		return ""
+	}
+	return kernelPanicRegexp.FindString(string(data))
+}
+
+// hypervisorFailed reports whether the exit status code of the hypervisor is
+// a failure. Neither the guest resetting, powering off or halting, nor the
+// hypervisor being killed are.
+func hypervisorFailed(code int) bool {
+	return code > 0 && !guestShutdownStatuses[code]
+}
+
+// saveExitStatus records the exit status of the hypervisor, which GetState
+// reports as Error when it failed.
+func (d *Driver) saveExitStatus(waitErr error) {
+	code := exitStatus(waitErr)
+	if err := ioutil.WriteFile(d.ResolveStorePath(exitStatusFilename), []byte(strconv.Itoa(code)), 0644); err != nil {
+		log.Debugf("Could not save the exit status of %s: %s", d.MachineName, err)
+	}
+}
+
+func (d *Driver) loadExitStatus() (int, error) {
+	data, err := ioutil.ReadFile(d.ResolveStorePath(exitStatusFilename))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// clearExitStatus forgets the exit status of the previous hypervisor, when
+// it is started again or the machine is stopped on purpose.
+func (d *Driver) clearExitStatus() {
+	os.Remove(d.ResolveStorePath(exitStatusFilename))
+}
@@ -0,0 +1,249 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/zchee/docker-machine-driver-xhyve/vmnet"
+)
+
+const (
+	// staticIPAuto allocates the next free static IP of the vmnet network
+	staticIPAuto = "auto"
+
+	// staticIPLock serializes the allocations of static IPs.
+	staticIPLock = "static-ip.lock"
+)
+
+// bindingNameRegexp matches the machine names the bootptab can hold.
+var bindingNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// validateStaticIP checks the --xhyve-static-ip: auto or an IPv4 address.
+func validateStaticIP(s string) error {
+	if s == "" || s == staticIPAuto {
+		return nil
+	}
+	if ip := net.ParseIP(s); ip == nil || ip.To4() == nil {
+		return fmt.Errorf("--xhyve-static-ip must be auto or an IPv4 address, got %q", s)
+	}
+	return nil
+}
+
+// addStaticIP binds the guest address ip of the vmnet network to the MAC
+// address mac of the machine name in the bootptab of the vmnet DHCP server.
+// It needs root.
+func addStaticIP(name, mac, ip string) error {
+	if !bindingNameRegexp.MatchString(name) {
+		return fmt.Errorf("Invalid machine name %q", name)
+	}
+	if !leaseMACRegexp.MatchString(mac) {
+		return fmt.Errorf("Invalid MAC address %q", mac)
+	}
+	if err := validateStaticIP(ip); err != nil || ip == "" || ip == staticIPAuto {
+		return fmt.Errorf("Invalid IP address %q", ip)
+	}
+	network, isHost, err := vmnetHosts()
+	if err != nil {
+		return fmt.Errorf("Could not read the vmnet network: %s", err)
+	}
+	if !isHost(net.ParseIP(ip)) {
+		return fmt.Errorf("The static IP %s is not a guest address of the vmnet network %s", ip, network)
+	}
+	if err := vmnet.AddStaticBinding(vmnet.StaticBinding{Name: name, HWAddress: mac, IPAddress: ip}); err != nil {
+		return fmt.Errorf("Could not bind %s to %s: %s", ip, mac, err)
+	}
+	return nil
+}
+
+// removeStaticIP removes the static IP bindings of the MAC address mac from
+// the bootptab of the vmnet DHCP server. It needs root like addStaticIP.
+func removeStaticIP(mac string) error {
+	if !leaseMACRegexp.MatchString(mac) {
+		return fmt.Errorf("Invalid MAC address %q", mac)
+	}
+	n, err := vmnet.RemoveStaticBindingsByMACAddress(mac)
+	if err != nil {
+		return fmt.Errorf("Could not remove the static IP of %s: %s", mac, err)
+	}
+	log.Debugf("Removed %d static IP bindings of %s", n, mac)
+	return nil
+}
+
+// vmnetHosts returns the vmnet network and the addresses the guests can get
+// in it: all but the network, broadcast and host addresses.
+func vmnetHosts() (*net.IPNet, func(ip net.IP) bool, error) {
+	network, err := vmnet.GetIPNet()
+	if err != nil {
+		return nil, nil, err
+	}
+	gateway, err := vmnet.GetNetAddr()
+	if err != nil {
+		return nil, nil, err
+	}
+	first, last := ipRange(network)
+	isHost := func(ip net.IP) bool {
+		n := ipToInt(ip)
+		return network.Contains(ip) && n > first && n < last && !ip.Equal(gateway)
+	}
+	return network, isHost, nil
+}
+
+func ipToInt(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func intToIP(n uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+// ipRange returns the network and broadcast addresses of network.
+func ipRange(network *net.IPNet) (uint32, uint32) {
+	first := ipToInt(network.IP.Mask(network.Mask))
+	return first, first | ^binary.BigEndian.Uint32(network.Mask)
+}
+
+// takenIPs returns the addresses which are not free for the machine: bound
+// or leased to other MAC addresses, or the static IPs of the other machines
+// of the store. It also returns the highest bound address.
+func (d *Driver) takenIPs() (map[string]bool, net.IP, error) {
+	taken := make(map[string]bool)
+	var highest net.IP
+	bindings, err := vmnet.GetStaticBindings()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, b := range bindings {
+		if b.HWAddress == d.MacAddr {
+			continue
+		}
+		taken[b.IPAddress] = true
+		if ip := net.ParseIP(b.IPAddress); ip != nil && ip.To4() != nil && (highest == nil || ipToInt(ip) > ipToInt(highest)) {
+			highest = ip
+		}
+	}
+	leases, _ := vmnet.GetLeases()
+	for _, l := range leases {
+		if l.HWAddress != d.MacAddr {
+			taken[l.IPAddress] = true
+		}
+	}
+	for name, m := range storeMachines(d.StorePath) {
+		if name != d.MachineName && m.StaticIP != "" && m.StaticIP != staticIPAuto {
+			taken[m.StaticIP] = true
+		}
+	}
+	return taken, highest, nil
+}
+
+// nextStaticIPs returns count consecutive addresses of network which isHost
+// and are not taken. The search starts after the highest bound address, in
+// the upper half of the network where the DHCP server leases last, and wraps
+// around to the start of the upper half.
+func nextStaticIPs(network *net.IPNet, isHost func(net.IP) bool, taken map[string]bool, highest net.IP, count int) ([]string, error) {
+	first, last := ipRange(network)
+	start := first + (last-first+1)/2
+	from := start
+	if highest != nil && network.Contains(highest) && ipToInt(highest) >= start {
+		from = ipToInt(highest) + 1
+	}
+
+	search := func(from uint32) []string {
+		var run []string
+		for n := from; n < last; n++ {
+			ip := intToIP(n)
+			if !isHost(ip) || taken[ip.String()] {
+				run = nil
+				continue
+			}
+			if run = append(run, ip.String()); len(run) == count {
+				return run
+			}
+		}
+		return nil
+	}
+	if ips := search(from); ips != nil {
+		return ips, nil
+	}
+	if ips := search(start); ips != nil {
+		return ips, nil
+	}
+	return nil, fmt.Errorf("No %d consecutive free addresses left in the upper half of %s", count, network)
+}
+
+// createStaticIP allocates the --xhyve-static-ip of the machine and binds it
+// to its MAC address, before its first start.
+func (d *Driver) createStaticIP() error {
+	if d.StaticIP == "" {
+		return nil
+	}
+
+	unlock, err := d.lockCache(staticIPLock)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	network, isHost, err := vmnetHosts()
+	if err != nil {
+		return fmt.Errorf("Could not read the vmnet network: %s", err)
+	}
+	taken, highest, err := d.takenIPs()
+	if err != nil {
+		return err
+	}
+	if d.StaticIP == staticIPAuto {
+		ips, err := nextStaticIPs(network, isHost, taken, highest, 1)
+		if err != nil {
+			return err
+		}
+		d.StaticIP = ips[0]
+		log.Infof("Allocated the static IP %s", d.StaticIP)
+	} else if !isHost(net.ParseIP(d.StaticIP)) {
+		return fmt.Errorf("The static IP %s is not a guest address of the vmnet network %s", d.StaticIP, network)
+	} else if taken[d.StaticIP] {
+		return fmt.Errorf("The static IP %s is already used by another machine", d.StaticIP)
+	}
+	return d.bindStaticIP()
+}
+
+// checkStaticIPRoot makes sure the driver runs as root, which binds the
+// static IPs. The helper does not: the MAC addresses and IPs it would be
+// given could be those of the machines of any user.
+func checkStaticIPRoot() error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("--xhyve-static-ip needs the setuid root driver, which binds the IP in %s, the %s helper does not", vmnet.BOOTPTAB_FILE, HelperName)
+	}
+	return nil
+}
+
+// bindStaticIP binds the static IP to the MAC address of the machine, as the
+// setuid root driver.
+func (d *Driver) bindStaticIP() error {
+	if err := checkStaticIPRoot(); err != nil {
+		return err
+	}
+	return addStaticIP(d.MachineName, d.MacAddr, d.StaticIP)
+}
+
+// unbindStaticIP removes the static IP binding of the removed machine, so
+// its address can be given again.
+func (d *Driver) unbindStaticIP() error {
+	if d.StaticIP == "" || d.MacAddr == "" {
+		return nil
+	}
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("Removing static IPs needs the setuid root driver, remove the entry of %s from %s by hand",
+			d.MacAddr, vmnet.BOOTPTAB_FILE)
+	}
+	return removeStaticIP(d.MacAddr)
+}
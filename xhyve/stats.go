@@ -0,0 +1,146 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/docker/machine/libmachine/state"
+)
+
+// statsCommand collects the memory and Docker disk usage of the guest.
+const statsCommand = "cat /proc/meminfo; df -Pk /var/lib/docker"
+
+// Stats is a sample of the resource usage of a running machine. The sizes
+// are in bytes.
+type Stats struct {
+	// CPUPercent is the share of a host CPU the hypervisor process takes,
+	// over 100 with several busy vCPUs.
+	CPUPercent float64
+	// RSS is the host memory the hypervisor process takes.
+	RSS int64
+
+	GuestMemoryTotal     int64
+	GuestMemoryAvailable int64
+	DockerDiskSize       int64
+	DockerDiskUsed       int64
+	// GuestError is why the guest part could not be sampled over SSH.
+	GuestError string `json:",omitempty"`
+}
+
+// Stats samples the resource usage of the hypervisor process, and of the
+// guest over SSH.
+func (d *Driver) Stats() (*Stats, error) {
+	if s, err := d.processState(); err != nil || s != state.Running {
+		return nil, fmt.Errorf("%s is not running", d.MachineName)
+	}
+	pid, err := d.GetPid()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &Stats{}
+	if stats.CPUPercent, stats.RSS, err = d.sampleProcess(pid); err != nil {
+		return nil, err
+	}
+
+	guest, err := d.runSSHCommand(statsCommand)
+	if err == nil {
+		err = parseGuestStats(guest, stats)
+	}
+	if err != nil {
+		stats.GuestError = err.Error()
+	}
+	return stats, nil
+}
+
+// sampleProcess returns the CPU share and the RSS of the hypervisor process
+// pid.
+func (d *Driver) sampleProcess(pid int) (float64, int64, error) {
+	out, err := d.commands().Output(exec.Command("ps", "-o", "%cpu=,rss=", "-p", strconv.Itoa(pid)))
+	if err != nil {
+		return 0, 0, fmt.Errorf("Could not sample the hypervisor process %d: %s", pid, err)
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 {
+		return 0, 0, fmt.Errorf("Unexpected ps output %q", out)
+	}
+	cpu, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	rss, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return cpu, rss * 1024, nil
+}
+
+// parseGuestStats fills in the guest part of stats from the output of
+// statsCommand.
+func parseGuestStats(out string, stats *Stats) error {
+	var disk []string
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		switch {
+		case len(fields) == 3 && fields[0] == "MemTotal:":
+			stats.GuestMemoryTotal, _ = strconv.ParseInt(fields[1], 10, 64)
+		case len(fields) == 3 && fields[0] == "MemAvailable:":
+			stats.GuestMemoryAvailable, _ = strconv.ParseInt(fields[1], 10, 64)
+		case len(fields) == 6:
+			// the df line, its header has a 7th "on" field
+			disk = fields
+		}
+	}
+	if stats.GuestMemoryTotal == 0 || disk == nil {
+		return fmt.Errorf("Unexpected output of %q", statsCommand)
+	}
+	stats.GuestMemoryTotal *= 1024
+	stats.GuestMemoryAvailable *= 1024
+	size, err := strconv.ParseInt(disk[1], 10, 64)
+	if err != nil {
+		return err
+	}
+	used, err := strconv.ParseInt(disk[2], 10, 64)
+	if err != nil {
+		return err
+	}
+	stats.DockerDiskSize = size * 1024
+	stats.DockerDiskUsed = used * 1024
+	return nil
+}
+
+// PrintStats writes the resource usage of the machine name of the
+// docker-machine store storePath to w.
+func PrintStats(storePath, name string, w io.Writer) error {
+	d, err := loadHostDriver(filepath.Join(storePath, "machines", name))
+	if err != nil {
+		return err
+	}
+	stats, err := d.Stats()
+	if err != nil {
+		return err
+	}
+
+	const mb = 1024 * 1024
+	fmt.Fprintf(w, "Hypervisor process:\n")
+	fmt.Fprintf(w, "  CPU:             %.1f%%\n", stats.CPUPercent)
+	fmt.Fprintf(w, "  memory (RSS):    %dMB\n", stats.RSS/mb)
+	fmt.Fprintf(w, "Guest:\n")
+	if stats.GuestError != "" {
+		fmt.Fprintf(w, "  unknown (%s)\n", stats.GuestError)
+		return nil
+	}
+	fmt.Fprintf(w, "  memory used:     %dMB of %dMB\n", (stats.GuestMemoryTotal-stats.GuestMemoryAvailable)/mb, stats.GuestMemoryTotal/mb)
+	fmt.Fprintf(w, "  /var/lib/docker: %dMB of %dMB\n", stats.DockerDiskUsed/mb, stats.DockerDiskSize/mb)
+	return nil
+}
@@ -0,0 +1,309 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	ps "github.com/mitchellh/go-ps"
+)
+
+const (
+	supervisorPidFilename    = "supervisor.pid"
+	supervisorStatusFilename = "supervisor.json"
+	supervisorLogFilename    = "supervisor.log"
+
+	// the supervisor gives up after maxCrashes crashes within crashWindow
+	maxCrashes  = 5
+	crashWindow = 10 * time.Minute
+	// restartDelay is waited before restarting a crashed hypervisor
+	restartDelay = 2 * time.Second
+)
+
+// Exit statuses of xhyve and hyperkit when the guest powers off or halts.
+// The guest resetting exits with 0, any other status is a crash.
+var guestShutdownStatuses = map[int]bool{1: true, 2: true}
+
+// supervisorStatus is the content of the supervisor status file, shown by
+// "docker-machine inspect".
+type supervisorStatus struct {
+	// Restarts counts the crashes the hypervisor was restarted after.
+	Restarts int
+	// LastCrash is the reason of the last crash.
+	LastCrash string `json:",omitempty"`
+	// LastRestart is the time the hypervisor was last restarted after a crash.
+	LastRestart time.Time
+}
+
+// MarshalJSON adds the runtime details of the machine, and the supervisor
+// status of supervised machines, to the driver configuration.
+func (d *Driver) MarshalJSON() ([]byte, error) {
+	type config Driver
+	var (
+		runtime *runtimeDetails
+		status  *supervisorStatus
+	)
+	if d.BaseDriver != nil && d.MachineName != "" {
+		runtime = d.runtimeDetails()
+	}
+	if d.Supervise && d.BaseDriver != nil {
+		status, _ = d.loadSupervisorStatus()
+	}
+	return json.Marshal(struct {
+		*config
+		Runtime    *runtimeDetails   `json:",omitempty"`
+		Supervisor *supervisorStatus `json:",omitempty"`
+	}{(*config)(d), runtime, status})
+}
+
+func (d *Driver) loadSupervisorStatus() (*supervisorStatus, error) {
+	data, err := ioutil.ReadFile(d.ResolveStorePath(supervisorStatusFilename))
+	if err != nil {
+		return nil, err
+	}
+	var status supervisorStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+func (d *Driver) saveSupervisorStatus(status *supervisorStatus) error {
+	data, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(d.ResolveStorePath(supervisorStatusFilename), data, 0644)
+}
+
+// startDetached runs the driver binary with the argument command in its own
+// session, so it outlives the driver, logging to logFilename. It gets the
+// driver configuration on its stdin, the machine is not saved yet when it is
+// created.
+func (d *Driver) startDetached(command, logFilename string) (int, error) {
+	config, err := json.Marshal(d)
+	if err != nil {
+		return 0, err
+	}
+	logFile, err := openPrivateLog(d.ResolveStorePath(logFilename))
+	if err != nil {
+		return 0, err
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(d.driverBinary(), command)
+	cmd.Stdin = bytes.NewReader(config)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	p, err := d.commands().Start(cmd)
+	if err != nil {
+		return 0, err
+	}
+	go p.Wait()
+	return p.Pid(), nil
+}
+
+// startSupervisor starts the supervisor of the machine.
+func (d *Driver) startSupervisor() error {
+	pid, err := d.startDetached("supervise", supervisorLogFilename)
+	if err != nil {
+		return fmt.Errorf("Could not start the supervisor: %s", err)
+	}
+	log.Debugf("Started the supervisor of %s (pid %d)", d.MachineName, pid)
+	return nil
+}
+
+// signalSupervisor sends sig to the supervisor of the machine. It reports
+// whether the machine is supervised.
+func (d *Driver) signalSupervisor(sig syscall.Signal) bool {
+	pidPath := d.ResolveStorePath(supervisorPidFilename)
+	p, err := ioutil.ReadFile(pidPath)
+	if err != nil {
+		return false
+	}
+	pid, err := strconv.Atoi(string(p))
+	if err != nil || !d.isDriverProcess(pid) {
+		// left by a supervisor killed with -9 or a host reboot
+		os.Remove(pidPath)
+		return false
+	}
+	return syscall.Kill(pid, sig) == nil
+}
+
+// isDriverProcess reports whether pid is a process of the driver binary, and
+// not an unrelated process which got the pid of a dead one. ps truncates the
+// executable names.
+func (d *Driver) isDriverProcess(pid int) bool {
+	if syscall.Kill(pid, 0) != nil {
+		return false
+	}
+	p, err := ps.FindProcess(pid)
+	if err != nil || p == nil || p.Executable() == "" {
+		return false
+	}
+	return strings.HasPrefix(filepath.Base(d.driverBinary()), p.Executable())
+}
+
+// crashReason returns the kernel panic of the console log, or the exit
+// status of the hypervisor. It reports whether the hypervisor crashed, the
+// guest resetting is not a crash.
+func (d *Driver) crashReason(waitErr error) (string, bool) {
+	if data, err := ioutil.ReadFile(d.consoleLogPath()); err == nil {
+		if m := kernelPanicRegexp.FindAll(data, -1); len(m) > 0 {
+			return string(m[len(m)-1]), true
+		}
+	}
+	if waitErr == nil {
+		return "", false
+	}
+	return waitErr.Error(), true
+}
+
+// exitStatus returns the exit status of the hypervisor, -1 when it was
+// killed by a signal.
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Exited() {
+			return ws.ExitStatus()
+		}
+	}
+	return -1
+}
+
+// Supervise runs the hypervisor of the machine configured on r, and restarts
+// it when the guest resets or crashes. It keeps the clock of the guest synced
+// meanwhile, emits its metrics and stops the machine once its TTL runs out.
+// It returns when the guest powers off, when the supervisor is terminated,
+// which terminates the hypervisor, or when the hypervisor crashes too often.
+func Supervise(r io.Reader) error {
+	d := NewDriver("", "")
+	if err := json.NewDecoder(r).Decode(d); err != nil {
+		return fmt.Errorf("Invalid driver configuration: %s", err)
+	}
+
+	pidPath := d.ResolveStorePath(supervisorPidFilename)
+	if err := ioutil.WriteFile(pidPath, []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+		return err
+	}
+	defer os.Remove(pidPath)
+
+	status := &supervisorStatus{}
+	if err := d.saveSupervisorStatus(status); err != nil {
+		return err
+	}
+
+	var (
+		mu       sync.Mutex
+		stopping bool
+		current  Process
+	)
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		mu.Lock()
+		defer mu.Unlock()
+		stopping = true
+		if current != nil {
+			current.Signal(syscall.SIGTERM)
+		}
+	}()
+
+	if d.TTL > 0 {
+		go d.stopAfterTTL(nil)
+	}
+	if d.Metrics != "" {
+		go d.emitMetrics(nil)
+	}
+
+	var crashes []time.Time
+	for {
+		cmd, err := d.hypervisorCommand()
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		if stopping {
+			mu.Unlock()
+			return nil
+		}
+		p, err := d.startHypervisor(cmd)
+		if err != nil {
+			mu.Unlock()
+			return err
+		}
+		current = p
+		mu.Unlock()
+
+		if !d.backend().writesPidfile() {
+			if err := ioutil.WriteFile(d.pidfilePath(), []byte(strconv.Itoa(p.Pid())), 0644); err != nil {
+				return err
+			}
+		}
+		log.Infof("Started the hypervisor of %s (pid %d)", d.MachineName, p.Pid())
+
+		stopClockSync := make(chan struct{})
+		if d.ClockSyncInterval > 0 {
+			go d.keepClockSynced(stopClockSync)
+		}
+		waitErr := p.Wait()
+		close(stopClockSync)
+		d.logHypervisorExit(waitErr)
+		code := exitStatus(waitErr)
+
+		mu.Lock()
+		stopped := stopping
+		mu.Unlock()
+		if stopped {
+			log.Infof("The hypervisor of %s was stopped", d.MachineName)
+			return nil
+		}
+		if guestShutdownStatuses[code] {
+			log.Infof("The guest of %s powered off", d.MachineName)
+			return nil
+		}
+
+		if reason, crashed := d.crashReason(waitErr); crashed {
+			now := time.Now()
+			crashes = append(crashes, now)
+			for len(crashes) > 0 && now.Sub(crashes[0]) > crashWindow {
+				crashes = crashes[1:]
+			}
+			if len(crashes) >= maxCrashes {
+				d.saveExitStatus(waitErr)
+				return fmt.Errorf("The hypervisor of %s crashed %d times in %s, giving up. Last crash: %s", d.MachineName, len(crashes), crashWindow, reason)
+			}
+
+			log.Warnf("The hypervisor of %s crashed: %s", d.MachineName, reason)
+			status.Restarts++
+			status.LastCrash = reason
+			status.LastRestart = now
+			if err := d.saveSupervisorStatus(status); err != nil {
+				log.Warnf("Could not save the supervisor status: %s", err)
+			}
+			time.Sleep(restartDelay)
+		}
+
+		d.rotateConsoleLog()
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"syscall"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// backgroundTask is a process of the driver binary working for a running
+// machine, started detached so it outlives the driver. It writes its pid to
+// its pidfile in the machine directory while it runs.
+type backgroundTask struct {
+	// command is the argument of the driver binary running the task
+	command string
+	// name names the task in the messages
+	name        string
+	pidFilename string
+	logFilename string
+	// enabled reports whether the machine runs the task
+	enabled func(d *Driver) bool
+	// supervised tasks are run by the supervisor of supervised machines
+	supervised bool
+	// replace stops the task of the previous start, else a running task is
+	// kept
+	replace bool
+	// run runs the task until the machine stops
+	run func(d *Driver) error
+}
+
+// backgroundTasks are the background tasks by command.
+var backgroundTasks = map[string]*backgroundTask{
+	clockSyncTask.command:  clockSyncTask,
+	ttlTask.command:        ttlTask,
+	metricsTask.command:    metricsTask,
+	consoleLogTask.command: consoleLogTask,
+}
+
+// start starts the task t for the machine.
+func (t *backgroundTask) start(d *Driver) error {
+	if !t.enabled(d) || (t.supervised && d.Supervise) {
+		return nil
+	}
+	if pid := t.pid(d); pid > 0 {
+		if !t.replace {
+			return nil
+		}
+		syscall.Kill(pid, syscall.SIGTERM)
+	}
+	pid, err := d.startDetached(t.command, t.logFilename)
+	if err != nil {
+		return fmt.Errorf("Could not start the %s of %s: %s", t.name, d.MachineName, err)
+	}
+	log.Debugf("Started the %s of %s (pid %d)", t.name, d.MachineName, pid)
+	return nil
+}
+
+// pid returns the pid of the running task t of the machine, 0 when there is
+// none.
+func (t *backgroundTask) pid(d *Driver) int {
+	p, err := ioutil.ReadFile(d.ResolveStorePath(t.pidFilename))
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(string(p))
+	if err != nil || !d.isDriverProcess(pid) {
+		return 0
+	}
+	return pid
+}
+
+// IsBackgroundTask reports whether command is the argument of the driver
+// binary running a background task.
+func IsBackgroundTask(command string) bool {
+	_, ok := backgroundTasks[command]
+	return ok
+}
+
+// RunBackgroundTask runs the background task command for the machine
+// configured on r until the machine stops.
+func RunBackgroundTask(command string, r io.Reader) error {
+	t, ok := backgroundTasks[command]
+	if !ok {
+		return fmt.Errorf("Unknown background task %q", command)
+	}
+	d := NewDriver("", "")
+	if err := json.NewDecoder(r).Decode(d); err != nil {
+		return fmt.Errorf("Invalid driver configuration: %s", err)
+	}
+
+	pidPath := d.ResolveStorePath(t.pidFilename)
+	if err := ioutil.WriteFile(pidPath, []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+		return err
+	}
+	defer os.Remove(pidPath)
+
+	return t.run(d)
+}
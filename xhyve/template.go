@@ -0,0 +1,84 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/state"
+)
+
+// loadTemplate reads the stopped template machine the machine is cloned from.
+func (d *Driver) loadTemplate() (*Driver, error) {
+	t, err := loadHostDriver(filepath.Join(d.StorePath, "machines", d.Template))
+	if err != nil {
+		return nil, fmt.Errorf("Could not read the template machine %s: %s", d.Template, err)
+	}
+	if s, err := t.processState(); err == nil && (s == state.Running || s == state.Paused) {
+		return nil, fmt.Errorf("The template machine %s is %s, stop it before cloning it", d.Template, strings.ToLower(s.String()))
+	}
+	return t, nil
+}
+
+// cloneTemplate copies the image, kernel, SSH key and disk of the template
+// machine. The disk is an APFS clone, so the machine starts with the
+// containers and images of the template in no time and space. The CPU count,
+// memory size and UUID of the machine are its own.
+func (d *Driver) cloneTemplate() error {
+	t, err := d.loadTemplate()
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Cloning the template machine %s...", d.Template)
+	d.ImagePreset = t.ImagePreset
+	d.Boot2DockerURL = t.Boot2DockerURL
+	d.ISOChecksum = t.ISOChecksum
+	d.Bootrom = t.Bootrom
+	d.Vmlinuz = t.Vmlinuz
+	d.Initrd = t.Initrd
+	d.BootCmd = renameHost(t.BootCmd, t.hostname(), d.hostname())
+	d.CloudImageURL = t.CloudImageURL
+	d.CloudKernelURL = t.CloudKernelURL
+	d.CloudInitrdURL = t.CloudInitrdURL
+	d.Qcow2 = t.Qcow2
+	d.RawDisk = t.RawDisk
+	d.DiskSize = t.DiskSize
+	d.SSHUser = t.SSHUser
+	d.SSHPort = t.SSHPort
+	d.SSHAgent = t.SSHAgent
+
+	files := map[string]string{
+		t.diskImagePath():                      d.diskImagePath(),
+		t.privateSSHKeyPath():                  d.privateSSHKeyPath(),
+		t.publicSSHKeyPath():                   d.publicSSHKeyPath(),
+		t.ResolveStorePath(isoFilename):        d.ResolveStorePath(isoFilename),
+		t.ResolveStorePath(vzEFIVariableStore): d.ResolveStorePath(vzEFIVariableStore),
+	}
+	if t.Vmlinuz != "" {
+		files[t.ResolveStorePath(t.Vmlinuz)] = d.ResolveStorePath(d.Vmlinuz)
+	}
+	if t.Initrd != "" {
+		files[t.ResolveStorePath(t.Initrd)] = d.ResolveStorePath(d.Initrd)
+	}
+	for src, dst := range files {
+		if _, err := os.Stat(src); err != nil {
+			continue
+		}
+		if err := d.cloneFile(src, dst); err != nil {
+			return err
+		}
+	}
+
+	if _, err := os.Stat(d.diskImagePath()); err != nil {
+		return fmt.Errorf("The template machine %s has no disk image", d.Template)
+	}
+	d.ArtifactName = d.MachineName
+	return nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// cpuTopology is the CPU topology of the guest.
+type cpuTopology struct {
+	sockets, cores, threads int
+}
+
+func (t cpuTopology) cpus() int {
+	return t.sockets * t.cores * t.threads
+}
+
+// String returns the topology as the -c argument of xhyve.
+func (t cpuTopology) String() string {
+	return fmt.Sprintf("cpus=%d,sockets=%d,cores=%d,threads=%d", t.cpus(), t.sockets, t.cores, t.threads)
+}
+
+// parseCPUTopology parses the --xhyve-cpu-topology value, like
+// "sockets=1,cores=2,threads=2", for a machine of cpus CPUs. Cores and
+// threads default to 1, the sockets to the number of CPUs they make up, or
+// to 1 when cpus is 0: the topology then gives the CPU count.
+func parseCPUTopology(s string, cpus int) (cpuTopology, error) {
+	t := cpuTopology{cores: 1, threads: 1}
+	for _, field := range strings.Split(s, ",") {
+		kv := strings.SplitN(field, "=", 2)
+		n, err := strconv.Atoi(kv[len(kv)-1])
+		if len(kv) != 2 || err != nil || n < 1 {
+			return t, fmt.Errorf("Invalid --xhyve-cpu-topology %q, must be like sockets=1,cores=2,threads=2", s)
+		}
+		switch kv[0] {
+		case "sockets":
+			t.sockets = n
+		case "cores":
+			t.cores = n
+		case "threads":
+			t.threads = n
+		default:
+			return t, fmt.Errorf("Invalid --xhyve-cpu-topology %q, %q is not sockets, cores or threads", s, kv[0])
+		}
+	}
+	if t.sockets == 0 && cpus == 0 {
+		t.sockets = 1
+	}
+	if t.sockets == 0 {
+		if cpus%(t.cores*t.threads) != 0 {
+			return t, fmt.Errorf("--xhyve-cpu-topology %q does not divide the %d CPUs of the machine", s, cpus)
+		}
+		t.sockets = cpus / (t.cores * t.threads)
+	}
+	return t, nil
+}
+
+// cpuArg returns the -c argument of xhyve: the number of CPUs, or the
+// topology giving it.
+func (d *Driver) cpuArg() string {
+	if d.CPUTopology != "" {
+		return d.CPUTopology
+	}
+	return strconv.Itoa(d.CPU)
+}
@@ -0,0 +1,90 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/state"
+)
+
+const (
+	ttlPidFilename = "ttl.pid"
+	ttlLogFilename = "ttl.log"
+)
+
+// parseTTL parses the --xhyve-ttl duration into seconds, "" and "0" disable
+// it.
+func parseTTL(s string) (int, error) {
+	if s == "" || s == "0" {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(s)
+	if err != nil || ttl < time.Second {
+		return 0, fmt.Errorf("--xhyve-ttl must be a duration like 90m or 8h, got %q", s)
+	}
+	return int(ttl / time.Second), nil
+}
+
+// ttlExpired reports whether the TTL of the machine started at started ran
+// out at now. It goes by the wall clock, the time the Mac slept counts.
+func (d *Driver) ttlExpired(started, now time.Time) bool {
+	return !now.Round(0).Before(started.Round(0).Add(time.Duration(d.TTL) * time.Second))
+}
+
+// stopAfterTTL stops the machine TTL seconds after it started. It returns
+// when the machine stops, or when stop is closed. The supervisor, which
+// outlives the restarts of the hypervisor, only has it return after the stop.
+func (d *Driver) stopAfterTTL(stop <-chan struct{}) {
+	ticker := time.NewTicker(clockCheckInterval)
+	defer ticker.Stop()
+
+	started := time.Now()
+	log.Infof("%s will be stopped at %s", d.MachineName, started.Add(time.Duration(d.TTL)*time.Second).Format(time.RFC3339))
+	running := false
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		s, err := d.processState()
+		if !d.Supervise && (err != nil || (s != state.Running && s != state.Paused)) {
+			// the hypervisor may not have written its pidfile yet
+			if running || time.Since(started) > time.Duration(d.BootTimeout)*time.Second {
+				return
+			}
+			continue
+		}
+		running = true
+
+		if d.ttlExpired(started, time.Now()) {
+			log.Infof("The TTL of %s ran out, stopping it", d.MachineName)
+			if err := d.Stop(); err != nil {
+				log.Warnf("Could not stop %s: %s", d.MachineName, err)
+			}
+			return
+		}
+	}
+}
+
+// ttlTask stops the machine once its TTL runs out, in place of the one of
+// the previous start.
+var ttlTask = &backgroundTask{
+	command:     "ttl",
+	name:        "TTL",
+	pidFilename: ttlPidFilename,
+	logFilename: ttlLogFilename,
+	enabled:     func(d *Driver) bool { return d.TTL != 0 },
+	supervised:  true,
+	replace:     true,
+	run: func(d *Driver) error {
+		d.stopAfterTTL(nil)
+		return nil
+	},
+}
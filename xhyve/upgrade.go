@@ -0,0 +1,30 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"github.com/docker/machine/libmachine/log"
+	"github.com/zchee/docker-machine-driver-xhyve/b2d"
+)
+
+// refreshKernel re-extracts the kernel and initrd when the ISO of the machine
+// changed since they were extracted, like after "docker-machine upgrade".
+// Machines created before the checksum was saved are refreshed once.
+func (d *Driver) refreshKernel() error {
+	if d.Bootrom != "" || d.preset().cloudImage || d.Hypervisor == hypervisorFake {
+		return nil
+	}
+
+	sum, err := b2d.Checksum(d.ResolveStorePath(isoFilename))
+	if err != nil {
+		return err
+	}
+	if sum == d.ISOChecksum {
+		return nil
+	}
+
+	log.Infof("%s changed, extracting its kernel...", isoFilename)
+	return d.extractKernelImages()
+}
@@ -0,0 +1,392 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/state"
+)
+
+// boot2docker only reads the first 4KB of the disk for the userdata.tar,
+// which the SSH keys fill. The complete bundle is installed over SSH after the
+// first boot, in place of the one saved by boot2docker, and is extracted to
+// /home/docker at every boot, before bootsync.sh runs.
+const (
+	guestUserdataPath   = "/var/lib/boot2docker/userdata.tar"
+	guestBootsyncPath   = "/var/lib/boot2docker/bootsync.sh"
+	guestBootlocalPath  = "/var/lib/boot2docker/bootlocal.sh"
+	guestProxyPath      = "/var/lib/boot2docker/xhyve-proxy"
+	guestDockerInitPath = "/etc/init.d/docker"
+	guestHomeDir        = "/home/docker"
+	guestCertsDir       = "/etc/docker/certs.d"
+	guestDaemonJSON     = "/etc/docker/daemon.json"
+	guestHostsPath      = "/etc/hosts"
+	guestResolvConfPath = "/etc/resolv.conf"
+
+	// userdataDir keeps the files of the bundle the boot hook installs
+	// outside of /home/docker, at their path under userdataDir/rootfs.
+	userdataDir = ".xhyve"
+	// userBootsync is the --xhyve-bootsync script in the bundle, run by the
+	// boot hook, which takes the place of bootsync.sh.
+	userBootsync = userdataDir + "/bootsync.sh"
+	// bootHookMarker ends the lines the boot hook adds to the guest files.
+	bootHookMarker = "# docker-machine-driver-xhyve"
+)
+
+// machineDaemonOptions are the options of the docker daemon docker-machine
+// always passes as flags. dockerd refuses to start when daemon.json sets them
+// too.
+var machineDaemonOptions = []string{"hosts", "labels", "storage-driver", "tls", "tlscacert", "tlscert", "tlskey", "tlsverify"}
+
+// engineFlags are the docker-machine create flags setting the
+// machineDaemonOptions the user chooses.
+var engineFlags = map[string]string{
+	"labels":         "--engine-label",
+	"storage-driver": "--engine-storage-driver",
+}
+
+// userdataFile is a file of the userdata bundle.
+type userdataFile struct {
+	// name is the path of the file relative to /home/docker.
+	name string
+	mode int64
+	data []byte
+}
+
+// rootFile returns the userdata file installed at the absolute guest path by
+// the boot hook.
+func rootFile(guestPath string, mode int64, data []byte) userdataFile {
+	return userdataFile{path.Join(userdataDir, "rootfs", guestPath), mode, data}
+}
+
+// userdataFiles returns the files added to the userdata bundle by the flags.
+func (d *Driver) userdataFiles() ([]userdataFile, error) {
+	var files []userdataFile
+	for _, ca := range d.RegistryCAs {
+		registry, caPath, err := parseRegistryCA(ca)
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadFile(caPath)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read the CA certificate of %s: %s", registry, err)
+		}
+		files = append(files, rootFile(path.Join(guestCertsDir, registry, "ca.crt"), 0644, data))
+	}
+	if d.DaemonJSON != "" {
+		data, err := ioutil.ReadFile(d.DaemonJSON)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, rootFile(guestDaemonJSON, 0644, data))
+	}
+	scripts := []struct{ hostPath, name string }{
+		{d.Bootsync, userBootsync},
+		{d.Bootlocal, path.Join(userdataDir, "rootfs", guestBootlocalPath)},
+	}
+	for _, s := range scripts {
+		if s.hostPath == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(s.hostPath)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, userdataFile{s.name, 0755, data})
+	}
+	for _, f := range d.UserdataFiles {
+		hostPath, guestPath, err := parseUserdataFile(f)
+		if err != nil {
+			return nil, err
+		}
+		fi, err := os.Stat(hostPath)
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadFile(hostPath)
+		if err != nil {
+			return nil, err
+		}
+		if path.IsAbs(guestPath) {
+			files = append(files, rootFile(guestPath, int64(fi.Mode().Perm()), data))
+		} else {
+			files = append(files, userdataFile{guestPath, int64(fi.Mode().Perm()), data})
+		}
+	}
+	return files, nil
+}
+
+// parseUserdataFile splits a --xhyve-userdata-file host:guest value. Relative
+// guest paths are in /home/docker.
+func parseUserdataFile(value string) (string, string, error) {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("Invalid --xhyve-userdata-file %q, must be /host/path:guest/path", value)
+	}
+	guestPath := path.Clean(parts[1])
+	if guestPath == "/" || guestPath == "." || guestPath == ".." || strings.HasPrefix(guestPath, "../") {
+		return "", "", fmt.Errorf("Invalid guest path %q of --xhyve-userdata-file", parts[1])
+	}
+	return parts[0], guestPath, nil
+}
+
+// parseRegistryCA splits a --xhyve-registry-ca registry=path value.
+func parseRegistryCA(value string) (string, string, error) {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.ContainsAny(parts[0], "/ ") {
+		return "", "", fmt.Errorf("Invalid --xhyve-registry-ca %q, must be registry[:port]=/path/to/ca.crt", value)
+	}
+	return parts[0], parts[1], nil
+}
+
+// hasUserdata reports whether the machine needs the complete userdata bundle
+// and the boot hook.
+func (d *Driver) hasUserdata() bool {
+	return len(d.ProxyEnv) > 0 || len(d.RegistryCAs) > 0 || len(d.UserdataFiles) > 0 ||
+		d.Bootsync != "" || d.Bootlocal != "" || d.DaemonJSON != "" || len(d.HostEntries) > 0 ||
+		len(d.DNSServers) > 0
+}
+
+// bootHook returns the bootsync.sh installing the files of the bundle, the
+// proxy settings, the host entries and the name servers before docker
+// starts, then running the --xhyve-bootsync script. docker-machine rewrites
+// the profile when provisioning docker, so the proxy settings are kept in a
+// file of their own, which the init script of docker sources at every start
+// of the daemon.
+func (d *Driver) bootHook() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "#!/bin/sh\n%s, runs before docker at every boot\n", bootHookMarker)
+	fmt.Fprintf(&buf, "if [ -d %[1]s/rootfs ]; then cp -R %[1]s/rootfs/. /; fi\n", path.Join(guestHomeDir, userdataDir))
+	if len(d.ProxyEnv) > 0 {
+		buf.WriteString("{ ")
+		for _, env := range d.ProxyEnv {
+			fmt.Fprintf(&buf, "echo %s; ", shellQuote("export "+shellQuote(env)))
+		}
+		fmt.Fprintf(&buf, "} > %s\n", guestProxyPath)
+		// the root filesystem is new at every boot, the init script is
+		// patched again
+		fmt.Fprintf(&buf, "grep -q '%[2]s$' %[1]s || sed -i '1a . %[3]s %[2]s' %[1]s\n", guestDockerInitPath, bootHookMarker, guestProxyPath)
+	} else {
+		fmt.Fprintf(&buf, "rm -f %s\n", guestProxyPath)
+	}
+	var hosts []string
+	for _, entry := range d.HostEntries {
+		if ip, name, err := parseHostEntry(entry); err == nil {
+			hosts = append(hosts, ip+" "+name)
+		}
+	}
+	appendGuestLines(&buf, guestHostsPath, hosts)
+	// the resolv.conf of the DHCP client is new at every boot, the name
+	// servers are put first so they are queried before the DHCP ones, once
+	// the DHCP client running in the background wrote it
+	if len(d.DNSServers) > 0 {
+		fmt.Fprintf(&buf, "for i in $(seq 10); do grep -q nameserver %s && break; sleep 1; done\n", guestResolvConfPath)
+		buf.WriteString("{ ")
+		for _, server := range d.DNSServers {
+			fmt.Fprintf(&buf, "echo nameserver %s; ", server)
+		}
+		fmt.Fprintf(&buf, "cat %[1]s; } > %[1]s.new && mv %[1]s.new %[1]s\n", guestResolvConfPath)
+	}
+	if d.Bootsync != "" {
+		fmt.Fprintf(&buf, "/bin/sh %s\n", path.Join(guestHomeDir, userBootsync))
+	}
+	return buf.Bytes()
+}
+
+// appendGuestLines writes the boot hook commands replacing the lines it added
+// to the guest file at the previous boot with lines.
+func appendGuestLines(buf *bytes.Buffer, guestPath string, lines []string) {
+	if len(lines) == 0 {
+		return
+	}
+	fmt.Fprintf(buf, "touch %[1]s\nsed -i '/%[2]s$/d' %[1]s\n", guestPath, bootHookMarker)
+	for _, line := range lines {
+		fmt.Fprintf(buf, "echo %s >> %s\n", shellQuote(line+" "+bootHookMarker), guestPath)
+	}
+}
+
+// parseHostEntry splits a --xhyve-host-entry ip:name value. The name is after
+// the last colon, IPv6 addresses have some.
+func parseHostEntry(value string) (string, string, error) {
+	i := strings.LastIndex(value, ":")
+	if i < 0 || net.ParseIP(value[:i]) == nil || value[i+1:] == "" || strings.ContainsAny(value[i+1:], " \t#") {
+		return "", "", fmt.Errorf("Invalid --xhyve-host-entry %q, must be ip:name", value)
+	}
+	return value[:i], value[i+1:], nil
+}
+
+// validateUserdata checks the flags of the userdata bundle can be used, only
+// boot2docker reads it and the disk of templates is cloned with theirs.
+func (d *Driver) validateUserdata() error {
+	if !d.hasUserdata() {
+		return nil
+	}
+	if d.ImagePreset != presetBoot2Docker {
+		return fmt.Errorf("The userdata flags are only supported by the %s image preset", presetBoot2Docker)
+	}
+	if d.Template != "" {
+		return fmt.Errorf("The userdata flags can not be used with --xhyve-template, the disk of the template is cloned")
+	}
+	for _, ca := range d.RegistryCAs {
+		_, caPath, err := parseRegistryCA(ca)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(caPath); err != nil {
+			return fmt.Errorf("Could not read the --xhyve-registry-ca certificate: %s", err)
+		}
+	}
+	for _, f := range d.UserdataFiles {
+		hostPath, _, err := parseUserdataFile(f)
+		if err != nil {
+			return err
+		}
+		if fi, err := os.Stat(hostPath); err != nil {
+			return fmt.Errorf("Could not read the --xhyve-userdata-file: %s", err)
+		} else if !fi.Mode().IsRegular() {
+			return fmt.Errorf("The --xhyve-userdata-file %s is not a regular file", hostPath)
+		}
+		if err := checkPrivateFile(hostPath, "--xhyve-userdata-file", userdataModeMask); err != nil {
+			return err
+		}
+	}
+	for _, entry := range d.HostEntries {
+		if _, _, err := parseHostEntry(entry); err != nil {
+			return err
+		}
+	}
+	for _, server := range d.DNSServers {
+		if net.ParseIP(server) == nil {
+			return fmt.Errorf("Invalid --xhyve-dns %q, must be an IP address", server)
+		}
+	}
+	if d.DaemonJSON != "" {
+		if err := validateDaemonJSON(d.DaemonJSON); err != nil {
+			return err
+		}
+	}
+	for _, s := range []struct{ flag, script string }{{"--xhyve-bootsync", d.Bootsync}, {"--xhyve-bootlocal", d.Bootlocal}} {
+		if s.script == "" {
+			continue
+		}
+		if _, err := os.Stat(s.script); err != nil {
+			return fmt.Errorf("Could not read the %s script: %s", s.flag, err)
+		}
+		if err := checkPrivateFile(s.script, s.flag+" script", scriptModeMask); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateDaemonJSON checks the --xhyve-daemon-json file is a JSON object
+// which does not set the options docker-machine passes as flags.
+func validateDaemonJSON(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("Could not read the --xhyve-daemon-json: %s", err)
+	}
+	var config map[string]interface{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("The --xhyve-daemon-json %s is not a JSON object: %s", file, err)
+	}
+	for _, option := range machineDaemonOptions {
+		if _, ok := config[option]; !ok {
+			continue
+		}
+		if flag, ok := engineFlags[option]; ok {
+			return fmt.Errorf("The --xhyve-daemon-json %s sets %q, which docker-machine passes to the docker daemon as a flag. Set it with %s instead", file, option, flag)
+		}
+		return fmt.Errorf("The --xhyve-daemon-json %s sets %q, which docker-machine passes to the docker daemon as a flag", file, option)
+	}
+	return nil
+}
+
+// writeGuestFile returns the shell command writing data to the guest path.
+func writeGuestFile(guestPath string, data []byte) string {
+	return fmt.Sprintf("echo %s | base64 -d | sudo tee %s > /dev/null", base64.StdEncoding.EncodeToString(data), guestPath)
+}
+
+// installUserdata installs the complete userdata bundle and the boot hook in
+// the boot2docker guest, and runs the hook for this first boot.
+func (d *Driver) installUserdata() error {
+	if !d.hasUserdata() {
+		return nil
+	}
+
+	// resuming after a failure restarts the machine
+	if s, err := d.processState(); err == nil && s != state.Running {
+		if err := d.launch(); err != nil {
+			return err
+		}
+		if err := d.waitForIP(); err != nil {
+			return err
+		}
+	}
+
+	files, err := d.userdataFiles()
+	if err != nil {
+		return err
+	}
+	bundle, err := d.generateKeyBundle(files...)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Installing the userdata bundle...")
+	cmds := []string{
+		writeGuestFile(guestUserdataPath, bundle.Bytes()),
+		fmt.Sprintf("sudo tar xf %s -C %s", guestUserdataPath, guestHomeDir),
+		fmt.Sprintf("sudo rm -f %s", shellQuote(path.Join(guestHomeDir, magicString))),
+		fmt.Sprintf("sudo chown -R docker:staff %s", guestHomeDir),
+		writeGuestFile(guestBootsyncPath, d.bootHook()),
+		fmt.Sprintf("sudo chmod 755 %s", guestBootsyncPath),
+		fmt.Sprintf("sudo sh %s", guestBootsyncPath),
+	}
+	// boot2docker runs bootlocal.sh in the background once docker started
+	if d.Bootlocal != "" {
+		cmds = append(cmds, fmt.Sprintf("sudo sh -c %s", shellQuote(fmt.Sprintf("/bin/sh %s > /var/log/bootlocal.log 2>&1 &", guestBootlocalPath))))
+	}
+	if out, err := d.runSSHCommand(strings.Join(cmds, " && ")); err != nil {
+		return fmt.Errorf("Could not install the userdata bundle: %s: %s", err, strings.TrimSpace(out))
+	}
+	return nil
+}
+
+// addUserdataFiles adds files to the userdata tarball tw, creating their
+// parent directories.
+func addUserdataFiles(tw *tar.Writer, files []userdataFile) error {
+	dirs := map[string]bool{".": true, ".ssh": true}
+	for _, f := range files {
+		var parents []string
+		for dir := path.Dir(f.name); !dirs[dir]; dir = path.Dir(dir) {
+			dirs[dir] = true
+			parents = append([]string{dir}, parents...)
+		}
+		for _, dir := range parents {
+			if err := tw.WriteHeader(&tar.Header{Name: dir + "/", Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+				return err
+			}
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Size: int64(len(f.data)), Mode: f.mode}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
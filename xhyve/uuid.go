@@ -4,26 +4,68 @@
 
 package xhyve
 
-/*
-#include <stdio.h>
-#include <uuid/uuid.h>
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"fmt"
+	"regexp"
+	"strings"
+)
 
-char uuid_str[37];
+// uuidgen returns a random (version 4) UUID in upper case, like
+// uuid_generate_random and uuid_unparse_upper of libSystem.
+func uuidgen() (string, error) {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		return "", fmt.Errorf("Could not generate a UUID: %s", err)
+	}
+	u[6] = u[6]&0x0f | 0x40 // version 4
+	u[8] = u[8]&0x3f | 0x80 // RFC 4122 variant
+	return formatUUID(u), nil
+}
+
+// machineUUIDNamespace is the namespace of the UUIDs derived from machine
+// names.
+var machineUUIDNamespace = [16]byte{0x8c, 0x3e, 0x5f, 0x21, 0x4a, 0x7d, 0x4e, 0x0b, 0x9d, 0x52, 0x6f, 0x1a, 0xe4, 0x37, 0xb0, 0x96}
 
-extern inline char* uuidgen() {
-	uuid_t uuid;
+// nameUUID returns the name-based (version 5) UUID of the machine name, so
+// that a machine created again with the same name gets the same UUID, MAC
+// address and DHCP lease.
+func nameUUID(name string) string {
+	h := sha1.New()
+	h.Write(machineUUIDNamespace[:])
+	h.Write([]byte(name))
+	var u [16]byte
+	copy(u[:], h.Sum(nil))
+	u[6] = u[6]&0x0f | 0x50 // version 5
+	u[8] = u[8]&0x3f | 0x80 // RFC 4122 variant
+	return formatUUID(u)
+}
 
-	// generate with random
-	uuid_generate_random(uuid);
+func formatUUID(u [16]byte) string {
+	return fmt.Sprintf("%X-%X-%X-%X-%X", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
 
-	// unparse (to string)
-	uuid_unparse_upper(uuid, uuid_str);
+var uuidRegexp = regexp.MustCompile(`^[0-9A-Fa-f]{8}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{12}$`)
 
-	return uuid_str;
+// validateUUID checks the --xhyve-uuid is a UUID xhyve and vmnet accept.
+func validateUUID(uuid string) error {
+	if !uuidRegexp.MatchString(uuid) {
+		return fmt.Errorf("--xhyve-uuid must be a UUID like 2B5D1E0C-0F0C-4B0A-9A3A-0D6B0B5A1E2F, got %q", uuid)
+	}
+	return nil
 }
-*/
-import "C"
 
-func uuidgen() string {
-	return C.GoString(C.uuidgen())
+// checkUUIDConflict makes sure no other machine of the store uses the UUID
+// of the machine, vmnet would give both the same MAC and IP addresses.
+func (d *Driver) checkUUIDConflict() error {
+	if d.UUID == "" {
+		return nil
+	}
+	for name, m := range storeMachines(d.StorePath) {
+		if name != d.MachineName && strings.EqualFold(m.UUID, d.UUID) {
+			return fmt.Errorf("The UUID %s is already used by the machine %s", d.UUID, name)
+		}
+	}
+	return nil
 }
@@ -10,4 +10,8 @@ var (
 
 	// GitCommit will be overwritten automatically by the build system
 	GitCommit = "HEAD"
+
+	// HypervisorVersion is the hyperkit revision the embedded xhyve is built
+	// from, see the VERSION cflag of github.com/zchee/libhyperkit
+	HypervisorVersion = "2db2b2c"
 )
@@ -0,0 +1,215 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/log"
+)
+
+const (
+	// virtualBoxDriverName is the docker-machine driver of VirtualBox
+	virtualBoxDriverName = "virtualbox"
+
+	// virtualBoxDiskFilename is the disk image of a VirtualBox machine
+	virtualBoxDiskFilename = "disk.vmdk"
+
+	// virtualBoxBackupDir keeps the VirtualBox machines migrated under their
+	// own name, out of the machines of the store.
+	virtualBoxBackupDir = "virtualbox-machines"
+)
+
+// virtualBoxMachine is the part of the host configuration of a VirtualBox
+// machine carried over to xhyve.
+type virtualBoxMachine struct {
+	DriverName string
+	Driver     struct {
+		CPU            int
+		Memory         int
+		DiskSize       int
+		Boot2DockerURL string
+	}
+}
+
+// readVirtualBoxMachine reads the host configuration of the VirtualBox
+// machine directory dir.
+func readVirtualBoxMachine(dir string) ([]byte, *virtualBoxMachine, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, hostConfigFilename))
+	if err != nil {
+		return nil, nil, err
+	}
+	var m virtualBoxMachine
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, nil, fmt.Errorf("Could not read %s: %s", filepath.Join(dir, hostConfigFilename), err)
+	}
+	if m.DriverName != virtualBoxDriverName {
+		return nil, nil, fmt.Errorf("%s is a %s machine, not a %s one", filepath.Base(dir), m.DriverName, virtualBoxDriverName)
+	}
+	return data, &m, nil
+}
+
+// virtualBoxFlags returns the create flags of the xhyve machine equivalent
+// to the VirtualBox machine m of the directory dir: its CPUs, memory and
+// disk size, its boot2docker ISO, disk and SSH key.
+func virtualBoxFlags(dir string, m *virtualBoxMachine) map[string]interface{} {
+	flags := map[string]interface{}{
+		"xhyve-import-disk": filepath.Join(dir, virtualBoxDiskFilename),
+		"xhyve-ssh-key":     filepath.Join(dir, "id_rsa"),
+	}
+	if m.Driver.CPU > 0 {
+		flags["xhyve-cpu-count"] = m.Driver.CPU
+	}
+	if m.Driver.Memory > 0 {
+		flags["xhyve-memory-size"] = strconv.Itoa(m.Driver.Memory)
+	}
+	if m.Driver.DiskSize > 0 {
+		flags["xhyve-disk-size"] = strconv.Itoa(m.Driver.DiskSize)
+	}
+	// the ISO of the machine boots the kernel its disk was provisioned for
+	if iso := filepath.Join(dir, isoFilename); fileExists(iso) {
+		flags["xhyve-boot2docker-url"] = iso
+	} else if m.Driver.Boot2DockerURL != "" {
+		flags["xhyve-boot2docker-url"] = m.Driver.Boot2DockerURL
+	}
+	return flags
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// virtualBoxRunning reports whether the VirtualBox VM name is running, false
+// when VBoxManage is not installed.
+func (d *Driver) virtualBoxRunning(name string) bool {
+	bin, err := exec.LookPath("VBoxManage")
+	if err != nil {
+		return false
+	}
+	out, err := d.commands().CombinedOutput(exec.Command(bin, "showvminfo", name, "--machinereadable"))
+	if err != nil {
+		log.Debugf("Could not read the state of the VirtualBox VM %s: %s", name, strings.TrimSpace(string(out)))
+		return false
+	}
+	return strings.Contains(string(out), `VMState="running"`)
+}
+
+// MigrateVirtualBox replaces the stopped VirtualBox machine name of the
+// docker-machine store storePath with the xhyve machine newName: its disk is
+// converted, its SSH key and certificates carried over, and its CPUs, memory
+// and disk size kept, so its images and volumes are kept. The xhyve machine
+// is created and started.
+//
+// The VirtualBox machine is left as it is, or moved to virtualbox-machines in
+// the store when newName is its own name, to be removed once the xhyve
+// machine is checked.
+func MigrateVirtualBox(storePath, name, newName string) (err error) {
+	vboxDir := filepath.Join(storePath, "machines", name)
+	data, m, err := readVirtualBoxMachine(vboxDir)
+	if err != nil {
+		return err
+	}
+	d := NewDriver(newName, storePath)
+	if d.virtualBoxRunning(name) {
+		return fmt.Errorf("Stop %s before migrating it", name)
+	}
+
+	srcDir := vboxDir
+	if newName == name {
+		srcDir = filepath.Join(storePath, virtualBoxBackupDir, name)
+		if fileExists(srcDir) {
+			return fmt.Errorf("A VirtualBox machine %s was already migrated, remove %s first", name, srcDir)
+		}
+		if err := os.MkdirAll(filepath.Dir(srcDir), 0700); err != nil {
+			return err
+		}
+		if err := os.Rename(vboxDir, srcDir); err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				os.Rename(srcDir, vboxDir)
+			}
+		}()
+	} else if fileExists(d.ResolveStorePath(".")) {
+		return fmt.Errorf("Machine %s already exists", newName)
+	}
+
+	log.Infof("Migrating the VirtualBox machine %s to the xhyve machine %s...", name, newName)
+	if err := d.SetConfigFromFlags(&drivers.CheckDriverOptions{
+		FlagsValues: virtualBoxFlags(srcDir, m),
+		CreateFlags: d.GetCreateFlags(),
+	}); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(d.ResolveStorePath("."), 0700); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(d.ResolveStorePath("."))
+		}
+	}()
+	if err := copyCerts(srcDir, d.ResolveStorePath(".")); err != nil {
+		return err
+	}
+	if err := d.Create(); err != nil {
+		return err
+	}
+	if err := writeMigratedHostConfig(data, vboxDir, d); err != nil {
+		return err
+	}
+
+	log.Infof("Run \"docker-machine regenerate-certs %s\", its IP address changed", newName)
+	log.Infof("The VirtualBox machine is kept in %s, remove it with \"VBoxManage unregistervm %s --delete\" once %s works", srcDir, name, newName)
+	return nil
+}
+
+// copyCerts copies the TLS certificates and keys of the machine directory
+// src to dst.
+func copyCerts(src, dst string) error {
+	certs, _ := filepath.Glob(filepath.Join(src, "*.pem"))
+	for _, cert := range certs {
+		data, err := ioutil.ReadFile(cert)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dst, filepath.Base(cert)), data, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeMigratedHostConfig registers the xhyve machine d migrated from the
+// VirtualBox machine of the host configuration data and directory vboxDir:
+// its engine, swarm and TLS options are kept, moved to the directory of d.
+func writeMigratedHostConfig(data []byte, vboxDir string, d *Driver) error {
+	var config map[string]interface{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return err
+	}
+	relocateAuthOptions(config, func(path string) string {
+		return relocatePath(path, vboxDir, d.ResolveStorePath("."))
+	})
+	config["Name"] = d.MachineName
+	config["DriverName"] = d.DriverName()
+	config["Driver"] = d
+
+	out, err := json.MarshalIndent(config, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(d.ResolveStorePath(hostConfigFilename), out, 0600)
+}
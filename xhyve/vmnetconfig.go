@@ -0,0 +1,59 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/zchee/docker-machine-driver-xhyve/vmnet"
+)
+
+func init() {
+	// the defaults commands reading the vmnet configuration are traced
+	vmnet.Output = func(cmd *exec.Cmd) ([]byte, error) {
+		return commandOutput(execRunner{}, cmd)
+	}
+}
+
+// checkVmnetConfig makes sure the vmnet configuration is not corrupted, and
+// explains how to repair it.
+func (d *Driver) checkVmnetConfig() error {
+	if d.Hypervisor == hypervisorVZ || d.Hypervisor == hypervisorFake {
+		// neither Virtualization.framework nor the fake machine read the
+		// vmnet configuration
+		return nil
+	}
+	if err := vmnet.CheckConfig(); err != nil {
+		return fmt.Errorf("The vmnet configuration is corrupted, the machines would get no IP address: %s.\n"+
+			"\tStop all the machines, then repair it with\n"+
+			"\t%s repair-vmnet", err, d.driverBinary())
+	}
+	return nil
+}
+
+// RepairVmnet removes a corrupted vmnet configuration, vmnet writes it again
+// with its defaults when the next machine starts. It writes what it does to w.
+// It runs sudo, which may prompt for the password.
+func RepairVmnet(w io.Writer) error {
+	err := vmnet.CheckConfig()
+	if err == nil {
+		fmt.Fprintf(w, "The vmnet configuration is valid\n")
+		return nil
+	}
+	fmt.Fprintf(w, "The vmnet configuration is corrupted: %s\n", err)
+
+	plist := vmnet.CONFIG_PLIST + ".plist"
+	fmt.Fprintf(w, "Removing %s...\n", plist)
+	cmd := exec.Command("sudo", "rm", "-f", plist)
+	cmd.Stdin = os.Stdin
+	if out, err := (execRunner{}).CombinedOutput(cmd); err != nil {
+		return fmt.Errorf("Could not remove %s: %s %s", plist, err, out)
+	}
+	fmt.Fprintf(w, "vmnet writes its default configuration when the next machine starts\n")
+	return nil
+}
@@ -0,0 +1,133 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// hypervisorVZ runs the machine with Apple's Virtualization.framework
+	// through the vfkit command line tool. It is the only backend working on
+	// macOS 11+ Apple Silicon Macs.
+	hypervisorVZ = "vz"
+
+	// vzConsole is the guest device backed by the virtio console.
+	vzConsole = "console=hvc0"
+
+	// vzEFIVariableStore keeps the EFI variables of machines booted with
+	// --xhyve-bootrom.
+	vzEFIVariableStore = "efi-variable-store"
+)
+
+// Virtualization.framework with Linux guests needs macOS 11.
+var minVZMacOSVersion = []int{11}
+
+func init() {
+	backends[hypervisorVZ] = vzBackend{}
+}
+
+// vzBackend runs the machine with Virtualization.framework through vfkit.
+// Virtualization.framework boots the kernel directly and only supports raw
+// disk images, the boot2docker ISO is not attached.
+type vzBackend struct{}
+
+func (vzBackend) command(d *Driver, args []string) (*exec.Cmd, error) {
+	bin, err := exec.LookPath(d.vfkitBinary())
+	if err != nil {
+		return nil, fmt.Errorf("vfkit not found, install it or use --xhyve-vfkit-path: %s", err)
+	}
+
+	mac, err := macFromUUID(d.UUID)
+	if err != nil {
+		return nil, err
+	}
+
+	bootloader := fmt.Sprintf("linux,kernel=%s,initrd=%s,cmdline=%q",
+		d.ResolveStorePath(d.Vmlinuz), d.ResolveStorePath(d.Initrd), d.kernelCmdline())
+	if d.Bootrom != "" {
+		// Virtualization.framework has its own EFI firmware
+		bootloader = fmt.Sprintf("efi,variable-store=%s,create", d.ResolveStorePath(vzEFIVariableStore))
+	}
+
+	vzArgs := []string{
+		"--cpus", fmt.Sprintf("%d", d.CPU),
+		"--memory", fmt.Sprintf("%d", d.Memory),
+		"--bootloader", bootloader,
+		"--device", fmt.Sprintf("virtio-blk,path=%s", d.rawDiskPath()),
+		"--device", fmt.Sprintf("virtio-net,nat,mac=%s", mac),
+		"--device", fmt.Sprintf("virtio-serial,logFilePath=%s", d.consoleLogPath()),
+		"--device", "virtio-rng",
+	}
+	if d.Bootrom != "" {
+		vzArgs = append(vzArgs, "--device", fmt.Sprintf("usb-mass-storage,path=%s", d.ResolveStorePath(isoFilename)))
+	}
+	if d.preset().seed != nil {
+		vzArgs = append(vzArgs, "--device", fmt.Sprintf("virtio-blk,path=%s", d.seedISOPath()))
+	}
+	for i, share := range d.Virtio9p {
+		vzArgs = append(vzArgs, "--device", fmt.Sprintf("virtio-fs,sharedDir=%s,mountTag=host-%d", filepath.Clean(share), i))
+	}
+
+	extra, _ := splitExtraArgs(d.ExtraArgs)
+	vzArgs = append(vzArgs, extra...)
+
+	return exec.Command(bin, vzArgs...), nil
+}
+
+// macAddress returns the MAC address handed to vfkit. Virtualization.framework
+// does not derive it from the UUID, so the driver does.
+func (vzBackend) macAddress(d *Driver) (string, error) {
+	return macFromUUID(d.UUID)
+}
+
+func (vzBackend) processName(d *Driver) string { return "vfkit" }
+
+func (vzBackend) version(d *Driver) (string, error) {
+	out, err := d.commands().Output(exec.Command(d.vfkitBinary(), "--version"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func (vzBackend) writesPidfile() bool { return false }
+
+// checkVZKernel refuses to boot the boot2docker releases with vz on Apple
+// Silicon: they only have an x86_64 kernel, which Virtualization.framework
+// can only boot on Intel Macs. An image, a kernel or a firmware of the user
+// is trusted to be built for the host CPU.
+func (d *Driver) checkVZKernel() error {
+	if d.ImagePreset != presetBoot2Docker || d.Boot2DockerURL != "" || d.kernelPath() != "" || d.Bootrom != "" || d.Template != "" {
+		return nil
+	}
+	if !isAppleSilicon(d.commands()) {
+		return nil
+	}
+	return fmt.Errorf("The boot2docker releases only have an x86_64 kernel, which the %s hypervisor can not boot on Apple Silicon.\n"+
+		"\tGive an arm64 image with --xhyve-boot2docker-url, or an arm64 kernel and initrd with --xhyve-vmlinuz-path and --xhyve-initrd-path", hypervisorVZ)
+}
+
+func (d *Driver) vfkitBinary() string {
+	if d.VfkitPath != "" {
+		return d.VfkitPath
+	}
+	return "vfkit"
+}
+
+// macFromUUID derives a stable, locally administered unicast MAC address from uuid.
+func macFromUUID(uuid string) (string, error) {
+	b, err := hex.DecodeString(strings.Replace(uuid, "-", "", -1))
+	if err != nil || len(b) < 6 {
+		return "", fmt.Errorf("invalid UUID %q", uuid)
+	}
+	b[0] = (b[0] | 0x02) &^ 0x01
+	return net.HardwareAddr(b[:6]).String(), nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// wipeChunk is how much of a disk image is overwritten at once
+const wipeChunk = 1048576
+
+// wipeDiskImage overwrites the disk images and snapshots of the removed
+// machine with random data before they are unlinked. The encrypted disks
+// are crypto-shredded instead: their key is removed from the keychain.
+func (d *Driver) wipeDiskImage() error {
+	if d.EncryptDisk {
+		log.Infof("The disk of %s is encrypted, removing its key shreds it", d.MachineName)
+		return nil
+	}
+
+	log.Infof("Wiping the disk image of %s...", d.MachineName)
+	paths := []string{d.rawDiskPath(), d.qcow2DiskPath(), d.sparseBundlePath(), d.diskFilePath(snapshotsDir)}
+	for _, root := range paths {
+		err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			if err != nil || !fi.Mode().IsRegular() {
+				return err
+			}
+			return wipeFile(path, fi.Size())
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wipeFile overwrites the data of the file path of size bytes and syncs it.
+// The holes of a sparse file are left as they are, they hold no data.
+func wipeFile(path string, size int64) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf := make([]byte, wipeChunk)
+	for off := int64(0); off < size; {
+		start, err := f.Seek(off, seekData)
+		if err != nil {
+			// no data left, or a filesystem without SEEK_DATA
+			if !seekSupported(f) {
+				if err := overwrite(f, buf, off, size); err != nil {
+					return err
+				}
+			}
+			break
+		}
+		end, err := f.Seek(start, seekHole)
+		if err != nil || end > size {
+			end = size
+		}
+		if err := overwrite(f, buf, start, end); err != nil {
+			return err
+		}
+		off = end
+	}
+	return f.Sync()
+}
+
+// seekSupported reports whether the filesystem of f finds the holes of the
+// sparse files: a file always ends with a hole.
+func seekSupported(f *os.File) bool {
+	_, err := f.Seek(0, seekHole)
+	return err == nil
+}
+
+// overwrite writes random data from start to end of f.
+func overwrite(f *os.File, buf []byte, start, end int64) error {
+	for off := start; off < end; off += int64(len(buf)) {
+		n := minInt64(int64(len(buf)), end-off)
+		if _, err := io.ReadFull(rand.Reader, buf[:n]); err != nil {
+			return err
+		}
+		if _, err := f.WriteAt(buf[:n], off); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -8,11 +8,13 @@ import (
 	"archive/tar"
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/user"
@@ -29,7 +31,6 @@ import (
 	"github.com/docker/machine/libmachine/log"
 	"github.com/docker/machine/libmachine/mcnflag"
 	"github.com/docker/machine/libmachine/mcnutils"
-	"github.com/docker/machine/libmachine/ssh"
 	"github.com/docker/machine/libmachine/state"
 	"github.com/johanneswuerbach/nfsexports"
 	ps "github.com/mitchellh/go-ps"
@@ -59,17 +60,30 @@ const (
 	defaultVirtio9pRoot   = "/xhyve-virtio9p"
 	defaultQcow2          = false
 	defaultRawDisk        = false
+	defaultBootTimeout    = 120
+	defaultIPPollInterval = 2
+	defaultSSHTimeout     = 180
+	defaultSSHPort        = 22
+	dockerPort            = 2376
 )
 
 type Driver struct {
 	*drivers.BaseDriver
 	*b2d.B2dUtils
 
-	Boot2DockerURL string
-	CaCertPath     string
-	PrivateKeyPath string
+	ConfigVersion int
+
+	Boot2DockerURL        string
+	Boot2DockerChecksum   string
+	Boot2DockerReleaseURL string
+	Boot2DockerMirrorURL  string
+	Boot2DockerVersion    string
+	Offline               bool
+	CaCertPath            string
+	PrivateKeyPath        string
 
 	CPU           int
+	CPUTopology   string
 	Memory        int
 	DiskSize      int64
 	DiskNumber    int
@@ -77,17 +91,80 @@ type Driver struct {
 	UUID          string
 	Qcow2         bool
 	RawDisk       bool
+	EncryptDisk   bool
+	SecureRemove  bool
+	DiskKeyName   string
 	NFSShares     []string
 	NFSSharesRoot string
 	Virtio9p      []string
 	Virtio9pRoot  string
 	NFSShare      bool
-
-	BootCmd    string
-	BootKernel string
-	BootInitrd string
-	Initrd     string
-	Vmlinuz    string
+	ShowConsole   bool
+
+	BootTimeout    int
+	IPPollInterval int
+	SSHTimeout     int
+
+	Hypervisor        string
+	HypervisorVersion string
+	HyperkitPath      string
+	VfkitPath         string
+	XhyveBinary       string
+	ExtraArgs         []string
+	CPUYield          []string
+	ProcessPriority   string
+	NonInteractive    bool
+	HelperPath        string
+	DriverBinary      string
+	OrphanPolicy      string
+	ArtifactName      string
+	Template          string
+	NodeBase          string
+	ImportDisk        string
+	SSHKey            string
+	SSHAgent          bool
+	ProxyEnv          []string
+	RegistryCAs       []string
+	UserdataFiles     []string
+	Bootsync          string
+	Bootlocal         string
+	DaemonJSON        string
+	HostEntries       []string
+	DNSServers        []string
+	Hostname          string
+	ClockSyncInterval int
+	TTL               int
+	Metrics           string
+	MetricsInterval   int
+	PreStartHook      string
+	PostStartHook     string
+	PreStopHook       string
+	PostRemoveHook    string
+	DeterministicUUID bool
+	StaticIP          string
+	DiskDir           string
+	Ephemeral         bool
+	Supervise         bool
+
+	BootCmd      string
+	BootCmdExtra string
+	BootKernel   string
+	BootInitrd   string
+	Initrd       string
+	Vmlinuz      string
+	VmlinuzPath  string
+	InitrdPath   string
+	Bootrom      string
+	ISOChecksum  string
+	ImagePreset  string
+
+	CloudImageURL  string
+	CloudKernelURL string
+	CloudInitrdURL string
+
+	runner CommandRunner
+	// auditFlags are the create flags written to the audit log
+	auditFlags []string
 }
 
 var (
@@ -95,6 +172,7 @@ var (
 	ErrMachineNotExist = errors.New("machine does not exist")
 	diskRegexp         = regexp.MustCompile("^/dev/disk([0-9]+)")
 	kernelRegexp       = regexp.MustCompile(`(vmlinu[xz]|bzImage)[\d]*`)
+	initrdRegexp       = regexp.MustCompile(`initrd`)
 	kernelOptionRegexp = regexp.MustCompile(`(?:\t|\s{2})append\s+([[:print:]]+)`)
 )
 
@@ -105,70 +183,155 @@ func NewDriver(hostName, storePath string) *Driver {
 			MachineName: hostName,
 			StorePath:   storePath,
 		},
-		Boot2DockerURL: defaultBoot2DockerURL,
-		BootCmd:        defaultBootCmd,
-		BootKernel:     defaultBootKernel,
-		BootInitrd:     defaultBootInitrd,
-		CPU:            defaultCPU,
-		CaCertPath:     defaultCaCertPath,
-		DiskSize:       defaultDiskSize,
-		MacAddr:        defaultMacAddr,
-		Memory:         defaultMemory,
-		PrivateKeyPath: defaultPrivateKeyPath,
-		UUID:           defaultUUID,
-		Virtio9pRoot:   defaultVirtio9pRoot,
-		NFSSharesRoot:  defaultNFSSharesRoot,
-		DiskNumber:     defaultDiskNumber,
-		Qcow2:          defaultQcow2,
-		RawDisk:        defaultRawDisk,
+		Boot2DockerURL:    defaultBoot2DockerURL,
+		BootCmd:           defaultBootCmd,
+		BootKernel:        defaultBootKernel,
+		BootInitrd:        defaultBootInitrd,
+		CPU:               defaultCPU,
+		CaCertPath:        defaultCaCertPath,
+		DiskSize:          defaultDiskSize,
+		MacAddr:           defaultMacAddr,
+		Memory:            defaultMemory,
+		PrivateKeyPath:    defaultPrivateKeyPath,
+		UUID:              defaultUUID,
+		Virtio9pRoot:      defaultVirtio9pRoot,
+		NFSSharesRoot:     defaultNFSSharesRoot,
+		DiskNumber:        defaultDiskNumber,
+		Qcow2:             defaultQcow2,
+		RawDisk:           defaultRawDisk,
+		BootTimeout:       defaultBootTimeout,
+		IPPollInterval:    defaultIPPollInterval,
+		SSHTimeout:        defaultSSHTimeout,
+		ClockSyncInterval: defaultClockSyncInterval,
+		CPUYield:          defaultCPUYield,
+		MetricsInterval:   defaultMetricsInterval,
+		Hypervisor:        defaultHypervisor,
+		OrphanPolicy:      defaultOrphanPolicy,
+		ImagePreset:       defaultImagePreset,
 	}
 }
 
 // RegisterCreateFlags registers the flags this driver adds to
 // "docker hosts create"
 func (d *Driver) GetCreateFlags() []mcnflag.Flag {
-	return []mcnflag.Flag{
+	return withFlagDefaults(d.StorePath, []mcnflag.Flag{
 		mcnflag.StringFlag{
 			EnvVar: "XHYVE_BOOT_CMD",
 			Name:   "xhyve-boot-cmd",
 			Usage:  "Command of booting kexec protocol",
 			Value:  defaultBootCmd,
 		},
+		mcnflag.StringFlag{
+			EnvVar: "XHYVE_BOOT_CMD_EXTRA",
+			Name:   "xhyve-boot-cmd-extra",
+			Usage:  "Options appended to the default kernel command line",
+			Value:  "",
+		},
 		mcnflag.StringFlag{
 			EnvVar: "XHYVE_BOOT_KERNEL",
 			Name:   "xhyve-boot-kernel",
-			Usage:  "Absolute path to kernel file (like /boot/vmlinuz64)",
+			Usage:  "Deprecated, use --xhyve-vmlinuz-path",
 			Value:  defaultBootKernel,
 		},
 		mcnflag.StringFlag{
 			EnvVar: "XHYVE_BOOT_INITRD",
 			Name:   "xhyve-boot-initrd",
-			Usage:  "Absolute path to ramdisk file (like /boot/initrd.img)",
+			Usage:  "Deprecated, use --xhyve-initrd-path",
 			Value:  defaultBootInitrd,
 		},
+		mcnflag.StringFlag{
+			EnvVar: "XHYVE_VMLINUZ_PATH",
+			Name:   "xhyve-vmlinuz-path",
+			Usage:  "Path to the kernel inside the ISO (like /boot/vmlinuz64) or on the host",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "XHYVE_INITRD_PATH",
+			Name:   "xhyve-initrd-path",
+			Usage:  "Path to the ramdisk inside the ISO (like /boot/initrd.img) or on the host",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "XHYVE_BOOTROM",
+			Name:   "xhyve-bootrom",
+			Usage:  "Path to a UEFI firmware booting the ISO with its own bootloader instead of kexec",
+			Value:  "",
+		},
 		mcnflag.StringFlag{
 			EnvVar: "XHYVE_BOOT2DOCKER_URL",
 			Name:   "xhyve-boot2docker-url",
 			Usage:  "The URL of the boot2docker image. Defaults to the latest available version",
 			Value:  "",
 		},
+		mcnflag.StringFlag{
+			EnvVar: "XHYVE_BOOT2DOCKER_RELEASE_URL",
+			Name:   "xhyve-boot2docker-release-url",
+			Usage:  "GitHub (Enterprise) API URL of the latest boot2docker release",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "XHYVE_BOOT2DOCKER_MIRROR_URL",
+			Name:   "xhyve-boot2docker-mirror-url",
+			Usage:  "Base URL the boot2docker releases are downloaded from, as <url>/<tag>/boot2docker.iso",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "XHYVE_BOOT2DOCKER_VERSION",
+			Name:   "xhyve-boot2docker-version",
+			Usage:  "Pinned boot2docker release, like v17.06.0-ce. Defaults to the latest release",
+			Value:  "",
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "XHYVE_OFFLINE",
+			Name:   "xhyve-offline",
+			Usage:  "Refuse any network access during create, using only cached or local images",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "XHYVE_GITHUB_API_TOKEN",
+			Name:   "xhyve-github-api-token",
+			Usage:  "GitHub API token used to look up the latest boot2docker release",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "XHYVE_BOOT2DOCKER_CHECKSUM",
+			Name:   "xhyve-boot2docker-checksum",
+			Usage:  "SHA256 checksum the boot2docker ISO is verified against before use",
+			Value:  "",
+		},
 		mcnflag.IntFlag{
 			EnvVar: "XHYVE_CPU_COUNT",
 			Name:   "xhyve-cpu-count",
-			Usage:  "Number of CPUs for the machine (-1 to use the number of CPUs available)",
-			Value:  defaultCPU,
+			Usage:  "Number of CPUs for the machine, 1 or the CPUs of --xhyve-cpu-topology when 0 (-1 to use the number of CPUs available)",
+			Value:  0,
 		},
-		mcnflag.IntFlag{
+		mcnflag.StringFlag{
+			EnvVar: "XHYVE_CPU_TOPOLOGY",
+			Name:   "xhyve-cpu-topology",
+			Usage:  "CPU topology of the machine, like sockets=1,cores=2,threads=2",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
 			EnvVar: "XHYVE_DISK_SIZE",
 			Name:   "xhyve-disk-size",
-			Usage:  "Size of disk for host in MB",
-			Value:  defaultDiskSize,
+			Usage:  "Size of disk for host, in MB or with a unit like 20G",
+			Value:  strconv.Itoa(defaultDiskSize),
 		},
-		mcnflag.IntFlag{
+		mcnflag.StringFlag{
+			EnvVar: "XHYVE_DISK_DIR",
+			Name:   "xhyve-disk-dir",
+			Usage:  "Directory for the disk image and its snapshots, on another volume than the machine store",
+			Value:  "",
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "XHYVE_EPHEMERAL",
+			Name:   "xhyve-ephemeral",
+			Usage:  "Create the disk image on a RAM disk, which is faster but lost when the host restarts",
+		},
+		mcnflag.StringFlag{
 			EnvVar: "XHYVE_MEMORY_SIZE",
 			Name:   "xhyve-memory-size",
-			Usage:  "Size of memory for host in MB",
-			Value:  defaultMemory,
+			Usage:  "Size of memory for host, in MB or with a unit like 512M or 2G",
+			Value:  strconv.Itoa(defaultMemory),
 		},
 		mcnflag.BoolFlag{
 			EnvVar: "XHYVE_QCOW2",
@@ -180,12 +343,33 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			Name:   "xhyve-rawdisk",
 			Usage:  "Use a raw disk for attached volumes",
 		},
+		mcnflag.BoolFlag{
+			EnvVar: "XHYVE_ENCRYPT_DISK",
+			Name:   "xhyve-encrypt-disk",
+			Usage:  "Encrypt the sparsebundle disk with a key kept in the login keychain",
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "XHYVE_SECURE_REMOVE",
+			Name:   "xhyve-secure-remove",
+			Usage:  "Overwrite the disk image with random data before removing it",
+		},
 		mcnflag.StringFlag{
 			EnvVar: "XHYVE_UUID",
 			Name:   "xhyve-uuid",
-			Usage:  "The UUID for the machine",
+			Usage:  "The UUID for the machine, which vmnet derives its MAC address from",
 			Value:  defaultUUID,
 		},
+		mcnflag.BoolFlag{
+			EnvVar: "XHYVE_DETERMINISTIC_UUID",
+			Name:   "xhyve-deterministic-uuid",
+			Usage:  "Derive the UUID from the machine name, so the machine keeps its IP address when it is created again",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "XHYVE_STATIC_IP",
+			Name:   "xhyve-static-ip",
+			Usage:  "Static IP address of the machine in the vmnet network, or auto for the next free one",
+			Value:  "",
+		},
 		mcnflag.StringSliceFlag{
 			EnvVar: "XHYVE_VIRTIO_9P",
 			Name:   "xhyve-virtio-9p",
@@ -208,7 +392,255 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			Usage:  "root directory where the NFS shares will be mounted inside the machine",
 			Value:  defaultNFSSharesRoot,
 		},
-	}
+		mcnflag.BoolFlag{
+			EnvVar: "XHYVE_SHOW_CONSOLE",
+			Name:   "xhyve-show-console",
+			Usage:  "Stream the VM console to the log output while the machine is created",
+		},
+		mcnflag.IntFlag{
+			EnvVar: "XHYVE_BOOT_TIMEOUT",
+			Name:   "xhyve-boot-timeout",
+			Usage:  "Seconds to wait for the machine to get an IP address",
+			Value:  defaultBootTimeout,
+		},
+		mcnflag.IntFlag{
+			EnvVar: "XHYVE_IP_POLL_INTERVAL",
+			Name:   "xhyve-ip-poll-interval",
+			Usage:  "Seconds between two lookups of the machine IP address",
+			Value:  defaultIPPollInterval,
+		},
+		mcnflag.IntFlag{
+			EnvVar: "XHYVE_SSH_TIMEOUT",
+			Name:   "xhyve-ssh-timeout",
+			Usage:  "Seconds to wait for the machine to accept SSH connections once it has an IP address",
+			Value:  defaultSSHTimeout,
+		},
+		mcnflag.IntFlag{
+			EnvVar: "XHYVE_CLOCK_SYNC_INTERVAL",
+			Name:   "xhyve-clock-sync-interval",
+			Usage:  "Seconds between two syncs of the guest clock with the host clock, 0 to disable them",
+			Value:  defaultClockSyncInterval,
+		},
+		mcnflag.StringFlag{
+			EnvVar: "XHYVE_TTL",
+			Name:   "xhyve-ttl",
+			Usage:  "Stop the machine this long after it started, like 8h, 0 to never stop it",
+			Value:  "0",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "XHYVE_METRICS",
+			Name:   "xhyve-metrics",
+			Usage:  "File to append the metrics of the machine to as JSON lines, or statsd://host:port to send them to",
+			Value:  "",
+		},
+		mcnflag.IntFlag{
+			EnvVar: "XHYVE_METRICS_INTERVAL",
+			Name:   "xhyve-metrics-interval",
+			Usage:  "Seconds between two samples of the --xhyve-metrics",
+			Value:  defaultMetricsInterval,
+		},
+		mcnflag.StringFlag{
+			EnvVar: "XHYVE_PRE_START_HOOK",
+			Name:   "xhyve-pre-start-hook",
+			Usage:  "Script run before the machine starts, which fails the start when it fails",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "XHYVE_POST_START_HOOK",
+			Name:   "xhyve-post-start-hook",
+			Usage:  "Script run once the machine started and has its IP address",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "XHYVE_PRE_STOP_HOOK",
+			Name:   "xhyve-pre-stop-hook",
+			Usage:  "Script run before the machine stops, which fails the stop when it fails",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "XHYVE_POST_REMOVE_HOOK",
+			Name:   "xhyve-post-remove-hook",
+			Usage:  "Script run once the machine is removed",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "XHYVE_HYPERVISOR",
+			Name:   "xhyve-hypervisor",
+			Usage:  "Hypervisor running the machine: embedded, hyperkit, vz (Virtualization.framework) or fake (no guest, for tests)",
+			Value:  defaultHypervisor,
+		},
+		mcnflag.StringFlag{
+			EnvVar: "XHYVE_HYPERKIT_PATH",
+			Name:   "xhyve-hyperkit-path",
+			Usage:  "Path to the hyperkit binary. Defaults to the one in $PATH or shipped with Docker for Mac",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "XHYVE_VFKIT_PATH",
+			Name:   "xhyve-vfkit-path",
+			Usage:  "Path to the vfkit binary used by the vz hypervisor. Defaults to the one in $PATH",
+			Value:  "",
+		},
+		mcnflag.StringSliceFlag{
+			EnvVar: "XHYVE_EXTRA_ARGS",
+			Name:   "xhyve-extra-args",
+			Usage:  "Arguments appended to the hypervisor command line, like \"-s 6,virtio-rnd\"",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "XHYVE_CPU_YIELD",
+			Name:   "xhyve-cpu-yield",
+			Usage:  "Instructions the idle vCPUs yield the host CPU on: hlt, pause, hlt,pause or none",
+			Value:  strings.Join(defaultCPUYield, ","),
+		},
+		mcnflag.StringFlag{
+			EnvVar: "XHYVE_PROCESS_PRIORITY",
+			Name:   "xhyve-process-priority",
+			Usage:  "Priority of the hypervisor process: background, foreground or a nice level",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "XHYVE_HELPER_PATH",
+			Name:   "xhyve-helper-path",
+			Usage:  "Path to the setuid root " + HelperName + " running the embedded hypervisor",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "XHYVE_BINARY",
+			Name:   "xhyve-binary",
+			Usage:  "Path to a locally built xhyve binary to run instead of the embedded hypervisor",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "XHYVE_ORPHAN_POLICY",
+			Name:   "xhyve-orphan-policy",
+			Usage:  "What to do with a running hypervisor of the machine missing from its pidfile: adopt, kill or ignore",
+			Value:  defaultOrphanPolicy,
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "XHYVE_NON_INTERACTIVE",
+			Name:   "xhyve-non-interactive",
+			Usage:  "Never prompt, fail fast with single line JSON errors and print no progress, for CI",
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "XHYVE_SUPERVISE",
+			Name:   "xhyve-supervise",
+			Usage:  "Restart the hypervisor when it crashes",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "XHYVE_TEMPLATE",
+			Name:   "xhyve-template",
+			Usage:  "Stopped machine to clone the image, SSH key and disk of",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "XHYVE_NODE_BASE",
+			Name:   "xhyve-node-base",
+			Usage:  "Prefix of the nodes sharing the boot files and base disk of the machine, set by create-nodes",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "XHYVE_IMPORT_DISK",
+			Name:   "xhyve-import-disk",
+			Usage:  "Raw, qcow2, VMDK or VDI disk image to convert into the disk of the machine",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "XHYVE_SSH_KEY",
+			Name:   "xhyve-ssh-key",
+			Usage:  "Existing private SSH key to use instead of generating one",
+			Value:  "",
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "XHYVE_SSH_AGENT",
+			Name:   "xhyve-ssh-agent",
+			Usage:  "Authorize the keys of the running ssh-agent instead of a private key file",
+		},
+		mcnflag.BoolFlag{
+			EnvVar: "XHYVE_ENV_PROXY",
+			Name:   "xhyve-env-proxy",
+			Usage:  "Set the HTTP_PROXY, HTTPS_PROXY and NO_PROXY of the host, or its system proxies, for the docker daemon of the boot2docker guest",
+		},
+		mcnflag.StringSliceFlag{
+			EnvVar: "XHYVE_REGISTRY_CA",
+			Name:   "xhyve-registry-ca",
+			Usage:  "CA certificate of a private registry installed in the boot2docker guest, as registry[:port]=/path/to/ca.crt",
+		},
+		mcnflag.StringSliceFlag{
+			EnvVar: "XHYVE_USERDATA_FILE",
+			Name:   "xhyve-userdata-file",
+			Usage:  "Host file added to the userdata of the boot2docker guest, as /host/path:guest/path, relative to /home/docker",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "XHYVE_BOOTSYNC",
+			Name:   "xhyve-bootsync",
+			Usage:  "Script run by the boot2docker guest at every boot before docker starts",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "XHYVE_BOOTLOCAL",
+			Name:   "xhyve-bootlocal",
+			Usage:  "Script run by the boot2docker guest at every boot after docker started",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "XHYVE_DAEMON_JSON",
+			Name:   "xhyve-daemon-json",
+			Usage:  "Host file installed as /etc/docker/daemon.json in the boot2docker guest",
+			Value:  "",
+		},
+		mcnflag.StringSliceFlag{
+			EnvVar: "XHYVE_HOST_ENTRY",
+			Name:   "xhyve-host-entry",
+			Usage:  "Entry added to the /etc/hosts of the boot2docker guest, as ip:name",
+		},
+		mcnflag.StringSliceFlag{
+			EnvVar: "XHYVE_DNS",
+			Name:   "xhyve-dns",
+			Usage:  "Name server queried first by the boot2docker guest",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "XHYVE_HOSTNAME",
+			Name:   "xhyve-hostname",
+			Usage:  "Hostname of the guest, the machine name by default",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "XHYVE_SSH_USER",
+			Name:   "xhyve-ssh-user",
+			Usage:  "SSH user of the guest, the user of the image preset by default",
+			Value:  "",
+		},
+		mcnflag.IntFlag{
+			EnvVar: "XHYVE_SSH_PORT",
+			Name:   "xhyve-ssh-port",
+			Usage:  "Port of the SSH server of the guest",
+			Value:  defaultSSHPort,
+		},
+		mcnflag.StringFlag{
+			EnvVar: "XHYVE_IMAGE_PRESET",
+			Name:   "xhyve-image-preset",
+			Usage:  "Guest OS of the ISO: boot2docker, rancheros, coreos, cloud-init or minikube",
+			Value:  defaultImagePreset,
+		},
+		mcnflag.StringFlag{
+			EnvVar: "XHYVE_CLOUD_IMAGE_URL",
+			Name:   "xhyve-cloud-image-url",
+			Usage:  "URL or path of the raw cloud disk image booted by the cloud-init image preset",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "XHYVE_CLOUD_KERNEL_URL",
+			Name:   "xhyve-cloud-kernel-url",
+			Usage:  "URL or path of the kernel of the cloud image",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "XHYVE_CLOUD_INITRD_URL",
+			Name:   "xhyve-cloud-initrd-url",
+			Usage:  "URL or path of the initrd of the cloud image",
+			Value:  "",
+		},
+	})
 }
 
 func (d *Driver) GetMachineName() string {
@@ -219,13 +651,18 @@ func (d *Driver) GetSSHHostname() (string, error) {
 	return d.GetIP()
 }
 
+// GetSSHKeyPath returns no key for machines using the ssh-agent, so
+// docker-machine lets ssh offer the keys of the agent.
 func (d *Driver) GetSSHKeyPath() string {
-	return d.ResolveStorePath("id_rsa")
+	if d.SSHAgent {
+		return ""
+	}
+	return d.privateSSHKeyPath()
 }
 
 func (d *Driver) GetSSHPort() (int, error) {
 	if d.SSHPort == 0 {
-		d.SSHPort = 22
+		d.SSHPort = defaultSSHPort
 	}
 
 	return d.SSHPort, nil
@@ -244,28 +681,342 @@ func (d *Driver) DriverName() string {
 }
 
 func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
+	d.auditFlags = auditFlags(flags, d.GetCreateFlags())
+	flags = withBoolDefaults(d.StorePath, flags)
+	d.ConfigVersion = configVersion
 	d.Boot2DockerURL = flags.String("xhyve-boot2docker-url")
+	d.Boot2DockerChecksum = flags.String("xhyve-boot2docker-checksum")
+	d.Boot2DockerReleaseURL = flags.String("xhyve-boot2docker-release-url")
+	d.Boot2DockerMirrorURL = flags.String("xhyve-boot2docker-mirror-url")
+	d.Boot2DockerVersion = flags.String("xhyve-boot2docker-version")
+	if d.Boot2DockerVersion != "" {
+		if d.Boot2DockerURL != "" {
+			return fmt.Errorf("--xhyve-boot2docker-version and --xhyve-boot2docker-url can not be used together")
+		}
+		if !strings.HasPrefix(d.Boot2DockerVersion, "v") {
+			d.Boot2DockerVersion = "v" + d.Boot2DockerVersion
+		}
+	}
+	d.Offline = flags.Bool("xhyve-offline")
+	// the token is not saved with the machine config
+	if token := flags.String("xhyve-github-api-token"); token != "" {
+		b2d.GithubAPIToken = token
+	}
 	d.BootCmd = flags.String("xhyve-boot-cmd")
+	d.BootCmdExtra = flags.String("xhyve-boot-cmd-extra")
 	d.BootKernel = flags.String("xhyve-boot-kernel")
 	d.BootInitrd = flags.String("xhyve-boot-initrd")
-	d.CPU = flags.Int("xhyve-cpu-count")
-	if d.CPU < 1 {
-		d.CPU = int(runtime.NumCPU())
+	d.VmlinuzPath = flags.String("xhyve-vmlinuz-path")
+	d.InitrdPath = flags.String("xhyve-initrd-path")
+	d.Bootrom = flags.String("xhyve-bootrom")
+	cpus := runtime.NumCPU()
+	if n, err := hostCPUs(d.commands()); err == nil {
+		cpus = n
+	}
+	// 0 is the default: defaultCPU, or the CPU count of the topology
+	count := flags.Int("xhyve-cpu-count")
+	switch {
+	case count == -1:
+		count = cpus
+	case count < 0:
+		return fmt.Errorf("--xhyve-cpu-count must be a positive number or -1, got %d", count)
+	}
+	if s := flags.String("xhyve-cpu-topology"); s != "" {
+		topology, err := parseCPUTopology(s, count)
+		if err != nil {
+			return err
+		}
+		if count != 0 && topology.cpus() != count {
+			return fmt.Errorf("--xhyve-cpu-topology %q makes %d CPUs, not the %d of --xhyve-cpu-count", s, topology.cpus(), count)
+		}
+		if topology.cpus() > cpus {
+			return fmt.Errorf("--xhyve-cpu-topology %q makes %d CPUs, more than the %d of this host", s, topology.cpus(), cpus)
+		}
+		d.CPU = topology.cpus()
+		d.CPUTopology = topology.String()
+	} else if count == 0 {
+		d.CPU = defaultCPU
+	} else if count > cpus {
+		log.Warnf("--xhyve-cpu-count %d exceeds the %d CPUs of this host, using %d", count, cpus, cpus)
+		d.CPU = cpus
+	} else {
+		d.CPU = count
+	}
+	diskSize, err := parseDiskSize(flags.String("xhyve-disk-size"))
+	if err != nil {
+		return err
+	}
+	d.DiskSize = diskSize
+	if dir := flags.String("xhyve-disk-dir"); dir != "" {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		if fi, err := os.Stat(abs); err != nil || !fi.IsDir() {
+			return fmt.Errorf("Could not use the --xhyve-disk-dir %s: not a directory", dir)
+		}
+		d.DiskDir = filepath.Join(abs, d.MachineName)
+	}
+	memory, err := parseMemorySize(flags.String("xhyve-memory-size"))
+	if err != nil {
+		return err
 	}
-	d.DiskSize = int64(flags.Int("xhyve-disk-size"))
-	d.Memory = flags.Int("xhyve-memory-size")
+	d.Memory = memory
 	d.Qcow2 = flags.Bool("xhyve-qcow2")
 	d.RawDisk = flags.Bool("xhyve-rawdisk")
-	d.SSHPort = 22
-	d.SSHUser = "docker"
+	d.EncryptDisk = flags.Bool("xhyve-encrypt-disk")
+	d.SecureRemove = flags.Bool("xhyve-secure-remove")
+	d.Template = flags.String("xhyve-template")
+	d.NodeBase = flags.String("xhyve-node-base")
+	if d.NodeBase != "" {
+		if d.Template != "" {
+			return fmt.Errorf("--xhyve-node-base can not be used with --xhyve-template, the nodes are clones of the template")
+		}
+		if err := validateNodePrefix(d.NodeBase); err != nil {
+			return err
+		}
+	}
+	if key := flags.String("xhyve-ssh-key"); key != "" {
+		if d.Template != "" {
+			return fmt.Errorf("--xhyve-ssh-key can not be used with --xhyve-template, the SSH key of the template is cloned")
+		}
+		d.SSHKey = expandPath(key)
+		if _, _, err := readSSHKey(d.SSHKey); err != nil {
+			return err
+		}
+		if err := checkPrivateFile(d.SSHKey, "--xhyve-ssh-key", keyModeMask); err != nil {
+			return err
+		}
+	}
+	d.SSHAgent = flags.Bool("xhyve-ssh-agent")
+	if d.SSHAgent && (d.SSHKey != "" || d.Template != "") {
+		return fmt.Errorf("--xhyve-ssh-agent can not be used with --xhyve-ssh-key or --xhyve-template")
+	}
+	d.Supervise = flags.Bool("xhyve-supervise")
+	d.NonInteractive = flags.Bool("xhyve-non-interactive")
+	b2d.Quiet = d.NonInteractive
+	d.ImagePreset = flags.String("xhyve-image-preset")
+	if err := validateImagePreset(d.ImagePreset); err != nil {
+		return err
+	}
+	if flags.Bool("xhyve-env-proxy") {
+		d.ProxyEnv = hostProxyEnv(d.commands())
+		if len(d.ProxyEnv) == 0 {
+			log.Warnf("--xhyve-env-proxy is set but the host has no proxy settings")
+		}
+	}
+	d.RegistryCAs = nil
+	for _, ca := range flags.StringSlice("xhyve-registry-ca") {
+		if registry, caPath, err := parseRegistryCA(ca); err == nil {
+			ca = registry + "=" + expandPath(caPath)
+		}
+		d.RegistryCAs = append(d.RegistryCAs, ca)
+	}
+	d.UserdataFiles = nil
+	for _, f := range flags.StringSlice("xhyve-userdata-file") {
+		if hostPath, guestPath, err := parseUserdataFile(f); err == nil {
+			f = expandPath(hostPath) + ":" + guestPath
+		}
+		d.UserdataFiles = append(d.UserdataFiles, f)
+	}
+	if script := flags.String("xhyve-bootsync"); script != "" {
+		d.Bootsync = expandPath(script)
+	}
+	if script := flags.String("xhyve-bootlocal"); script != "" {
+		d.Bootlocal = expandPath(script)
+	}
+	d.Hostname = flags.String("xhyve-hostname")
+	if d.Hostname != "" && !hostnameRegexp.MatchString(d.Hostname) {
+		return fmt.Errorf("Invalid --xhyve-hostname %q", d.Hostname)
+	}
+	d.HostEntries = flags.StringSlice("xhyve-host-entry")
+	d.DNSServers = flags.StringSlice("xhyve-dns")
+	if file := flags.String("xhyve-daemon-json"); file != "" {
+		d.DaemonJSON = expandPath(file)
+	}
+	if err := d.validateUserdata(); err != nil {
+		return err
+	}
+	d.SSHUser = flags.String("xhyve-ssh-user")
+	if d.SSHUser == "" {
+		d.SSHUser = d.preset().sshUser
+	}
+	d.SSHPort = flags.Int("xhyve-ssh-port")
+	if d.SSHPort < 1 || d.SSHPort > 65535 {
+		return fmt.Errorf("--xhyve-ssh-port must be a port number between 1 and 65535, got %d", d.SSHPort)
+	}
+	d.CloudImageURL = flags.String("xhyve-cloud-image-url")
+	d.CloudKernelURL = flags.String("xhyve-cloud-kernel-url")
+	d.CloudInitrdURL = flags.String("xhyve-cloud-initrd-url")
+	if d.preset().cloudImage {
+		if err := d.validateCloudImage(); err != nil {
+			return err
+		}
+	}
+	if disk := flags.String("xhyve-import-disk"); disk != "" {
+		if d.Template != "" || d.preset().cloudImage {
+			return fmt.Errorf("--xhyve-import-disk can not be used with --xhyve-template or a cloud image preset, they bring their own disk")
+		}
+		if d.ImportDisk, err = filepath.Abs(expandPath(disk)); err != nil {
+			return err
+		}
+		if err := validateImportDisk(d.ImportDisk); err != nil {
+			return err
+		}
+		if d.SSHKey == "" && !d.SSHAgent {
+			log.Warnf("The imported disk is not given a new SSH key, it must already authorize one: use --xhyve-ssh-key")
+		}
+	}
 	d.SwarmDiscovery = flags.String("swarm-discovery")
 	d.SwarmHost = flags.String("swarm-host")
 	d.SwarmMaster = flags.Bool("swarm-master")
 	d.UUID = flags.String("xhyve-uuid")
+	if d.UUID != "" {
+		if err := validateUUID(d.UUID); err != nil {
+			return err
+		}
+	}
+	d.DeterministicUUID = flags.Bool("xhyve-deterministic-uuid")
+	if d.DeterministicUUID {
+		if d.UUID != "" {
+			return fmt.Errorf("--xhyve-deterministic-uuid can not be used with --xhyve-uuid")
+		}
+		d.UUID = nameUUID(d.MachineName)
+	}
+	d.StaticIP = flags.String("xhyve-static-ip")
+	if err := validateStaticIP(d.StaticIP); err != nil {
+		return err
+	}
 	d.Virtio9p = flags.StringSlice("xhyve-virtio-9p")
 	d.Virtio9pRoot = flags.String("xhyve-virtio-9p-root")
+	if root := d.preset().virtio9pRoot; root != "" && d.Virtio9pRoot == defaultVirtio9pRoot {
+		d.Virtio9pRoot = root
+	}
 	d.NFSShares = flags.StringSlice("xhyve-experimental-nfs-share")
 	d.NFSSharesRoot = flags.String("xhyve-experimental-nfs-share-root")
+	d.ShowConsole = flags.Bool("xhyve-show-console")
+	d.BootTimeout = flags.Int("xhyve-boot-timeout")
+	d.IPPollInterval = flags.Int("xhyve-ip-poll-interval")
+	if d.BootTimeout < 1 {
+		return fmt.Errorf("--xhyve-boot-timeout must be a positive number of seconds, got %d", d.BootTimeout)
+	}
+	if d.IPPollInterval < 1 || d.IPPollInterval > d.BootTimeout {
+		return fmt.Errorf("--xhyve-ip-poll-interval must be between 1 and %d seconds, got %d", d.BootTimeout, d.IPPollInterval)
+	}
+	d.SSHTimeout = flags.Int("xhyve-ssh-timeout")
+	if d.SSHTimeout < 1 {
+		return fmt.Errorf("--xhyve-ssh-timeout must be a positive number of seconds, got %d", d.SSHTimeout)
+	}
+	d.ClockSyncInterval = flags.Int("xhyve-clock-sync-interval")
+	if d.ClockSyncInterval < 0 {
+		return fmt.Errorf("--xhyve-clock-sync-interval must be a number of seconds, got %d", d.ClockSyncInterval)
+	}
+	ttl, err := parseTTL(flags.String("xhyve-ttl"))
+	if err != nil {
+		return err
+	}
+	d.TTL = ttl
+	d.Metrics = flags.String("xhyve-metrics")
+	if err := validateMetrics(d.Metrics); err != nil {
+		return err
+	}
+	if d.Metrics != "" && !strings.Contains(d.Metrics, "://") {
+		if d.Metrics, err = filepath.Abs(d.Metrics); err != nil {
+			return err
+		}
+	}
+	d.MetricsInterval = flags.Int("xhyve-metrics-interval")
+	if d.MetricsInterval < 1 {
+		return fmt.Errorf("--xhyve-metrics-interval must be a positive number of seconds, got %d", d.MetricsInterval)
+	}
+	if err := d.setHookScripts(flags); err != nil {
+		return err
+	}
+	d.Hypervisor = flags.String("xhyve-hypervisor")
+	d.HyperkitPath = flags.String("xhyve-hyperkit-path")
+	d.VfkitPath = flags.String("xhyve-vfkit-path")
+	d.XhyveBinary = flags.String("xhyve-binary")
+	d.HelperPath = flags.String("xhyve-helper-path")
+	d.ExtraArgs = flags.StringSlice("xhyve-extra-args")
+	if d.CPUYield, err = parseCPUYield(flags.String("xhyve-cpu-yield")); err != nil {
+		return err
+	}
+	d.ProcessPriority = flags.String("xhyve-process-priority")
+	if err := validateProcessPriority(d.ProcessPriority); err != nil {
+		return err
+	}
+	if _, err := splitExtraArgs(d.ExtraArgs); err != nil {
+		return err
+	}
+	if d.XhyveBinary != "" && d.Hypervisor != hypervisorEmbedded {
+		return fmt.Errorf("--xhyve-binary can only be used with the %s hypervisor", hypervisorEmbedded)
+	}
+	if err := validateHypervisor(d.Hypervisor); err != nil {
+		return err
+	}
+	// hyperkit and vfkit only take a CPU count
+	if d.CPUTopology != "" && d.Hypervisor != hypervisorEmbedded && d.Hypervisor != hypervisorFake {
+		return fmt.Errorf("--xhyve-cpu-topology is only supported by the %s hypervisor", hypervisorEmbedded)
+	}
+	// and so may the xhyve builds of --xhyve-binary
+	if d.CPUTopology != "" && d.XhyveBinary != "" {
+		return fmt.Errorf("--xhyve-cpu-topology can not be used with --xhyve-binary, only the %s xhyve supports it", hypervisorEmbedded)
+	}
+	// the fake machine and vfkit have no vmnet DHCP server
+	if d.StaticIP != "" && (d.Hypervisor == hypervisorVZ || d.Hypervisor == hypervisorFake) {
+		return fmt.Errorf("--xhyve-static-ip can not be used with the %s hypervisor", d.Hypervisor)
+	}
+	if d.StaticIP != "" {
+		if err := checkStaticIPRoot(); err != nil {
+			return err
+		}
+	}
+	if d.ImportDisk != "" && d.Hypervisor == hypervisorFake {
+		return fmt.Errorf("--xhyve-import-disk can not be used with the %s hypervisor, it boots no disk", hypervisorFake)
+	}
+	d.Ephemeral = flags.Bool("xhyve-ephemeral")
+	if d.Ephemeral {
+		if d.DiskDir != "" {
+			return fmt.Errorf("--xhyve-ephemeral can not be used with --xhyve-disk-dir")
+		}
+		d.DiskDir = d.ephemeralDiskDir()
+	}
+	d.OrphanPolicy = flags.String("xhyve-orphan-policy")
+	if err := validateOrphanPolicy(d.OrphanPolicy); err != nil {
+		return err
+	}
+	if d.Hypervisor == hypervisorVZ {
+		if d.Qcow2 {
+			return fmt.Errorf("--xhyve-qcow2 is not supported by the %s hypervisor", hypervisorVZ)
+		}
+		// Virtualization.framework only attaches raw disk images
+		d.RawDisk = true
+		if err := d.checkVZKernel(); err != nil {
+			return err
+		}
+	}
+	if d.Hypervisor == hypervisorFake {
+		// the fake machine needs no disk device
+		d.RawDisk = true
+		if d.SSHPort == defaultSSHPort {
+			// its sshd listens on the host
+			port, err := freePort()
+			if err != nil {
+				return err
+			}
+			d.SSHPort = port
+		}
+	}
+	if d.EncryptDisk {
+		if err := d.validateEncryptDisk(); err != nil {
+			return err
+		}
+	}
+	if d.Bootrom != "" && d.Hypervisor != hypervisorVZ {
+		if _, err := os.Stat(d.Bootrom); err != nil {
+			return fmt.Errorf("Could not read the --xhyve-bootrom firmware: %s", err)
+		}
+	}
 
 	return nil
 }
@@ -273,20 +1024,17 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 // PreCommandCheck Check required of docker-machine-driver-xhyve before any func
 // func: GetURL, PreCreateCheck, Start, Stop, Restart
 func (d *Driver) PreCommandCheck() error {
-	bin, err := os.Stat(os.Args[0])
-	if err != nil {
-		return err
-	}
-
-	// Check of own binary owner and uid
-	if int(bin.Sys().(*syscall.Stat_t).Uid) != 0 {
-		return fmt.Errorf("%s binary needs root owner and uid. See https://github.com/zchee/docker-machine-driver-xhyve#install", bin.Name())
+	// Check of the owner and uid of the binary running the hypervisor
+	if bin := d.privilegedBinary(); bin != "" {
+		if err := d.checkSetuidRoot(bin); err != nil {
+			return err
+		}
 	}
 
 	// Check of execute user
 	user := syscall.Getuid()
 	if user == 0 {
-		return fmt.Errorf("%s needs to be executed with the privileges of the user. please remove sudo on execute command", bin.Name())
+		return fmt.Errorf("%s needs to be executed with the privileges of the user. please remove sudo on execute command", filepath.Base(os.Args[0]))
 	}
 
 	return nil
@@ -305,21 +1053,22 @@ func (d *Driver) GetURL() (string, error) {
 		return "", nil
 	}
 
-	// Wait for SSH over NAT to be available before returning to user
-	for {
-		err := drivers.WaitForSSH(d)
-		if err != nil {
-			time.Sleep(1 * time.Second)
-		} else {
-			break
+	// Start and Create return once SSH is available, only a starting machine
+	// has to be waited for
+	if d.isStarting() {
+		if err := d.waitForSSH(); err != nil {
+			return "", err
 		}
 	}
 
-	return fmt.Sprintf("tcp://%s:2376", ip), nil
+	return fmt.Sprintf("tcp://%s", net.JoinHostPort(ip, strconv.Itoa(dockerPort))), nil
 }
 
+// GetIP returns the IP address of the machine saved in its configuration,
+// as long as it answers. The DHCP leases are only read again when it does
+// not.
 func (d *Driver) GetIP() (string, error) {
-	s, err := d.GetState()
+	s, err := d.processState()
 	if err != nil {
 		return "", err
 	}
@@ -327,18 +1076,34 @@ func (d *Driver) GetIP() (string, error) {
 		return "", drivers.ErrHostIsNotRunning
 	}
 
-	if d.IPAddress != "" {
+	if d.IPAddress != "" && ipReachable(d.IPAddress, d.SSHPort) {
 		return d.IPAddress, nil
 	}
 
-	return d.getIPfromDHCPLease()
+	ip, err := d.getIPfromDHCPLease()
+	if err != nil {
+		if d.IPAddress != "" {
+			// the guest may only be too busy to answer
+			return d.IPAddress, nil
+		}
+		return "", err
+	}
+	if d.IPAddress != "" && ip != d.IPAddress {
+		log.Debugf("The IP address of %s changed from %s to %s", d.MachineName, d.IPAddress, ip)
+	}
+	d.IPAddress = ip
+	return ip, nil
 }
 
-func (d *Driver) GetState() (state.State, error) {
+// processState returns the state of the hypervisor process: Running, Paused
+// when it was stopped by SIGSTOP, or Stopped when it does not exist.
+func (d *Driver) processState() (state.State, error) {
 	pid, err := d.GetPid()
 	if err != nil {
-		// TODO: If err instead of nil, will be occurred error when first GetState() of Start()
-		return state.Error, nil
+		if d.handleOrphan() {
+			return state.Running, nil
+		}
+		return state.Stopped, nil
 	}
 
 	proc, err := os.FindProcess(int(pid))
@@ -347,6 +1112,9 @@ func (d *Driver) GetState() (state.State, error) {
 	}
 
 	if err := proc.Signal(syscall.Signal(0)); err != nil {
+		if d.handleOrphan() {
+			return state.Running, nil
+		}
 		return state.Stopped, nil
 	}
 
@@ -354,24 +1122,58 @@ func (d *Driver) GetState() (state.State, error) {
 	if err != nil {
 		return state.Error, err
 	}
-	// process name is truncated to 'docker-machine-d'
-	if !strings.Contains(psproc.Executable(), "docker-machine") {
+	if !strings.Contains(psproc.Executable(), d.backend().processName(d)) {
 		return state.Error, fmt.Errorf("Unable to find 'xhyve' process by PID: %d", pid)
 	}
 
+	if d.isProcessStopped(pid) {
+		return state.Paused, nil
+	}
 	return state.Running, nil
 }
 
 func (d *Driver) waitForIP() error {
 	var ip string
 	var err error
+	var staleErr error
+
+	defer d.markStarting()()
+
+	progress := &bootProgress{}
+	stop := make(chan struct{})
+	defer close(stop)
+	go d.followConsole(stop, progress.observe)
+
+	timeout, interval := d.BootTimeout, d.IPPollInterval
+	if timeout < 1 {
+		timeout = defaultBootTimeout
+	}
+	if interval < 1 {
+		interval = defaultIPPollInterval
+	}
+	attempts := timeout / interval
 
 	log.Infof("Waiting for VM to come online...")
-	for i := 1; i <= 60; i++ {
+	for i := 1; i <= attempts; i++ {
+		stage, consoleIP, panicMsg := progress.status()
+		if panicMsg != "" {
+			return fmt.Errorf("Machine failed to boot: %s. See %s for details", panicMsg, d.consoleLogPath())
+		}
+
 		ip, err = d.getIPfromDHCPLease()
+		if err == nil && ip != consoleIP {
+			if staleErr = d.verifyIP(ip); staleErr != nil {
+				log.Debugf("Not using the leased IP %s: %s", ip, staleErr)
+				ip, err = "", staleErr
+			}
+		}
+		if err != nil && consoleIP != "" && stage >= stageNetwork {
+			log.Debugf("No DHCP lease yet, using the IP announced on the console: %s", consoleIP)
+			ip, err = consoleIP, nil
+		}
 		if err != nil {
-			log.Debugf("Not there yet %d/%d, error: %s", i, 60, err)
-			time.Sleep(2 * time.Second)
+			log.Debugf("Not there yet %d/%d (%s), error: %s", i, attempts, stage, err)
+			time.Sleep(time.Duration(interval) * time.Second)
 			continue
 		}
 
@@ -383,20 +1185,50 @@ func (d *Driver) waitForIP() error {
 		}
 	}
 
+	if ip == "" && staleErr != nil {
+		return fmt.Errorf("Machine didn't answer on its leased IP after %d seconds: %s. See %s for details", timeout, staleErr, d.consoleLogPath())
+	}
 	if ip == "" {
-		return fmt.Errorf("Machine didn't return an IP after 120 seconds, aborting")
+		stage, _, _ := progress.status()
+		return fmt.Errorf("Machine didn't return an IP after %d seconds (last boot stage: %s), aborting. See %s for details", timeout, stage, d.consoleLogPath())
 	}
 
 	// Wait for SSH over NAT to be available before returning to user
-	if err := drivers.WaitForSSH(d); err != nil {
-		return err
+	return d.waitForSSH()
+}
+
+// waitForSSH waits up to SSHTimeout seconds for the guest to accept SSH
+// connections, so that Start and Create only return a machine docker-machine
+// can provision.
+func (d *Driver) waitForSSH() error {
+	timeout, interval := d.SSHTimeout, d.IPPollInterval
+	if timeout < 1 {
+		timeout = defaultSSHTimeout
+	}
+	if interval < 1 {
+		interval = defaultIPPollInterval
 	}
 
-	return nil
+	log.Infof("Waiting for SSH...")
+	deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+	for {
+		_, err := d.runSSHCommand("exit 0")
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s did not accept SSH connections on %s after %d seconds: %s", d.MachineName, d.IPAddress, timeout, err)
+		}
+		log.Debugf("SSH is not there yet: %s", err)
+		time.Sleep(time.Duration(interval) * time.Second)
+	}
 }
 
-// PreCreateCheck Prints driver version, and Check VirtualBox version
-func (d *Driver) PreCreateCheck() error {
+// PreCreateCheck Prints driver version, and Check the host can run xhyve
+func (d *Driver) PreCreateCheck() (err error) {
+	d.emitEvent("pre-create-check", "", eventStarted, nil)
+	defer d.machineReadable("pre-create-check", &err)
+
 	// Check required of docker-machine-driver-xhyve
 	if err := d.PreCommandCheck(); err != nil {
 		return err
@@ -407,155 +1239,262 @@ func (d *Driver) PreCreateCheck() error {
 	c := GitCommit
 	log.Debugf("===== Docker Machine %s Driver Version %s (%s) =====\n", d.DriverName(), v, c)
 
-	ver, err := vboxVersionDetect()
-	if ver == "" && err == nil {
-		return nil
+	hv, err := d.backend().version(d)
+	if err != nil {
+		log.Warnf("Unable to get the %s hypervisor version: %s", d.Hypervisor, err)
 	}
+	d.HypervisorVersion = hv
+	log.Debugf("===== Hypervisor %s Version %s =====\n", d.Hypervisor, hv)
+	if caps, err := json.Marshal(GetCapabilities()); err == nil {
+		log.Debugf("===== Driver capabilities %s =====\n", caps)
+	}
+
+	bin, err := d.hypervisorBinary()
 	if err != nil {
-		return fmt.Errorf("Error detecting VBox version: %s", err)
+		return err
+	}
+	if err := checkMacOSCompatibility(d.commands(), d.Hypervisor, bin); err != nil {
+		return err
+	}
+
+	// the fake hypervisor needs no Hypervisor.framework
+	if d.Hypervisor != hypervisorFake {
+		if err := checkHypervisorSupport(d.commands()); err != nil {
+			return err
+		}
+
+		if err := checkHypervisorConflicts(d.commands()); err != nil {
+			return err
+		}
 	}
-	if !strings.HasPrefix(ver, "5") {
-		return fmt.Errorf("Virtual Box version 4 or lower will cause a kernel panic" +
-			"if xhyve tries to run. You are running version: " +
-			ver +
-			"\n\t Please upgrade to version 5 at https://www.virtualbox.org/wiki/Downloads")
+
+	if err := d.checkVmnetConfig(); err != nil {
+		return err
+	}
+
+	if d.Template != "" {
+		if _, err := d.loadTemplate(); err != nil {
+			return err
+		}
+	}
+
+	if err := d.checkUUIDConflict(); err != nil {
+		return err
+	}
+
+	if d.SSHAgent {
+		if err := checkSSHAgent(); err != nil {
+			return err
+		}
+	}
+
+	if err := d.checkNonInteractiveSudo(); err != nil {
+		return err
+	}
+
+	if err := d.validateResources(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (d *Driver) Create() (err error) {
+	d.emitEvent("create", "", eventStarted, nil)
+	defer d.machineReadable("create", &err)
+	defer d.audit("create", &err)
+
+	if resumed, err := d.resumeCreate(); resumed {
+		return err
+	}
+	return d.runCreateSteps(nil)
+}
+
+func (d *Driver) Start() (err error) {
+	d.emitEvent("start", "", eventStarted, nil)
+	defer d.machineReadable("start", &err)
+	defer d.audit("start", &err)
+
+	if err := d.checkNonInteractiveSudo(); err != nil {
+		return err
+	}
+
+	if resumed, err := d.resumeCreate(); resumed {
+		return err
+	}
+
+	stopCleanup := cleanupOnInterrupt(d.releaseResources)
+	defer stopCleanup()
+
+	if err := d.runHook(hookPreStart); err != nil {
+		return err
+	}
+	if err := d.launch(); err != nil {
+		return err
+	}
+
+	if err := d.waitForIP(); err != nil {
+		return err
+	}
+
+	if err := d.setupMounts(); err != nil {
+		return err
 	}
 
+	d.runPostHook(hookPostStart)
 	return nil
 }
 
-func (d *Driver) Create() error {
-	if err := d.CopyIsoToMachineDir(d.Boot2DockerURL, d.MachineName); err != nil {
+// launch starts the hypervisor process of the machine.
+func (d *Driver) launch() error {
+	if err := d.PreCommandCheck(); err != nil {
 		return err
 	}
-
-	log.Infof("Creating VM...")
-	if err := os.MkdirAll(d.ResolveStorePath("."), 0755); err != nil {
+	if err := d.checkSSHKey(); err != nil {
 		return err
 	}
-
-	if err := d.extractKernelImages(); err != nil {
-		return err
+	// a second hypervisor would boot on the disk of the first one
+	if s, err := d.processState(); err == nil && s != state.Stopped {
+		return fmt.Errorf("%s is %s already", d.MachineName, strings.ToLower(s.String()))
 	}
 
-	log.Infof("Generating %dMB disk image...", d.DiskSize)
-
-	if d.Qcow2 {
-		if err := d.generateQcow2Image(d.DiskSize); err != nil {
-			return err
+	if d.DiskDir != "" {
+		if _, err := os.Stat(d.DiskDir); err != nil && d.Ephemeral {
+			if err := d.recreateEphemeralDisk(); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return fmt.Errorf("The disk directory %s of %s is missing, is its volume mounted?", d.DiskDir, d.MachineName)
 		}
-	} else if d.RawDisk {
-		if err := d.generateRawDiskImage(d.DiskSize); err != nil {
+	}
+	if err := d.followRename(); err != nil {
+		return err
+	}
+	if err := d.detectDiskFormat(); err != nil {
+		return err
+	}
+	// imported machines get their own UUID and static IP on this host
+	if d.MacAddr == "" {
+		if err := d.createUUID(); err != nil {
 			return err
 		}
-	} else {
-		if err := d.generateSparseBundleDiskImage(d.DiskSize); err != nil {
+		if err := d.createStaticIP(); err != nil {
 			return err
 		}
 	}
 
-	// Fix file permission root to current user for vmnet.framework
-	log.Infof("Fix file permission...")
-	os.Chown(d.ResolveStorePath("."), syscall.Getuid(), syscall.Getegid())
-	files, _ := ioutil.ReadDir(d.ResolveStorePath("."))
-	for _, f := range files {
-		log.Debugf(d.ResolveStorePath(f.Name()))
-		os.Chown(d.ResolveStorePath(f.Name()), syscall.Getuid(), syscall.Getegid())
-	}
-
-	if d.UUID == "" {
-		log.Infof("Generate UUID...")
-		d.UUID = uuidgen()
-		log.Debugf("Generated UUID: %s", d.UUID)
-	} else {
-		log.Infof("Using Supplied UUID: %s", d.UUID)
+	pid := d.pidfilePath()
+	if _, err := os.Stat(pid); err == nil {
+		os.Remove(pid)
 	}
 
-	log.Infof("Convert UUID to MAC address...")
-	rawUUID, err := d.getMACAdress()
-	if err != nil {
-		return fmt.Errorf("Could not convert the UUID to MAC address: %s", err.Error())
+	if err := d.refreshKernel(); err != nil {
+		return err
 	}
-	d.MacAddr = trimMacAddress(rawUUID)
-	log.Debugf("Converted MAC address: %s", d.MacAddr)
 
-	log.Infof("Starting %s...", d.MachineName)
-	if err := d.Start(); err != nil {
+	if err := d.attachDiskImage(); err != nil && d.EncryptDisk {
 		return err
 	}
+	d.rotateConsoleLog()
+	d.clearExitStatus()
 
-	return nil
-}
+	if d.Supervise {
+		return d.startSupervisor()
+	}
 
-func (d *Driver) Start() error {
-	if err := d.PreCommandCheck(); err != nil {
+	b := d.backend()
+	cmd, err := d.hypervisorCommand()
+	if err != nil {
 		return err
 	}
 
-	pid := d.ResolveStorePath(d.MachineName + ".pid")
-	if _, err := os.Stat(pid); err == nil {
-		os.Remove(pid)
+	p, err := d.startHypervisor(cmd)
+	if err != nil {
+		return err
 	}
 
-	d.attachDiskImage()
-
-	args := d.xhyveArgs()
-	args = append(args, "-F", fmt.Sprintf("%s", pid))
-	if len(d.Virtio9p) > 0 {
-		const virtio9pPciStartValue = 5
-		i := virtio9pPciStartValue
-		for _, virtioshare := range d.Virtio9p {
-			// In the following line, i-virtio9pPciStartValue is just so that the string "host-" starts from 0 and not from 5
-			args = append(args, "-s", fmt.Sprintf("%d,virtio-9p,host-%d=%s", i, i-virtio9pPciStartValue, virtioshare))
-			i++
+	if !b.writesPidfile() {
+		if err := ioutil.WriteFile(pid, []byte(strconv.Itoa(p.Pid())), 0644); err != nil {
+			return err
 		}
 	}
 
-	log.Debug(args)
-
-	cmd := exec.Command(os.Args[0], args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	err := cmd.Start()
-	if err != nil {
-		return err
+	for _, t := range []*backgroundTask{clockSyncTask, ttlTask, metricsTask} {
+		if err := t.start(d); err != nil {
+			log.Warnf("%s", err)
+		}
 	}
 
 	go func() {
-		err := cmd.Wait()
+		err := p.Wait()
 		if err != nil {
-			log.Error(err, cmd.Stdout, cmd.Stderr)
+			log.Errorf("The hypervisor of %s exited: %s. See %s for details", d.MachineName, err, d.hypervisorLogPath())
 		}
+		d.logHypervisorExit(err)
+		d.saveExitStatus(err)
 	}()
 
-	if err := d.waitForIP(); err != nil {
-		return err
-	}
+	return nil
+}
 
-	if err := d.setupMounts(); err != nil {
-		return err
+// hypervisorCommand returns the command running the hypervisor of the machine.
+func (d *Driver) hypervisorCommand() (*exec.Cmd, error) {
+	cmd, err := d.backend().command(d, d.hypervisorArgs())
+	if err != nil {
+		return nil, err
 	}
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%s", ConsoleLogEnv, d.consoleLogPath()))
+	return cmd, nil
+}
 
-	return nil
+// hypervisorArgs returns the xhyve arguments of the machine, with its shared
+// folders and --xhyve-extra-args.
+func (d *Driver) hypervisorArgs() []string {
+	args := d.xhyveArgs()
+	args = append(args, "-F", d.pidfilePath())
+	if len(d.Virtio9p) > 0 {
+		const virtio9pPciStartValue = 5
+		i := virtio9pPciStartValue
+		for _, virtioshare := range d.Virtio9p {
+			// In the following line, i-virtio9pPciStartValue is just so that the string "host-" starts from 0 and not from 5
+			args = append(args, "-s", fmt.Sprintf("%d,virtio-9p,host-%d=%s", i, i-virtio9pPciStartValue, virtioshare))
+			i++
+		}
+	}
+	extra, _ := splitExtraArgs(d.ExtraArgs)
+	return append(args, extra...)
 }
 
-func (d *Driver) Stop() error {
+func (d *Driver) Stop() (err error) {
+	d.emitEvent("stop", "", eventStarted, nil)
+	defer d.machineReadable("stop", &err)
+	defer d.audit("stop", &err)
+
 	if err := d.PreCommandCheck(); err != nil {
 		return err
 	}
 
-	log.Infof("Stopping %s ...", d.MachineName)
-	if err := d.SendSignal(syscall.SIGTERM); err != nil {
+	if err := d.runHook(hookPreStop); err != nil {
 		return err
 	}
+	log.Infof("Stopping %s ...", d.MachineName)
+	// the supervisor terminates the hypervisor without restarting it
+	if !d.signalSupervisor(syscall.SIGTERM) {
+		if err := d.SendSignal(syscall.SIGTERM); err != nil {
+			return err
+		}
+	}
+	// a paused hypervisor only handles SIGTERM once continued
+	if s, err := d.processState(); err == nil && s == state.Paused {
+		d.SendSignal(syscall.SIGCONT)
+	}
 
 	for {
-		s, err := d.GetState()
+		s, err := d.processState()
 		if err != nil {
 			return err
 		}
-		if s == state.Running {
+		if s == state.Running || s == state.Paused {
 			time.Sleep(1 * time.Second)
 		} else {
 			break
@@ -564,12 +1503,17 @@ func (d *Driver) Stop() error {
 
 	d.IPAddress = ""
 	d.detachDiskImage()
+	d.clearExitStatus()
 
 	return nil
 }
 
-func (d *Driver) Remove() error {
-	s, err := d.GetState()
+func (d *Driver) Remove() (err error) {
+	d.emitEvent("remove", "", eventStarted, nil)
+	defer d.machineReadable("remove", &err)
+	defer d.audit("remove", &err)
+
+	s, err := d.processState()
 	if err != nil {
 		if err == ErrMachineNotExist {
 			log.Infof("machine does not exist, assuming it has been removed already")
@@ -577,20 +1521,44 @@ func (d *Driver) Remove() error {
 		}
 		return err
 	}
-	if s == state.Running {
+	// Stop continues a paused hypervisor to stop it
+	if s == state.Running || s == state.Paused {
 		if err := d.Stop(); err != nil {
 			return err
 		}
 	}
 
+	if d.SecureRemove {
+		if err := d.wipeDiskImage(); err != nil {
+			return fmt.Errorf("Could not wipe the disk image of %s, it is not removed: %s", d.MachineName, err)
+		}
+	}
 	if err := d.removeDiskImage(); err != nil {
 		return err
 	}
+	if err := d.removeDiskKey(); err != nil {
+		if d.SecureRemove {
+			return err
+		}
+		log.Warnf("%s", err)
+	}
+	if d.Ephemeral {
+		if err := d.unmountEphemeralVolume(); err != nil {
+			log.Warnf("%s", err)
+		}
+	}
+
+	if err := d.removeLease(); err != nil {
+		log.Warnf("%s", err)
+	}
+	if err := d.unbindStaticIP(); err != nil {
+		log.Warnf("%s", err)
+	}
 
 	if len(d.NFSShares) > 0 {
 		log.Infof("Remove NFS share folder must be root. Please insert root password.")
 		for _, share := range d.NFSShares {
-			if _, err := nfsexports.Remove("", d.nfsExportIdentifier(share)); err != nil {
+			if _, err := nfsexports.Remove("", nfsExportIdentifier(d.MachineName, share)); err != nil {
 				log.Errorf("failed removing nfs share (%s): %s", share, err.Error())
 			}
 		}
@@ -599,6 +1567,8 @@ func (d *Driver) Remove() error {
 			log.Errorf("failed reload nfs daemon: %s", err.Error())
 		}
 	}
+
+	d.runPostHook(hookPostRemove)
 	return nil
 }
 
@@ -607,11 +1577,22 @@ func (d *Driver) Restart() error {
 		return err
 	}
 
-	s, err := d.GetState()
+	s, err := d.processState()
 	if err != nil {
 		return err
 	}
+	if s == state.Paused {
+		if err := d.Resume(); err != nil {
+			return err
+		}
+		s = state.Running
+	}
 	if s == state.Running {
+		err := d.rebootGuest()
+		if err == nil {
+			return nil
+		}
+		log.Warnf("Could not reboot %s, stopping it: %s", d.MachineName, err)
 		if err := d.Stop(); err != nil {
 			return err
 		}
@@ -626,6 +1607,7 @@ func (d *Driver) Restart() error {
 
 func (d *Driver) Kill() error {
 	log.Infof("Killing %s ...", d.MachineName)
+	d.signalSupervisor(syscall.SIGKILL)
 	if err := d.SendSignal(syscall.SIGKILL); err != nil {
 		return err
 	}
@@ -640,7 +1622,18 @@ func (d *Driver) setMachineNameIfNotSet() {
 }
 
 func (d *Driver) getIPfromDHCPLease() (string, error) {
+	if d.Hypervisor == hypervisorFake {
+		return d.fakeLeaseIP()
+	}
+	if d.StaticIP != "" && d.StaticIP != staticIPAuto {
+		// the DHCP server gives the machine the address bound to it
+		return d.StaticIP, nil
+	}
 	currentip, err := vmnet.GetIPAddressByMACAddress(d.MacAddr)
+	if currentip == "" && d.preset().leaseByHostname {
+		// the guest DHCP client does not identify itself by its MAC address
+		currentip, err = vmnet.GetIPAddressByName(d.hostname())
+	}
 	log.Debugf(currentip)
 
 	if currentip == "" {
@@ -651,8 +1644,12 @@ func (d *Driver) getIPfromDHCPLease() (string, error) {
 	return currentip, err
 }
 
+func (d *Driver) privateSSHKeyPath() string {
+	return d.ResolveStorePath("id_rsa")
+}
+
 func (d *Driver) publicSSHKeyPath() string {
-	return d.GetSSHKeyPath() + ".pub"
+	return d.privateSSHKeyPath() + ".pub"
 }
 
 func readLine(path string) (string, error) {
@@ -674,6 +1671,9 @@ func readLine(path string) (string, error) {
 
 func (d *Driver) extractKernelOptions() error {
 	volumeRootDir := d.ResolveStorePath(isoMountPath)
+	if d.BootCmd == "" {
+		d.BootCmd = d.preset().bootCmd
+	}
 	if d.BootCmd == "" {
 		err := filepath.Walk(volumeRootDir, func(path string, f os.FileInfo, err error) error {
 			if strings.Contains(path, "isolinux.cfg") {
@@ -691,6 +1691,7 @@ func (d *Driver) extractKernelOptions() error {
 		if d.BootCmd == "" {
 			return errors.New("Not able to parse isolinux.cfg, Please use --xhyve-boot-cmd option")
 		}
+		d.BootCmd = isolinuxHostRegexp.ReplaceAllString(d.BootCmd, "host={{.Hostname}}")
 	}
 
 	log.Debugf("Extracted Options %q", d.BootCmd)
@@ -698,76 +1699,165 @@ func (d *Driver) extractKernelOptions() error {
 }
 
 func (d *Driver) extractKernelImages() error {
+	sum, err := b2d.Checksum(d.ResolveStorePath(isoFilename))
+	if err != nil {
+		return err
+	}
+	d.ISOChecksum = sum
+
+	// kernels picked by the user are not cached
+	if d.kernelPath() != "" || d.initrdPath() != "" {
+		sum = ""
+	} else if d.loadCachedKernel(sum) {
+		return nil
+	}
+	userBootCmd := d.BootCmd
+
 	log.Debugf("Mounting %s", isoFilename)
 
 	volumeRootDir := d.ResolveStorePath(isoMountPath)
-	err := hdiutil("attach", d.ResolveStorePath(isoFilename), "-mountpoint", volumeRootDir)
+	unlock, err := d.lockCache(hdiutilLock)
 	if err != nil {
 		return err
 	}
-
-	log.Debugf("Extracting Kernel Options...")
-	if err := d.extractKernelOptions(); err != nil {
+	err = d.hdiutil("attach", d.ResolveStorePath(isoFilename), "-mountpoint", volumeRootDir)
+	unlock()
+	if err != nil {
 		return err
 	}
 
 	defer func() error {
 		log.Debugf("Unmounting %s", isoFilename)
-		return hdiutil("detach", volumeRootDir)
+		return d.hdiutil("detach", volumeRootDir)
 	}()
 
-	if d.BootKernel == "" && d.BootInitrd == "" {
+	log.Debugf("Extracting Kernel Options...")
+	if err := d.extractKernelOptions(); err != nil {
+		return err
+	}
+
+	kernel, initrd := d.kernelPath(), d.initrdPath()
+	bootKernel, err := resolveBootFile(kernel, volumeRootDir)
+	if err != nil {
+		return err
+	}
+	bootInitrd, err := resolveBootFile(initrd, volumeRootDir)
+	if err != nil {
+		return err
+	}
+
+	if bootKernel == "" || bootInitrd == "" {
 		err = filepath.Walk(volumeRootDir, func(path string, f os.FileInfo, err error) error {
-			if kernelRegexp.MatchString(path) {
-				d.BootKernel = path
-				_, d.Vmlinuz = filepath.Split(path)
+			if kernel == "" && d.preset().kernel.MatchString(path) {
+				bootKernel = path
 			}
-			if strings.Contains(path, "initrd") {
-				d.BootInitrd = path
-				_, d.Initrd = filepath.Split(path)
+			if initrd == "" && d.preset().initrd.MatchString(path) {
+				bootInitrd = path
 			}
 			return nil
 		})
 	}
 
-	if err != nil {
-		if err != nil || d.BootKernel == "" || d.BootInitrd == "" {
-			err = fmt.Errorf("==== Can't extract Kernel and Ramdisk file ====")
-			return err
-		}
+	if err != nil || bootKernel == "" || bootInitrd == "" {
+		return fmt.Errorf("==== Can't extract Kernel and Ramdisk file, use --xhyve-vmlinuz-path and --xhyve-initrd-path ====")
 	}
+	_, d.Vmlinuz = filepath.Split(bootKernel)
+	_, d.Initrd = filepath.Split(bootInitrd)
 
 	dest := d.ResolveStorePath(d.Vmlinuz)
-	log.Debugf("Extracting %s into %s", d.BootKernel, dest)
-	if err := mcnutils.CopyFile(d.BootKernel, dest); err != nil {
+	log.Debugf("Extracting %s into %s", bootKernel, dest)
+	if err := mcnutils.CopyFile(bootKernel, dest); err != nil {
 		return err
 	}
 
 	dest = d.ResolveStorePath(d.Initrd)
-	log.Debugf("Extracting %s into %s", d.BootInitrd, dest)
-	if err := mcnutils.CopyFile(d.BootInitrd, dest); err != nil {
+	log.Debugf("Extracting %s into %s", bootInitrd, dest)
+	if err := mcnutils.CopyFile(bootInitrd, dest); err != nil {
 		return err
 	}
 
+	if sum != "" {
+		// the boot command given by the user is not the one of the ISO
+		bootCmd := d.BootCmd
+		if userBootCmd != "" {
+			bootCmd = ""
+		}
+		if err := d.saveCachedKernel(sum, bootCmd); err != nil {
+			log.Debugf("Could not cache the kernel: %s", err)
+		}
+	}
+
 	return nil
 }
 
-func (d *Driver) generateRawDiskImage(size int64) error {
-	diskPath := filepath.Join(d.ResolveStorePath("."), d.MachineName+".rawdisk")
+// kernelPath returns the kernel path given by the user, if any.
+func (d *Driver) kernelPath() string {
+	if d.VmlinuzPath != "" {
+		return d.VmlinuzPath
+	}
+	return d.BootKernel
+}
 
-	f, err := os.OpenFile(diskPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
-	if err != nil {
-		if os.IsExist(err) {
-			return nil
+// initrdPath returns the initrd path given by the user, if any.
+func (d *Driver) initrdPath() string {
+	if d.InitrdPath != "" {
+		return d.InitrdPath
+	}
+	return d.BootInitrd
+}
+
+// resolveBootFile looks for a boot file given by the user inside the ISO
+// mounted at volumeRootDir first, then on the host.
+func resolveBootFile(path, volumeRootDir string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	for _, p := range []string{filepath.Join(volumeRootDir, path), path} {
+		if fi, err := os.Stat(p); err == nil && !fi.IsDir() {
+			return p, nil
 		}
+	}
+	return "", fmt.Errorf("%s not found in the ISO nor on the host", path)
+}
+
+// diskFilePath returns the path of the disk file name, in the --xhyve-disk-dir
+// of the machine or else in its directory.
+func (d *Driver) diskFilePath(name string) string {
+	if d.DiskDir != "" {
+		return filepath.Join(d.DiskDir, name)
+	}
+	return d.ResolveStorePath(name)
+}
+
+func (d *Driver) rawDiskPath() string {
+	return d.diskFilePath(d.MachineName + ".rawdisk")
+}
+
+func (d *Driver) generateRawDiskImage(size int64) error {
+	diskPath := d.rawDiskPath()
+	if _, err := os.Stat(diskPath); err == nil {
+		return nil
+	}
+	if err := createRawDisk(diskPath, d.DiskSize); err != nil {
 		return err
 	}
-	f.Close()
+	// the disk starts with the userdata.tar and its SSH key
+	return d.writeKeyBundle(diskPath)
+}
 
-	if err := os.Truncate(diskPath, d.DiskSize*1048576); err != nil {
+// createRawDisk creates the empty sparse raw disk image diskPath of size MB.
+func createRawDisk(diskPath string, size int64) error {
+	f, err := os.OpenFile(diskPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, privateFileMode)
+	if err != nil {
 		return err
 	}
+	f.Close()
+	return os.Truncate(diskPath, size*1048576)
+}
 
+// writeKeyBundle writes the userdata.tar of the machine at the start of the
+// disk diskPath, which boot2docker formats on its first boot.
+func (d *Driver) writeKeyBundle(diskPath string) error {
 	tarBuf, err := d.generateKeyBundle()
 	if err != nil {
 		return err
@@ -788,19 +1878,22 @@ func (d *Driver) generateRawDiskImage(size int64) error {
 	return nil
 }
 
-func (d *Driver) generateQcow2Image(size int64) error {
-	diskPath := filepath.Join(d.ResolveStorePath("."), d.MachineName+".qcow2")
-	opts := &qcow2.Opts{
+// qcow2Opts returns the options of the qcow2 disk image diskPath of size MB.
+func qcow2Opts(diskPath string, size int64) *qcow2.Opts {
+	return &qcow2.Opts{
 		Filename:      diskPath,
-		Size:          d.DiskSize * 107374,
+		Size:          size * 1048576,
 		Fmt:           qcow2.DriverQCow2,
 		ClusterSize:   65536,
 		Preallocation: qcow2.PREALLOC_MODE_OFF,
 		Encryption:    false,
 		LazyRefcounts: true,
 	}
+}
 
-	img, err := qcow2.Create(opts)
+func (d *Driver) generateQcow2Image(size int64) error {
+	diskPath := d.qcow2DiskPath()
+	img, err := qcow2.Create(qcow2Opts(diskPath, size))
 	if err != nil {
 		log.Error(err)
 	}
@@ -872,41 +1965,51 @@ func zeroFill(w io.Writer, n int64) error {
 	return nil
 }
 
+func (d *Driver) sparseBundlePath() string {
+	return d.diskFilePath(rootVolumeName + ".sparsebundle")
+}
+
 func (d *Driver) generateSparseBundleDiskImage(count int64) error {
-	diskPath := d.ResolveStorePath(rootVolumeName)
+	diskPath := d.diskFilePath(rootVolumeName)
 
-	if err := hdiutil("create", "-megabytes", fmt.Sprintf("%d", count), "-type", "SPARSEBUNDLE", diskPath); err != nil {
+	args := []string{"create", "-megabytes", fmt.Sprintf("%d", count), "-type", "SPARSEBUNDLE", diskPath}
+	if d.EncryptDisk {
+		passphrase, err := d.newDiskKey()
+		if err != nil {
+			return err
+		}
+		args = append(args, "-encryption", diskEncryption)
+		if out, err := d.commands().CombinedOutput(stdinPassCommand(passphrase, args...)); err != nil {
+			return fmt.Errorf("hdiutil create failed: %s", strings.TrimSpace(string(out)))
+		}
+	} else if err := d.hdiutil(args...); err != nil {
 		return err
 	}
 
 	if err := d.attachDiskImage(); err != nil {
 		return err
 	}
+	return d.writeKeyBundle(fmt.Sprintf("/dev/rdisk%d", d.DiskNumber))
+}
 
-	tarBuf, err := d.generateKeyBundle()
-	if err != nil {
-		return err
-	}
-
-	file, err := os.OpenFile(fmt.Sprintf("/dev/rdisk%d", d.DiskNumber), os.O_WRONLY, 0644)
+func (d *Driver) attachDiskImage() error {
+	diskPath := d.sparseBundlePath()
+	unlock, err := d.lockCache(hdiutilLock)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-	file.Seek(0, os.SEEK_SET)
-	_, err = file.Write(tarBuf.Bytes())
-	if err != nil {
-		return err
+	args := []string{"attach", "-nomount", "-noverify", "-noautofsck", diskPath}
+	cmd := exec.Command("hdiutil", args...)
+	if d.EncryptDisk {
+		passphrase, err := d.diskKey()
+		if err != nil {
+			unlock()
+			return err
+		}
+		cmd = stdinPassCommand(passphrase, args...)
 	}
-	file.Close()
-
-	return nil
-}
-
-func (d *Driver) attachDiskImage() error {
-	diskPath := d.ResolveStorePath(rootVolumeName + ".sparsebundle")
-	cmd := exec.Command("hdiutil", "attach", "-nomount", "-noverify", "-noautofsck", diskPath)
-	output, err := cmd.Output()
+	output, err := d.commands().Output(cmd)
+	unlock()
 	if err != nil {
 		return err
 	}
@@ -925,7 +2028,7 @@ func (d *Driver) attachDiskImage() error {
 }
 
 func (d *Driver) detachDiskImage() error {
-	if err := hdiutil("detach", fmt.Sprintf("/dev/disk%d", d.DiskNumber)); err != nil {
+	if err := d.hdiutil("detach", fmt.Sprintf("/dev/disk%d", d.DiskNumber)); err != nil {
 		return err
 	}
 
@@ -935,19 +2038,20 @@ func (d *Driver) detachDiskImage() error {
 }
 
 func (d *Driver) removeDiskImage() error {
-	diskPath := d.ResolveStorePath(rootVolumeName + ".sparsebundle")
-	return os.RemoveAll(diskPath)
+	if d.DiskDir != "" {
+		// docker-machine only removes the machine directory
+		return os.RemoveAll(d.DiskDir)
+	}
+	return os.RemoveAll(d.sparseBundlePath())
 }
 
-// Make a boot2docker userdata.tar key bundle
-func (d *Driver) generateKeyBundle() (*bytes.Buffer, error) {
-	magicString := "boot2docker, please format-me"
-
-	log.Infof("Creating SSH key...")
-	if err := ssh.GenerateSSHKey(d.GetSSHKeyPath()); err != nil {
-		return nil, err
-	}
+// magicString is the first file of the boot2docker userdata.tar, asking the
+// automount script to format the disk.
+const magicString = "boot2docker, please format-me"
 
+// Make a boot2docker userdata.tar key bundle, with the extra files of the
+// complete userdata bundle
+func (d *Driver) generateKeyBundle(files ...userdataFile) (*bytes.Buffer, error) {
 	buf := new(bytes.Buffer)
 	tw := tar.NewWriter(buf)
 
@@ -982,6 +2086,9 @@ func (d *Driver) generateKeyBundle() (*bytes.Buffer, error) {
 	if _, err := tw.Write([]byte(pubKey)); err != nil {
 		return nil, err
 	}
+	if err := addUserdataFiles(tw, files); err != nil {
+		return nil, err
+	}
 	if err := tw.Close(); err != nil {
 		return nil, err
 	}
@@ -1000,13 +2107,17 @@ func (d *Driver) setupVirt9pShare() error {
 		mountCommands = fmt.Sprintf("%s\\n", mountCommands)
 		fullMountPath := path.Clean(d.Virtio9pRoot + "/" + virtioShare)
 		mountCommands += fmt.Sprintf("sudo mkdir -p %s\\n", fullMountPath)
-		mountCommands += fmt.Sprintf("sudo mount -t 9p -o version=9p2000 -o trans=virtio -o uname=%s -o dfltuid=$(id -u docker) -o dfltgid=50 -o access=any host-%d %s", user.Username, i, fullMountPath)
+		if d.Hypervisor == hypervisorVZ {
+			mountCommands += fmt.Sprintf("sudo mount -t virtiofs host-%d %s", i, fullMountPath)
+		} else {
+			mountCommands += fmt.Sprintf("sudo mount -t 9p -o version=9p2000 -o trans=virtio -o uname=%s -o dfltuid=$(id -u docker) -o dfltgid=50 -o access=any host-%d %s", user.Username, i, fullMountPath)
+		}
 		i++
 	}
 
 	writeScriptCmd := fmt.Sprintf("echo -e \"%s\" | sh", mountCommands)
 
-	if _, err := drivers.RunSSHCommandFromDriver(d, writeScriptCmd); err != nil {
+	if _, err := d.runSSHCommand(writeScriptCmd); err != nil {
 		return err
 	}
 
@@ -1034,7 +2145,7 @@ func (d *Driver) setupNFSShare() error {
 		}
 		nfsConfig := fmt.Sprintf("%s %s -alldirs -mapall=%s", share, d.IPAddress, user.Username)
 
-		if _, err := nfsexports.Add("", d.nfsExportIdentifier(share), nfsConfig); err != nil {
+		if _, err := nfsexports.Add("", nfsExportIdentifier(d.MachineName, share), nfsConfig); err != nil {
 			if strings.Contains(err.Error(), "conflicts with existing export") {
 				log.Info("Conflicting NFS Share not setup and ignored:", err)
 				continue
@@ -1053,19 +2164,19 @@ func (d *Driver) setupNFSShare() error {
 
 	writeScriptCmd := fmt.Sprintf("echo -e \"%s\" | sh", mountCommands)
 
-	if _, err := drivers.RunSSHCommandFromDriver(d, writeScriptCmd); err != nil {
+	if _, err := d.runSSHCommand(writeScriptCmd); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (d *Driver) nfsExportIdentifier(path string) string {
-	return fmt.Sprintf("docker-machine-driver-xhyve %s-%s", d.MachineName, path)
+func nfsExportIdentifier(name, path string) string {
+	return fmt.Sprintf("docker-machine-driver-xhyve %s-%s", name, path)
 }
 
 func (d *Driver) GetPid() (int, error) {
-	p, err := ioutil.ReadFile(d.ResolveStorePath(d.MachineName + ".pid"))
+	p, err := ioutil.ReadFile(d.pidfilePath())
 	if err != nil {
 		return 0, err
 	}
@@ -1105,68 +2216,89 @@ func trimMacAddress(rawUUID string) string {
 }
 
 func (d *Driver) xhyveArgs() []string {
-	iso := d.ResolveStorePath(isoFilename)
+	args, _ := d.xhyveArgsWith(func(path string, write bool) (string, error) {
+		return path, nil
+	})
+	return args
+}
+
+// xhyveArgsWith returns the xhyve arguments of the machine with the files it
+// boots given by file, which returns the path the hypervisor opens for path,
+// writable or not.
+func (d *Driver) xhyveArgsWith(file func(path string, write bool) (string, error)) ([]string, error) {
+	var err error
+	open := func(path string, write bool) string {
+		if err == nil {
+			path, err = file(path, write)
+		}
+		return path
+	}
 
 	var diskImage string
 	if d.Qcow2 {
-		imgPath := fmt.Sprintf("file://%s", filepath.Join(d.ResolveStorePath("."), d.MachineName+".qcow2"))
+		imgPath := fmt.Sprintf("file://%s", open(d.qcow2DiskPath(), true))
 		diskImage = fmt.Sprintf("4:0,virtio-blk,%s,format=qcow", imgPath)
 	} else if d.RawDisk {
-		imgPath := fmt.Sprintf("%s", filepath.Join(d.ResolveStorePath("."), d.MachineName+".rawdisk"))
-		diskImage = fmt.Sprintf("4:0,virtio-blk,%s", imgPath)
+		diskImage = fmt.Sprintf("4:0,virtio-blk,%s", open(d.rawDiskPath(), true))
 	} else {
-		imgPath := fmt.Sprintf("/dev/rdisk%d", d.DiskNumber)
+		imgPath := open(fmt.Sprintf("/dev/rdisk%d", d.DiskNumber), true)
 		diskImage = fmt.Sprintf("4:0,ahci-hd,%s", imgPath)
 	}
 
-	vmlinuz := d.ResolveStorePath(d.Vmlinuz)
-	initrd := d.ResolveStorePath(d.Initrd)
-
-	return []string{
-		"xhyve",
-		"-A",
+	args := []string{"xhyve", "-A"}
+	for _, insn := range d.CPUYield {
+		args = append(args, cpuYieldArgs[insn])
+	}
+	args = append(args,
 		"-U", fmt.Sprintf("%s", d.UUID),
-		"-c", fmt.Sprintf("%d", d.CPU),
+		"-c", d.cpuArg(),
 		"-m", fmt.Sprintf("%dM", d.Memory),
 		"-l", "com1,autopty",
+		"-l", "com2,autopty",
 		"-s", "0:0,hostbridge",
 		"-s", "31,lpc",
 		"-s", "2:0,virtio-net",
-		"-s", fmt.Sprintf("3:0,ahci-cd,%s", iso),
 		"-s", diskImage,
-		"-f", fmt.Sprintf("kexec,%s,%s,%s", vmlinuz, initrd, d.BootCmd),
-	}
-}
+	)
 
-func (d *Driver) getMACAdress() (string, error) {
-	args := append(d.xhyveArgs(), "-M")
-
-	stdout := bytes.Buffer{}
+	if d.Bootrom != "" {
+		// the trailing commas are required by xhyve
+		args = append(args, "-f", fmt.Sprintf("bootrom,%s,,", open(d.Bootrom, false)))
+	} else {
+		vmlinuz := open(d.ResolveStorePath(d.Vmlinuz), false)
+		initrd := open(d.ResolveStorePath(d.Initrd), false)
+		args = append(args, "-f", fmt.Sprintf("kexec,%s,%s,%s", vmlinuz, initrd, d.kernelCmdline()))
+	}
 
-	cmd := exec.Command(os.Args[0], args...) // TODO: Should be possible without exec
-	log.Debugf("Running command: %s %s", os.Args[0], args)
+	if !d.preset().cloudImage {
+		args = append(args, "-s", fmt.Sprintf("3:0,ahci-cd,%s", open(d.ResolveStorePath(isoFilename), false)))
+	}
 
-	cmd.Stdout = &stdout
-	if err := cmd.Run(); err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			log.Debugf("Stderr: %s", exitErr.Stderr)
-		}
-		return "", err
+	if d.preset().seed != nil {
+		args = append(args, "-s", fmt.Sprintf("1:0,ahci-cd,%s", open(d.seedISOPath(), false)))
 	}
 
-	mac := bytes.TrimPrefix(stdout.Bytes(), []byte("MAC: "))
-	mac = bytes.TrimSpace(mac)
+	return args, err
+}
 
-	hw, err := net.ParseMAC(string(mac))
+// UpdateISOCache downloads the latest Boot2Docker release into the cache of
+// the machine store, unless it is cached already. It waits for the other
+// driver processes updating the cache.
+func (d *Driver) UpdateISOCache(isoURL string) error {
+	unlock, err := d.lockCache(isoCacheLock)
 	if err != nil {
-		return "", err
+		return err
 	}
-	return hw.String(), nil
+	defer unlock()
+	return d.updateISOCache(isoURL)
 }
 
-func (d *Driver) UpdateISOCache(isoURL string) error {
+// updateISOCache updates the cache, whose lock is held.
+func (d *Driver) updateISOCache(isoURL string) error {
+	b2d.ReleaseAPIURL = d.Boot2DockerReleaseURL
+	b2d.MirrorURL = d.Boot2DockerMirrorURL
+	b2d.Quiet = d.NonInteractive
 	b2d := b2d.NewB2dUtils(d.StorePath)
-	mcnutils := mcnutils.NewB2dUtils(d.StorePath)
 
 	// recreate the cache dir if it has been manually deleted
 	if _, err := os.Stat(b2d.ImgCachePath); os.IsNotExist(err) {
@@ -1184,35 +2316,106 @@ func (d *Driver) UpdateISOCache(isoURL string) error {
 		os.Chown(b2d.ImgCachePath, syscall.Getuid(), syscall.Getegid())
 	}
 
-	if isoURL != "" {
-		// Non-default B2D are not cached
+	if isoURL != "" || d.Boot2DockerVersion != "" {
+		// Non-default B2D are not cached, pinned releases are cached under their own name
 		return nil
 	}
 
 	exists := b2d.Exists()
 	if !exists {
+		if d.Offline {
+			return fmt.Errorf("No Boot2Docker ISO found in %s and --xhyve-offline is set", b2d.ImgCachePath)
+		}
 		log.Info("No default Boot2Docker ISO found locally, downloading the latest release...")
-		return mcnutils.DownloadLatestBoot2Docker("")
+		return b2d.DownloadLatest()
+	}
+
+	if d.Offline {
+		log.Infof("Offline mode, using the cached Boot2Docker ISO")
+		return nil
 	}
 
 	latest := b2d.IsLatest()
 	if !latest {
 		log.Info("Default Boot2Docker ISO is out-of-date, downloading the latest release...")
-		return mcnutils.DownloadLatestBoot2Docker("")
+		return b2d.DownloadLatest()
+	}
+
+	return nil
+}
+
+// copyPinnedISO copies the ISO of the pinned release from the cache,
+// downloading it first if needed.
+func (d *Driver) copyPinnedISO(b2dutils *b2d.B2dUtils, machineIsoPath string) error {
+	filename := b2dutils.VersionFilename(d.Boot2DockerVersion)
+	cachedISO := filepath.Join(b2dutils.ImgCachePath, filename)
+	if _, err := os.Stat(cachedISO); os.IsNotExist(err) {
+		if d.Offline {
+			return fmt.Errorf("Boot2Docker %s is not cached in %s and --xhyve-offline is set", d.Boot2DockerVersion, b2dutils.ImgCachePath)
+		}
+		if err := b2d.Download(b2dutils.ImgCachePath, filename, b2dutils.VersionURL(d.Boot2DockerVersion)); err != nil {
+			return err
+		}
+	}
+
+	log.Infof("Copying %s to %s...", cachedISO, machineIsoPath)
+	return CopyFile(cachedISO, machineIsoPath)
+}
+
+// localISOPath returns the absolute path of isoURL if it is a file:// URL or
+// a plain path, "~" standing for the home directory.
+func localISOPath(isoURL string) (string, bool) {
+	u, err := url.Parse(isoURL)
+	if err != nil || (u.Scheme != "" && u.Scheme != "file") {
+		return "", false
+	}
+
+	localPath := u.Path
+	if u.Scheme == "" {
+		localPath = isoURL
+	}
+	if localPath == "~" || strings.HasPrefix(localPath, "~/") {
+		localPath = filepath.Join(os.Getenv("HOME"), localPath[1:])
+	}
+	if abs, err := filepath.Abs(localPath); err == nil {
+		localPath = abs
+	}
+	return localPath, true
+}
+
+// verifyISO checks the ISO copied to the machine directory against the
+// --xhyve-boot2docker-checksum, if given.
+func (d *Driver) verifyISO() error {
+	if d.Boot2DockerChecksum == "" {
+		return nil
 	}
 
+	log.Infof("Verifying the checksum of %s...", isoFilename)
+	isoPath := d.ResolveStorePath(isoFilename)
+	if err := b2d.VerifyChecksum(isoPath, d.Boot2DockerChecksum); err != nil {
+		os.Remove(isoPath)
+		if d.Boot2DockerURL == "" {
+			return fmt.Errorf("%s. Remove the cached ISO at %s to download it again", err, filepath.Join(d.StorePath, "cache", defaultISOFilename))
+		}
+		return err
+	}
 	return nil
 }
 
 func (d *Driver) CopyIsoToMachineDir(isoURL, machineName string) error {
-	b2d := b2d.NewB2dUtils(d.StorePath)
-	mcnutils := mcnutils.NewB2dUtils(d.StorePath)
+	unlock, err := d.lockCache(isoCacheLock)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
-	if err := d.UpdateISOCache(isoURL); err != nil {
+	b2dutils := b2d.NewB2dUtils(d.StorePath)
+
+	if err := d.updateISOCache(isoURL); err != nil {
 		return err
 	}
 
-	isoPath := filepath.Join(b2d.ImgCachePath, isoFilename)
+	isoPath := filepath.Join(b2dutils.ImgCachePath, isoFilename)
 	if isoStat, err := os.Stat(isoPath); err == nil {
 		if int(isoStat.Sys().(*syscall.Stat_t).Uid) == 0 {
 			log.Debugf("Fix %s file permission...", isoStat.Name())
@@ -1224,18 +2427,35 @@ func (d *Driver) CopyIsoToMachineDir(isoURL, machineName string) error {
 	machineDir := filepath.Join(d.StorePath, "machines", machineName)
 	machineIsoPath := filepath.Join(machineDir, isoFilename)
 
+	// a pinned release is not the cached latest one
+	if d.Boot2DockerVersion != "" {
+		return d.copyPinnedISO(b2dutils, machineIsoPath)
+	}
+
 	// By default just copy the existing "cached" iso to the machine's directory...
-	defaultISO := filepath.Join(b2d.ImgCachePath, defaultISOFilename)
+	defaultISO := filepath.Join(b2dutils.ImgCachePath, defaultISOFilename)
 	if isoURL == "" {
 		log.Infof("Copying %s to %s...", defaultISO, machineIsoPath)
 		return CopyFile(defaultISO, machineIsoPath)
 	}
 
+	if localPath, ok := localISOPath(isoURL); ok {
+		if _, err := os.Stat(localPath); err != nil {
+			return fmt.Errorf("Could not use the boot2docker ISO %s: %s", isoURL, err)
+		}
+		log.Infof("Copying %s to %s...", localPath, machineIsoPath)
+		return CopyFile(localPath, machineIsoPath)
+	}
+
+	if d.Offline {
+		return fmt.Errorf("Can not download %s, --xhyve-offline is set", isoURL)
+	}
+
 	// if ISO is specified, check if it matches a github releases url or fallback to a direct download
-	downloadURL, err := b2d.GetReleaseURL(isoURL)
+	downloadURL, err := b2dutils.GetReleaseURL(isoURL)
 	if err != nil {
 		return err
 	}
 
-	return mcnutils.DownloadISO(machineDir, b2d.Filename(), downloadURL)
+	return b2d.Download(machineDir, b2dutils.Filename(), downloadURL)
 }
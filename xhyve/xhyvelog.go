@@ -0,0 +1,83 @@
+// Copyright 2015 The docker-machine-driver-xhyve Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xhyve
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+const (
+	hypervisorLogFilename = "xhyve.log"
+
+	// hypervisorLogMaxSize is the size over which the hypervisor log is
+	// rotated to xhyve.log.1 when the hypervisor starts
+	hypervisorLogMaxSize = 1024 * 1024
+)
+
+func (d *Driver) hypervisorLogPath() string {
+	return d.ResolveStorePath(hypervisorLogFilename)
+}
+
+// appendHypervisorLog writes a timestamped line to the hypervisor log.
+func (d *Driver) appendHypervisorLog(format string, args ...interface{}) {
+	f, err := openPrivateLog(d.hypervisorLogPath())
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "%s %s\n", time.Now().Format(time.RFC3339), fmt.Sprintf(format, args...))
+}
+
+// startHypervisor starts cmd with its output appended to the hypervisor log,
+// so that it outlives the driver and a failed start leaves its errors behind.
+// The start and the exit of each run are timestamped. The process gets the
+// --xhyve-process-priority of the machine. It returns the started process.
+func (d *Driver) startHypervisor(cmd *exec.Cmd) (Process, error) {
+	logPath := d.hypervisorLogPath()
+	if fi, err := os.Stat(logPath); err == nil && fi.Size() > hypervisorLogMaxSize {
+		os.Rename(logPath, logPath+".1")
+	}
+	d.appendHypervisorLog("Starting %s", strings.Join(cmd.Args, " "))
+
+	f, err := openPrivateLog(logPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cmd.Stdout = f
+	cmd.Stderr = f
+	if d.Hypervisor == hypervisorHyperkit {
+		os.Remove(d.hyperkitConsolePath())
+	}
+	p, err := d.commands().Start(cmd)
+	if err != nil {
+		d.appendHypervisorLog("Could not start: %s", err)
+		return nil, err
+	}
+	d.appendHypervisorLog("Started pid %d", p.Pid())
+	if err := d.setProcessPriority(p.Pid()); err != nil {
+		log.Warnf("%s", err)
+	}
+	if err := consoleLogTask.start(d); err != nil {
+		log.Warnf("%s", err)
+	}
+	return p, nil
+}
+
+// logHypervisorExit records the end of the run of the hypervisor waitErr was
+// returned for.
+func (d *Driver) logHypervisorExit(waitErr error) {
+	if waitErr == nil {
+		d.appendHypervisorLog("Exited")
+		return
+	}
+	d.appendHypervisorLog("Exited: %s", waitErr)
+}